@@ -0,0 +1,116 @@
+// Package acl decides which identities may do what to which paths. Rules
+// allow or deny operations on path prefixes and are read from a YAML or
+// JSON file.
+package acl
+
+import (
+	"fmt"
+	"github.com/rahulgovind/fastfs/transport"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"strings"
+)
+
+// Operation is a kind of client request
+type Operation string
+
+const (
+	Read   Operation = "read"
+	Write  Operation = "write"
+	Delete Operation = "delete"
+	List   Operation = "list"
+	Query  Operation = "query"
+	Admin  Operation = "admin"
+)
+
+var operations = map[Operation]bool{Read: true, Write: true, Delete: true, List: true, Query: true, Admin: true}
+
+// Rule allows and denies operations of Identity on paths starting with
+// Prefix. An Identity of "*" is everyone and "*" among the operations is
+// all of them.
+type Rule struct {
+	Identity string      `yaml:"identity"`
+	Prefix   string      `yaml:"prefix"`
+	Allow    []Operation `yaml:"allow"`
+	Deny     []Operation `yaml:"deny"`
+}
+
+// Policy is a set of rules. Of the rules matching a request the one with
+// the longest prefix decides, and denying wins over allowing at the same
+// length. Requests no rule matches are denied unless Default is allow.
+// transport.NodeIdentity may do everything, since nodes forward requests to
+// each other.
+type Policy struct {
+	Default string `yaml:"default"`
+	Rules   []Rule `yaml:"rules"`
+}
+
+// Load reads a policy from path
+func Load(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := new(Policy)
+	err = yaml.Unmarshal(data, p)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	err = p.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) validate() error {
+	if p.Default != "" && p.Default != "allow" && p.Default != "deny" {
+		return fmt.Errorf("default must be allow or deny, not %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		if rule.Identity == "" {
+			return fmt.Errorf("rule %d has no identity", i+1)
+		}
+		for _, op := range append(rule.Allow, rule.Deny...) {
+			if op != "*" && !operations[op] {
+				return fmt.Errorf("rule %d has unknown operation %q", i+1, op)
+			}
+		}
+	}
+	return nil
+}
+
+func includes(ops []Operation, op Operation) bool {
+	for _, o := range ops {
+		if o == op || o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns true if identity may do op on path
+func (p *Policy) Allowed(identity string, op Operation, path string) bool {
+	if identity == transport.NodeIdentity {
+		return true
+	}
+
+	longest, allowed := -1, p.Default == "allow"
+	for _, rule := range p.Rules {
+		if rule.Identity != identity && rule.Identity != "*" {
+			continue
+		}
+		if !strings.HasPrefix(path, rule.Prefix) {
+			continue
+		}
+
+		length := len(rule.Prefix)
+		if includes(rule.Deny, op) && length >= longest {
+			longest, allowed = length, false
+		} else if includes(rule.Allow, op) && length > longest {
+			longest, allowed = length, true
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,79 @@
+package acl
+
+import (
+	"github.com/rahulgovind/fastfs/transport"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	p := &Policy{
+		Rules: []Rule{
+			{Identity: "*", Prefix: "", Allow: []Operation{Read, List}},
+			{Identity: "analytics", Prefix: "logs/", Allow: []Operation{"*"}, Deny: []Operation{Delete}},
+			{Identity: "analytics", Prefix: "logs/private/", Deny: []Operation{Read}},
+			{Identity: "analytics", Prefix: "logs/private/shared/", Allow: []Operation{Read}},
+			{Identity: "ops", Prefix: "tmp/", Allow: []Operation{Write}},
+			{Identity: "*", Prefix: "tmp/", Deny: []Operation{Write}},
+		},
+	}
+
+	testCases := []struct {
+		identity string
+		op       Operation
+		path     string
+		allowed  bool
+	}{
+		{"anyone", Read, "data/a", true},
+		{"anyone", Write, "data/a", false},
+		{"analytics", Write, "logs/a", true},
+		{"analytics", Delete, "logs/a", false},
+		{"analytics", Write, "data/a", false},
+		{"analytics", Read, "logs/private/a", false},
+		{"analytics", Write, "logs/private/a", true},
+		{"analytics", Read, "logs/private/shared/a", true},
+		{"analytics", Read, "logs/privateer", true},
+		{"ops", Write, "tmp/a", false},
+		{"ops", Read, "tmp/a", true},
+		{"node1.internal", Delete, "data/a", false},
+		{transport.NodeIdentity, Admin, "", true},
+	}
+
+	for _, tc := range testCases {
+		if allowed := p.Allowed(tc.identity, tc.op, tc.path); allowed != tc.allowed {
+			t.Errorf("%v %v %v: got %v, expected %v", tc.identity, tc.op, tc.path, allowed, tc.allowed)
+		}
+	}
+}
+
+func TestDefault(t *testing.T) {
+	p := &Policy{Default: "allow", Rules: []Rule{
+		{Identity: "*", Prefix: "private/", Deny: []Operation{"*"}},
+	}}
+	if !p.Allowed("anyone", Write, "data/a") {
+		t.Error("Default allow denied a request no rule matches")
+	}
+	if p.Allowed("anyone", Read, "private/a") {
+		t.Error("Default allow overrode a matching deny")
+	}
+	if (&Policy{}).Allowed("anyone", Read, "data/a") {
+		t.Error("Requests are allowed without rules or default")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		policy Policy
+		valid  bool
+	}{
+		{Policy{Default: "allow"}, true},
+		{Policy{Default: "maybe"}, false},
+		{Policy{Rules: []Rule{{Prefix: "a/", Allow: []Operation{Read}}}}, false},
+		{Policy{Rules: []Rule{{Identity: "a", Allow: []Operation{"fly"}}}}, false},
+		{Policy{Rules: []Rule{{Identity: "a", Allow: []Operation{"*"}}}}, true},
+	}
+	for i, tc := range testCases {
+		if err := tc.policy.validate(); (err == nil) != tc.valid {
+			t.Errorf("Case %d: got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package acl
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time      time.Time
+	Identity  string
+	Remote    string
+	Operation Operation
+	Path      string
+	Method    string
+	URI       string
+}
+
+// AuditLog records denied requests as one JSON object per line
+type AuditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAuditLog appends to the file at path. With an empty path entries go
+// to the process log.
+func NewAuditLog(path string) (*AuditLog, error) {
+	a := new(AuditLog)
+	if path == "" {
+		return a, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	a.w = f
+	return a, nil
+}
+
+func (a *AuditLog) Record(entry AuditEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if a.w == nil {
+		log.Errorf("Denied: %s", data)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.w.Write(append(data, '\n'))
+	if err != nil {
+		log.Errorf("Writing audit log failed: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/rahulgovind/fastfs/acl"
+	"github.com/rahulgovind/fastfs/transport"
+	"net/http"
+	"time"
+)
+
+// operation returns what a request does and to which path. Setup is open
+// to every authenticated client.
+func operation(req *http.Request, cmd string, path string) (acl.Operation, string, bool) {
+	switch {
+	case cmd == "setup":
+		return "", "", false
+	case cmd == "presign" && req.URL.Query().Get("method") == "PUT":
+		return acl.Write, path, true
+	case cmd == "presign":
+		return acl.Read, path, true
+	case cmd == "admin" || cmd == "raft":
+		return acl.Admin, req.URL.Query().Get("prefix"), true
+	case req.Method == "HEAD":
+		return acl.Read, path, true
+	case cmd == "watch" || cmd == "ls":
+		return acl.List, path, true
+	case cmd == "lock" && req.Method == "GET":
+		return acl.List, path, true
+	case cmd == "lock" || cmd == "confirm":
+		return acl.Write, path, true
+	case req.Method == "PUT" || req.Method == "POST" || cmd == "put":
+		return acl.Write, path, true
+	case req.Method == "DELETE":
+		return acl.Delete, path, true
+	case cmd == "query":
+		return acl.Query, path, true
+	}
+	return acl.Read, path, true
+}
+
+// authorize returns true if the request may go ahead. Denied requests are
+// answered with 403 and recorded in the audit log.
+func (s *Server) authorize(w http.ResponseWriter, req *http.Request, cmd string, path string) bool {
+	if s.policy == nil {
+		return true
+	}
+	op, target, checked := operation(req, cmd, path)
+	if !checked {
+		return true
+	}
+
+	identity := transport.Identity(req)
+	if s.policy.Allowed(identity, op, target) {
+		return true
+	}
+
+	s.audit.Record(acl.AuditEntry{
+		Time:      time.Now(),
+		Identity:  identity,
+		Remote:    req.RemoteAddr,
+		Operation: op,
+		Path:      target,
+		Method:    req.Method,
+		URI:       req.RequestURI,
+	})
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
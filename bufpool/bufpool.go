@@ -0,0 +1,204 @@
+package bufpool
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Pool hands out reference counted block sized buffers. If the pool has an
+// arena, buffers are carved out of an anonymous mmap outside the Go heap so
+// large caches don't add to GC work. Once the arena is exhausted buffers
+// fall back to the heap.
+type Pool struct {
+	blockSize int64
+	heap      sync.Pool
+	arena     []byte
+	free      chan []byte
+
+	// Stats
+	InUse       int64
+	ArenaMisses int64
+}
+
+// Buffer is a block of data shared by the cache, downloaders and writers.
+// It starts with one reference. Everyone who keeps the buffer around must
+// Retain it and Release it when done. The memory is recycled when the last
+// reference is released.
+type Buffer struct {
+	pool *Pool
+	slot []byte
+	data []byte
+	refs int32
+
+	fromArena bool
+}
+
+// New returns a pool of heap allocated buffers
+func New(blockSize int64) *Pool {
+	p := new(Pool)
+	p.blockSize = blockSize
+	p.heap.New = func() interface{} {
+		return make([]byte, 0, blockSize)
+	}
+	return p
+}
+
+// NewArena returns a pool backed by an anonymous mmap of numBlocks blocks
+func NewArena(blockSize int64, numBlocks int64) (*Pool, error) {
+	p := New(blockSize)
+
+	arena, err := syscall.Mmap(-1, 0, int(blockSize*numBlocks),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+
+	p.arena = arena
+	p.free = make(chan []byte, numBlocks)
+	for i := int64(0); i < numBlocks; i += 1 {
+		p.free <- arena[i*blockSize : i*blockSize : (i+1)*blockSize]
+	}
+	return p, nil
+}
+
+func (p *Pool) BlockSize() int64 {
+	return p.blockSize
+}
+
+// OffHeap returns true if buffers are allocated outside the Go heap
+func (p *Pool) OffHeap() bool {
+	return p.arena != nil
+}
+
+// Get returns an empty buffer with one reference
+func (p *Pool) Get() *Buffer {
+	atomic.AddInt64(&p.InUse, 1)
+	b := &Buffer{pool: p, refs: 1}
+
+	if p.arena != nil {
+		select {
+		case slot := <-p.free:
+			b.slot = slot
+			b.fromArena = true
+		default:
+			atomic.AddInt64(&p.ArenaMisses, 1)
+		}
+	}
+
+	if b.slot == nil {
+		b.slot = p.heap.Get().([]byte)
+	}
+	b.data = b.slot[:0]
+	return b
+}
+
+func (p *Pool) put(b *Buffer) {
+	atomic.AddInt64(&p.InUse, -1)
+	if b.fromArena {
+		p.free <- b.slot[:0]
+	} else {
+		p.heap.Put(b.slot[:0])
+	}
+}
+
+// Close unmaps the arena. No buffers may be in use.
+func (p *Pool) Close() error {
+	if p.arena == nil {
+		return nil
+	}
+	err := syscall.Munmap(p.arena)
+	p.arena = nil
+	return err
+}
+
+// Wrap returns a buffer over b that doesn't belong to any pool
+func Wrap(b []byte) *Buffer {
+	return &Buffer{data: b, refs: 1}
+}
+
+// Bytes returns the contents of the buffer. Only valid while the caller
+// holds a reference.
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+func (b *Buffer) Len() int64 {
+	return int64(len(b.data))
+}
+
+// Write appends p to the buffer. Buffers that outgrow the block size are
+// moved to the heap.
+func (b *Buffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+// ReadFrom reads from r until EOF. The buffer only grows if r holds more
+// than fits, so a block sized read stays in its slot.
+func (b *Buffer) ReadFrom(r io.Reader) (int64, error) {
+	total := int64(0)
+	for {
+		if len(b.data) == cap(b.data) {
+			// Probe for EOF before growing
+			var scratch [1]byte
+			n, err := r.Read(scratch[:])
+			b.data = append(b.data, scratch[:n]...)
+			total += int64(n)
+			if err == io.EOF {
+				return total, nil
+			}
+			if err != nil {
+				return total, err
+			}
+			continue
+		}
+
+		n, err := r.Read(b.data[len(b.data):cap(b.data)])
+		b.data = b.data[:len(b.data)+n]
+		total += int64(n)
+
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(b.data)
+	return int64(n), err
+}
+
+func (b *Buffer) Reset() {
+	b.data = b.data[:0]
+}
+
+// Retain adds a reference to b
+func (b *Buffer) Retain() *Buffer {
+	atomic.AddInt32(&b.refs, 1)
+	return b
+}
+
+// Release drops a reference to b and recycles it if it was the last one
+func (b *Buffer) Release() {
+	refs := atomic.AddInt32(&b.refs, -1)
+	if refs < 0 {
+		panic("bufpool: buffer released too many times")
+	}
+	if refs == 0 && b.pool != nil {
+		b.pool.put(b)
+		b.slot = nil
+		b.data = nil
+	}
+}
+
+// Close releases the caller's reference so a Buffer can be handed out as a
+// cache.Reader
+func (b *Buffer) Close() error {
+	b.Release()
+	return nil
+}
@@ -1,65 +1,136 @@
 package badgercache
 
 import (
-	"bytes"
 	"github.com/dgraph-io/badger"
+	"github.com/rahulgovind/fastfs/cache/lruindex"
 	log "github.com/sirupsen/logrus"
+	"time"
 )
 
+// BadgerCache stores blocks in a badger database. Badger has no size
+// limit of its own so keys are evicted in LRU order by an index.
 type BadgerCache struct {
-	db *badger.DB
+	db    *badger.DB
+	index *lruindex.Index
+	ttl   time.Duration
+
+	// OnEvicted optionally specifies a callback function to be
+	// executed when an entry is purged from the cache.
+	OnEvicted func(key string)
 }
 
-func NewBadgerCache() *BadgerCache {
+// NewBadgerCache opens a cache in dir holding up to maxBytes of values.
+// Entries expire after ttl unless it is zero. Anything left in dir by an
+// earlier run is dropped.
+func NewBadgerCache(dir string, maxBytes int64, ttl time.Duration) *BadgerCache {
 	var err error
 	bc := new(BadgerCache)
-	bc.db, err = badger.Open(badger.DefaultOptions("/tmp/badger2"))
+	bc.ttl = ttl
+	bc.db, err = badger.Open(badger.DefaultOptions(dir))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = bc.db.DropAll()
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	bc.index = lruindex.New(maxBytes, ttl, bc.evict)
+	go bc.gc()
 	return bc
 }
 
 func (bc *BadgerCache) Add(key string, value []byte) {
-	bc.db.Update(func(txn *badger.Txn) error {
-		txn.Set([]byte(key), []byte(value))
-		return nil
+	err := bc.db.Update(func(txn *badger.Txn) error {
+		e := badger.NewEntry([]byte(key), value)
+		if bc.ttl > 0 {
+			e = e.WithTTL(bc.ttl)
+		}
+		return txn.SetEntry(e)
 	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	bc.index.Add(key, int64(len(value)))
 }
 
 func (bc *BadgerCache) Get(key string) ([]byte, bool) {
-	var buf bytes.Buffer
+	if !bc.index.Get(key) {
+		return nil, false
+	}
 
-	ok := false
+	var value []byte
 	err := bc.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(key))
-		if err == nil {
-			item.Value(func(v []byte) error {
-				buf.Write(v)
-				ok = true
-				return nil
-			})
+		if err != nil {
+			return err
 		}
-		return nil
+		value, err = item.ValueCopy(nil)
+		return err
 	})
+
+	if err == badger.ErrKeyNotFound {
+		bc.index.Remove(key)
+		return nil, false
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	return buf.Bytes(), ok
+	return value, true
 }
 
 func (bc *BadgerCache) Remove(key string) {
-	bc.db.Update(func(txn *badger.Txn) error {
-		txn.Delete([]byte(key))
-		return nil
+	bc.index.Remove(key)
+	bc.evict(key)
+}
+
+func (bc *BadgerCache) Contains(key string) bool {
+	return bc.index.Contains(key)
+}
+
+func (bc *BadgerCache) SetOnEvicted(f func(key string)) {
+	bc.OnEvicted = f
+}
+
+func (bc *BadgerCache) evict(key string) {
+	bc.delete(key)
+	if bc.OnEvicted != nil {
+		bc.OnEvicted(key)
+	}
+}
+
+func (bc *BadgerCache) delete(key string) {
+	err := bc.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
 	})
+	if err != nil {
+		log.Error(err)
+	}
 }
 
 func (bc *BadgerCache) Len() int64 {
-	return -1
+	return bc.index.Len()
+}
+
+// Size returns the total size in bytes of the cached values
+func (bc *BadgerCache) Size() int64 {
+	return bc.index.Size()
 }
 
 func (bc *BadgerCache) Clear() {
-	log.Info("Can't clear cache with badger")
-	return
+	bc.index.Clear()
+	err := bc.db.DropAll()
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// gc reclaims value log space of evicted blocks
+func (bc *BadgerCache) gc() {
+	for range time.Tick(5 * time.Minute) {
+		for bc.db.RunValueLogGC(0.5) == nil {
+		}
+	}
 }
@@ -1,5 +1,11 @@
 package cache
 
+import (
+	"github.com/rahulgovind/fastfs/bufpool"
+	"io"
+	"time"
+)
+
 type Cache interface {
 	Add(key string, value []byte)
 	Get(key string) ([]byte, bool)
@@ -7,3 +13,82 @@ type Cache interface {
 	Len() int64
 	Clear()
 }
+
+// Pinner is implemented by caches whose entries can be exempted from
+// eviction. A pin with a zero ttl lasts until the entry is unpinned.
+type Pinner interface {
+	Pin(key string, ttl time.Duration) bool
+	Unpin(key string)
+	UnpinPrefix(prefix string) int
+}
+
+// Usage is the quota and current usage of one cache namespace in bytes
+type Usage struct {
+	Prefix    string
+	MemBytes  int64
+	MemUsed   int64
+	DiskBytes int64
+	DiskUsed  int64
+	Entries   int64
+
+	// CompressionRatio is stored / raw bytes of the memory tier if it is compressed
+	CompressionRatio float64 `json:",omitempty"`
+}
+
+// UsageReporter is implemented by caches that track usage per namespace
+type UsageReporter interface {
+	Usage() []Usage
+}
+
+// Container is implemented by caches that can check for a key without
+// counting it as a use
+type Container interface {
+	Contains(key string) bool
+}
+
+// EvictionNotifier is implemented by caches that can report keys they
+// evict or remove
+type EvictionNotifier interface {
+	SetOnEvicted(f func(key string))
+}
+
+// BufferCache is implemented by caches that can hold pooled buffers
+// without copying them. AddBuffer takes its own reference to buf. The
+// buffer returned by GetBuffer must be released by the caller.
+type BufferCache interface {
+	AddBuffer(key string, buf *bufpool.Buffer)
+	GetBuffer(key string) (*bufpool.Buffer, bool)
+}
+
+// Reader streams one cached value. The value stays valid until Close.
+type Reader interface {
+	io.WriterTo
+	Len() int64
+	Close() error
+}
+
+// Opener is implemented by caches that can stream values without copying
+// them onto the heap first
+type Opener interface {
+	Open(key string) (Reader, bool)
+}
+
+type bytesReader []byte
+
+// NewBytesReader returns a Reader over b
+func NewBytesReader(b []byte) Reader {
+	return bytesReader(b)
+}
+
+func (b bytesReader) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (b bytesReader) Len() int64 {
+	return int64(len(b))
+}
+
+func (b bytesReader) Close() error {
+	return nil
+}
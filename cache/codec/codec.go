@@ -0,0 +1,183 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"sync/atomic"
+)
+
+// Codec compresses cache blocks. Implementations are safe for concurrent use.
+type Codec interface {
+	Name() string
+	// Encode returns the compressed form of src or nil if src
+	// can't be compressed
+	Encode(src []byte) []byte
+	Decode(src []byte) ([]byte, error)
+}
+
+var Codecs = []string{"snappy", "zstd", "lz4"}
+
+// New returns the codec with the given name. "none" and "" return nil.
+func New(name string) (Codec, error) {
+	switch name {
+	case "", "none":
+		return nil, nil
+	case "snappy":
+		return snappyCodec{}, nil
+	case "zstd":
+		return newZstdCodec()
+	case "lz4":
+		return lz4Codec{}, nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", name)
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) Encode(src []byte) []byte {
+	return snappy.Encode(nil, src)
+}
+
+func (snappyCodec) Decode(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdCodec() (*zstdCodec, error) {
+	var err error
+	zc := new(zstdCodec)
+	zc.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		return nil, err
+	}
+	zc.decoder, err = zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return zc, nil
+}
+
+func (zc *zstdCodec) Name() string {
+	return "zstd"
+}
+
+func (zc *zstdCodec) Encode(src []byte) []byte {
+	return zc.encoder.EncodeAll(src, nil)
+}
+
+func (zc *zstdCodec) Decode(src []byte) ([]byte, error) {
+	return zc.decoder.DecodeAll(src, nil)
+}
+
+// lz4Codec uses the lz4 block format. Blocks don't record their
+// uncompressed length so it is stored as a uvarint header.
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string {
+	return "lz4"
+}
+
+func (lz4Codec) Encode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64+lz4.CompressBlockBound(len(src)))
+	n := binary.PutUvarint(dst, uint64(len(src)))
+	m, err := lz4.CompressBlock(src, dst[n:], nil)
+	if err != nil || m == 0 {
+		return nil
+	}
+	return dst[:n+m]
+}
+
+func (lz4Codec) Decode(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errors.New("invalid lz4 block header")
+	}
+	dst := make([]byte, size)
+	m, err := lz4.UncompressBlock(src[n:], dst)
+	if err != nil {
+		return nil, err
+	}
+	return dst[:m], nil
+}
+
+// Adaptive compresses blocks with Codec and keeps them uncompressed if
+// they shrink by less than MaxRatio. After a run of incompressible blocks
+// only every ProbeInterval-th block is tried until compression starts
+// paying off again, so random or pre-compressed data costs little CPU.
+type Adaptive struct {
+	Codec         Codec
+	MaxRatio      float64
+	ProbeInterval int64
+
+	misses  int64
+	skipped int64
+
+	// Stats
+	Compressed int64
+	Bypassed   int64
+	BytesIn    int64
+	BytesOut   int64
+}
+
+func NewAdaptive(c Codec) *Adaptive {
+	return &Adaptive{
+		Codec:         c,
+		MaxRatio:      0.9,
+		ProbeInterval: 16,
+	}
+}
+
+// Compress returns the block to store and whether it is compressed
+func (a *Adaptive) Compress(src []byte) ([]byte, bool) {
+	atomic.AddInt64(&a.BytesIn, int64(len(src)))
+
+	if atomic.LoadInt64(&a.misses) >= 4 &&
+		atomic.AddInt64(&a.skipped, 1)%a.ProbeInterval != 0 {
+		return a.bypass(src)
+	}
+
+	out := a.Codec.Encode(src)
+	if out == nil || float64(len(out)) > a.MaxRatio*float64(len(src)) {
+		atomic.AddInt64(&a.misses, 1)
+		return a.bypass(src)
+	}
+
+	atomic.StoreInt64(&a.misses, 0)
+	atomic.AddInt64(&a.Compressed, 1)
+	atomic.AddInt64(&a.BytesOut, int64(len(out)))
+	return out, true
+}
+
+func (a *Adaptive) bypass(src []byte) ([]byte, bool) {
+	atomic.AddInt64(&a.Bypassed, 1)
+	atomic.AddInt64(&a.BytesOut, int64(len(src)))
+	return src, false
+}
+
+func (a *Adaptive) Decompress(data []byte, compressed bool) ([]byte, error) {
+	if !compressed {
+		return data, nil
+	}
+	return a.Codec.Decode(data)
+}
+
+// Ratio returns stored bytes / input bytes over the lifetime of a
+func (a *Adaptive) Ratio() float64 {
+	in := atomic.LoadInt64(&a.BytesIn)
+	if in == 0 {
+		return 1
+	}
+	return float64(atomic.LoadInt64(&a.BytesOut)) / float64(in)
+}
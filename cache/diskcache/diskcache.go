@@ -2,9 +2,13 @@ package diskcache
 
 import (
 	"container/list"
+	"github.com/rahulgovind/fastfs/bufpool"
+	"github.com/rahulgovind/fastfs/cache"
 	"github.com/rahulgovind/fastfs/fileio"
 	log "github.com/sirupsen/logrus"
+	"strings"
 	"sync"
+	"time"
 )
 
 // DiskCache is an LRU cache. It is not safe for concurrent access.
@@ -13,6 +17,10 @@ type DiskCache struct {
 	// an item is evicted. Zero means no limit.
 	MaxEntries int64
 
+	// TTL is how long entries stay valid after they are added. Zero
+	// means forever.
+	TTL time.Duration
+
 	// OnEvicted optionally specifies a callback function to be
 	// executed when an entry is purged from the cache.
 	OnEvicted func(key Key)
@@ -20,8 +28,13 @@ type DiskCache struct {
 	ll        *list.List
 	cache     map[interface{}]*list.Element
 	blockSize int64
+	size      int64
 	bm        *fileio.BlockManager
 
+	// pinnedLen counts pinned entries. Pins are refused once they would
+	// fill MaxEntries so eviction always has something to remove.
+	pinnedLen int64
+
 	mu sync.RWMutex
 }
 
@@ -32,6 +45,20 @@ type entry struct {
 	key     string
 	blockId int64
 	length  int64
+	expiry  time.Time
+
+	// pinned entries are skipped by RemoveOldest until pinExpiry passes.
+	// A zero pinExpiry keeps the entry pinned until it is unpinned.
+	pinned    bool
+	pinExpiry time.Time
+}
+
+func (e *entry) isPinned(now time.Time) bool {
+	return e.pinned && (e.pinExpiry.IsZero() || now.Before(e.pinExpiry))
+}
+
+func (e *entry) isExpired(now time.Time) bool {
+	return !e.expiry.IsZero() && now.After(e.expiry)
 }
 
 // NewDiskCache creates a new DiskCache.
@@ -48,6 +75,12 @@ func NewDiskCache(maxEntries int64, blockSize int64, filename string, iotype int
 
 // Add adds a value to the cache.
 func (c *DiskCache) Add(key string, value []byte) {
+	c.AddBuffer(key, bufpool.Wrap(value))
+}
+
+// AddBuffer adds the contents of buf. The cache holds a reference to buf
+// until it has been written to disk.
+func (c *DiskCache) AddBuffer(key string, buf *bufpool.Buffer) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -56,14 +89,32 @@ func (c *DiskCache) Add(key string, value []byte) {
 		c.ll = list.New()
 	}
 
-	if ee, ok := c.cache[key]; ok {
+	if ee, ok := c.lookup(key); ok {
 		c.ll.MoveToFront(ee)
 		//c.removeElement(ee)
 		return
 	}
 
-	blockId, _ := c.bm.Put(value)
-	ele := c.ll.PushFront(&entry{key, blockId, int64(len(value))})
+	blockId, err := c.bm.PutBuffer(buf)
+	if err != nil && c.removeOldest() {
+		// Slots of evicted blocks are held until their readers close.
+		// Evicting one more may free a slot that isn't being read.
+		blockId, err = c.bm.PutBuffer(buf)
+	}
+	if err != nil {
+		// The value is dropped so report it as evicted
+		log.Errorf("Failed to store %v on disk: %v", key, err)
+		if c.OnEvicted != nil {
+			c.OnEvicted(key)
+		}
+		return
+	}
+	e := &entry{key: key, blockId: blockId, length: buf.Len()}
+	if c.TTL > 0 {
+		e.expiry = time.Now().Add(c.TTL)
+	}
+	ele := c.ll.PushFront(e)
+	c.size += buf.Len()
 
 	c.cache[key] = ele
 	if c.MaxEntries != 0 && int64(c.ll.Len()) > c.MaxEntries {
@@ -80,7 +131,7 @@ func (c *DiskCache) Get(key string) (value []byte, ok bool) {
 		return
 	}
 
-	if ele, hit := c.cache[key]; hit {
+	if ele, hit := c.lookup(key); hit {
 		c.ll.MoveToFront(ele)
 		blockId := ele.Value.(*entry).blockId
 		data, _ := c.bm.Get(blockId, ele.Value.(*entry).length)
@@ -89,6 +140,65 @@ func (c *DiskCache) Get(key string) (value []byte, ok bool) {
 	return
 }
 
+// GetBuffer is Get wrapped in a buffer
+func (c *DiskCache) GetBuffer(key string) (*bufpool.Buffer, bool) {
+	data, ok := c.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return bufpool.Wrap(data), true
+}
+
+// Open returns a reader that streams the value of key from disk. Reading
+// doesn't block eviction. The evicted block is reclaimed once the reader
+// is closed.
+func (c *DiskCache) Open(key string) (cache.Reader, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cache == nil {
+		return nil, false
+	}
+
+	if ele, hit := c.lookup(key); hit {
+		c.ll.MoveToFront(ele)
+		e := ele.Value.(*entry)
+		if br := c.bm.Open(e.blockId, e.length); br != nil {
+			return br, true
+		}
+	}
+	return nil, false
+}
+
+// Contains checks for key without updating its recency
+func (c *DiskCache) Contains(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.cache[key]
+	return ok
+}
+
+// SetOnEvicted sets OnEvicted to call f with the evicted key
+func (c *DiskCache) SetOnEvicted(f func(key string)) {
+	c.OnEvicted = func(key Key) {
+		f(key.(string))
+	}
+}
+
+// lookup returns the element of key, dropping it if it has expired
+func (c *DiskCache) lookup(key string) (*list.Element, bool) {
+	ele, hit := c.cache[key]
+	if !hit {
+		return nil, false
+	}
+	if ele.Value.(*entry).isExpired(time.Now()) {
+		c.removeElement(ele)
+		return nil, false
+	}
+	return ele, true
+}
+
 // Remove removes the provided key from the cache.
 func (c *DiskCache) Remove(key string) {
 	c.mu.Lock()
@@ -102,23 +212,116 @@ func (c *DiskCache) Remove(key string) {
 	}
 }
 
-// RemoveOldest removes the oldest item from the cache.
+// RemoveOldest removes the oldest unpinned item from the cache.
 func (c *DiskCache) RemoveOldest() {
+	c.removeOldest()
+}
+
+func (c *DiskCache) removeOldest() bool {
 	if c.cache == nil {
-		return
+		return false
 	}
 
 	log.Info("Evicting from disk")
-	ele := c.ll.Back()
-	if ele != nil {
-		c.removeElement(ele)
+	now := time.Now()
+	for ele := c.ll.Back(); ele != nil; ele = ele.Prev() {
+		if !ele.Value.(*entry).isPinned(now) {
+			c.removeElement(ele)
+			return true
+		}
+	}
+	return false
+}
+
+// Pin exempts key from eviction for ttl, or until Unpin if ttl is zero.
+// Returns false if the key is not in the cache or pinning it would exceed
+// MaxEntries.
+func (c *DiskCache) Pin(key string, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cache == nil {
+		return false
+	}
+	if ele, hit := c.cache[key]; hit {
+		e := ele.Value.(*entry)
+		if !c.pin(e) {
+			return false
+		}
+		e.pinExpiry = time.Time{}
+		if ttl > 0 {
+			e.pinExpiry = time.Now().Add(ttl)
+		}
+		return true
+	}
+	return false
+}
+
+// Unpin makes key eligible for eviction again.
+func (c *DiskCache) Unpin(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cache == nil {
+		return
+	}
+	if ele, hit := c.cache[key]; hit {
+		c.unpin(ele.Value.(*entry))
+	}
+}
+
+// UnpinPrefix unpins every key starting with prefix and returns how many
+// pinned entries were released.
+func (c *DiskCache) UnpinPrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key, ele := range c.cache {
+		e := ele.Value.(*entry)
+		if e.pinned && strings.HasPrefix(key.(string), prefix) {
+			c.unpin(e)
+			n += 1
+		}
+	}
+	return n
+}
+
+// pin marks e pinned if the pinned entries still fit in MaxEntries.
+// Expired pins are released first if they don't.
+func (c *DiskCache) pin(e *entry) bool {
+	if e.pinned {
+		return true
+	}
+	if c.MaxEntries != 0 && c.pinnedLen >= c.MaxEntries {
+		now := time.Now()
+		for _, ele := range c.cache {
+			if pe := ele.Value.(*entry); pe.pinned && !pe.isPinned(now) {
+				c.unpin(pe)
+			}
+		}
+		if c.pinnedLen >= c.MaxEntries {
+			return false
+		}
+	}
+	e.pinned = true
+	c.pinnedLen += 1
+	return true
+}
+
+func (c *DiskCache) unpin(e *entry) {
+	if e.pinned {
+		e.pinned = false
+		c.pinnedLen -= 1
 	}
 }
 
 func (c *DiskCache) removeElement(e *list.Element) {
 	c.ll.Remove(e)
 	kv := e.Value.(*entry)
+	c.unpin(kv)
 	delete(c.cache, kv.key)
+	c.size -= kv.length
 	//logrus.Debug("Freeing block ", kv.blockId)
 	c.bm.Free(kv.blockId)
 
@@ -138,6 +341,14 @@ func (c *DiskCache) Len() int64 {
 	return int64(c.ll.Len())
 }
 
+// Size returns the total size in bytes of the cached values.
+func (c *DiskCache) Size() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.size
+}
+
 // Clear purges all stored items from the cache.
 func (c *DiskCache) Clear() {
 	c.mu.Lock()
@@ -152,4 +363,6 @@ func (c *DiskCache) Clear() {
 	}
 	c.ll = nil
 	c.cache = nil
+	c.size = 0
+	c.pinnedLen = 0
 }
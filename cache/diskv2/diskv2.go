@@ -1,42 +1,113 @@
 package diskv2
 
-import "github.com/peterbourgon/diskv"
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/peterbourgon/diskv"
+	"github.com/rahulgovind/fastfs/cache/lruindex"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
 
+// DiskV2Cache stores one file per block with diskv. Keys are evicted in
+// LRU order by an index.
 type DiskV2Cache struct {
-	dv *diskv.Diskv
+	dv    *diskv.Diskv
+	index *lruindex.Index
+
+	// OnEvicted optionally specifies a callback function to be
+	// executed when an entry is purged from the cache.
+	OnEvicted func(key string)
 }
 
-func NewDiskV2Cache(dir string, maxEntries int) *DiskV2Cache {
-	flatTransform := func(s string) []string { return []string{} }
+// NewDiskV2Cache creates a cache in dir holding up to maxBytes of values.
+// Entries expire after ttl unless it is zero. Anything left in dir by an
+// earlier run is erased.
+func NewDiskV2Cache(dir string, maxBytes int64, ttl time.Duration) *DiskV2Cache {
+	// Spread files over 256 directories
+	transform := func(s string) []string { return []string{s[:2]} }
 	d := new(DiskV2Cache)
 	d.dv = diskv.New(diskv.Options{
-		BasePath:     dir,
-		Transform:    flatTransform,
-		CacheSizeMax: uint64(maxEntries),
+		BasePath:  dir,
+		Transform: transform,
 	})
+
+	err := d.dv.EraseAll()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	d.index = lruindex.New(maxBytes, ttl, d.evict)
 	return d
 }
 
+// Cache keys are paths, so they are hashed to get valid file names
+func fileKey(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
 func (d *DiskV2Cache) Add(key string, value []byte) {
-	d.dv.Write(key, value)
+	err := d.dv.Write(fileKey(key), value)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	d.index.Add(key, int64(len(value)))
 }
 
 func (d *DiskV2Cache) Get(key string) ([]byte, bool) {
-	if d.dv.Has(key) {
-		value, _ := d.dv.Read(key)
-		return value, true
+	if !d.index.Get(key) {
+		return nil, false
+	}
+
+	value, err := d.dv.Read(fileKey(key))
+	if err != nil {
+		log.Error(err)
+		d.index.Remove(key)
+		return nil, false
 	}
-	return nil, false
+	return value, true
 }
 
 func (d *DiskV2Cache) Clear() {
-	d.dv.EraseAll()
+	d.index.Clear()
+	err := d.dv.EraseAll()
+	if err != nil {
+		log.Error(err)
+	}
 }
 
-func (d *DiskV2Cache) Len() int {
-	return -1
+func (d *DiskV2Cache) Len() int64 {
+	return d.index.Len()
+}
+
+// Size returns the total size in bytes of the cached values
+func (d *DiskV2Cache) Size() int64 {
+	return d.index.Size()
 }
 
 func (d *DiskV2Cache) Remove(key string) {
-	d.dv.Erase(key)
+	d.index.Remove(key)
+	d.evict(key)
+}
+
+func (d *DiskV2Cache) Contains(key string) bool {
+	return d.index.Contains(key)
+}
+
+func (d *DiskV2Cache) SetOnEvicted(f func(key string)) {
+	d.OnEvicted = f
+}
+
+func (d *DiskV2Cache) evict(key string) {
+	d.erase(key)
+	if d.OnEvicted != nil {
+		d.OnEvicted(key)
+	}
+}
+
+func (d *DiskV2Cache) erase(key string) {
+	// Erase fails for keys that were never written
+	d.dv.Erase(fileKey(key))
 }
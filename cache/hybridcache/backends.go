@@ -0,0 +1,50 @@
+package hybridcache
+
+import (
+	"fmt"
+	"github.com/rahulgovind/fastfs/cache"
+	"github.com/rahulgovind/fastfs/cache/badgercache"
+	"github.com/rahulgovind/fastfs/cache/diskcache"
+	"github.com/rahulgovind/fastfs/cache/diskv2"
+	"github.com/rahulgovind/fastfs/fileio"
+	"time"
+)
+
+// DiskFactory creates the disk tier of namespace id holding up to maxBytes.
+// The default namespace has id 0.
+type DiskFactory func(id int, maxBytes int64) cache.Cache
+
+var DiskBackends = []string{"blockmanager", "badger", "diskv"}
+
+// NewDiskFactory returns a factory for the named disk backend. The default
+// namespace is stored at location and namespace N at location-N.
+func NewDiskFactory(backend string, location string, blockSize int64, ttl time.Duration) (DiskFactory, error) {
+	switch backend {
+	case "", "blockmanager":
+		return blockManagerFactory(location, blockSize, fileio.FileInterface, ttl), nil
+	case "badger":
+		return func(id int, maxBytes int64) cache.Cache {
+			return badgercache.NewBadgerCache(diskPath(location, id), maxBytes, ttl)
+		}, nil
+	case "diskv":
+		return func(id int, maxBytes int64) cache.Cache {
+			return diskv2.NewDiskV2Cache(diskPath(location, id), maxBytes, ttl)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown disk backend %q", backend)
+}
+
+func blockManagerFactory(location string, blockSize int64, iotype int, ttl time.Duration) DiskFactory {
+	return func(id int, maxBytes int64) cache.Cache {
+		dc := diskcache.NewDiskCache(maxBytes/blockSize, blockSize, diskPath(location, id), iotype)
+		dc.TTL = ttl
+		return dc
+	}
+}
+
+func diskPath(location string, id int) string {
+	if id == 0 {
+		return location
+	}
+	return fmt.Sprintf("%s-%d", location, id)
+}
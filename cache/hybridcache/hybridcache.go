@@ -1,58 +1,203 @@
 package hybridcache
 
 import (
+	"fmt"
+	"github.com/rahulgovind/fastfs/bufpool"
 	"github.com/rahulgovind/fastfs/cache"
-	"github.com/rahulgovind/fastfs/cache/diskcache"
+	"github.com/rahulgovind/fastfs/cache/codec"
 	"github.com/rahulgovind/fastfs/cache/memcache"
 	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
 )
 
 type HybridCache struct {
-	mc *memcache.MemCache
-	dc cache.Cache
+	// OnEvicted optionally specifies a callback executed when a key is
+	// evicted or removed from the cache. Blocks moving from memory to
+	// disk don't count. Disk hits are copied to memory, so a key reported
+	// by the disk tier may still be cached in memory. Check Contains.
+	OnEvicted func(key string)
+
+	// def holds every key that doesn't fall under a configured namespace
+	def        *Namespace
+	namespaces []*Namespace
+
+	blockSize  int64
+	newDisk    DiskFactory
+	compressor *codec.Adaptive
+	pool       *bufpool.Pool
 }
 
 func NewHybridCache(maxMemEntries int64, dc cache.Cache) *HybridCache {
 	hc := new(HybridCache)
-	hc.mc = memcache.NewMemCache(maxMemEntries)
-	hc.dc = dc
-	hc.mc.OnEvicted = hc.handleMemEvict
+	hc.def = newNamespace("", memcache.NewMemCache(maxMemEntries), dc, hc.handleEvicted)
 	return hc
 }
 
 func NewMemDiskHybridCache(maxMemEntries int64, maxDiskEntries int64, blockSize int64,
 	filename string, iotype int) *HybridCache {
+	return NewHybridCacheWithDisk(maxMemEntries, maxDiskEntries*blockSize, blockSize,
+		blockManagerFactory(filename, blockSize, iotype, 0))
+}
+
+// NewHybridCacheWithDisk creates a cache whose disk tiers are created by
+// newDisk, for the default namespace and every namespace added later
+func NewHybridCacheWithDisk(maxMemEntries int64, maxDiskBytes int64, blockSize int64,
+	newDisk DiskFactory) *HybridCache {
 	hc := new(HybridCache)
-	hc.mc = memcache.NewMemCache(maxMemEntries)
-	hc.dc = diskcache.NewDiskCache(maxDiskEntries, blockSize, filename, iotype)
-	hc.mc.OnEvicted = hc.handleMemEvict
+	hc.def = newNamespace("", memcache.NewMemCache(maxMemEntries), newDisk(0, maxDiskBytes), hc.handleEvicted)
+	hc.def.DiskBytes = maxDiskBytes
+	hc.blockSize = blockSize
+	hc.newDisk = newDisk
 	return hc
+}
+
+// AddNamespace reserves the configured memory and disk quota for keys
+// starting with cfg.Prefix, on top of the quota of the default namespace.
+// Keys are assigned to the namespace with the longest matching prefix.
+// Namespaces must be added before the cache is used. A DiskBytes of 0
+// leaves the namespace without a disk tier.
+func (hc *HybridCache) AddNamespace(cfg NamespaceConfig) error {
+	// Zero limits mean unlimited to the tiers themselves
+	if cfg.MemBytes <= 0 {
+		return fmt.Errorf("namespace %q needs a positive memory quota", cfg.Prefix)
+	}
+	if cfg.DiskBytes < 0 || (cfg.DiskBytes > 0 && cfg.DiskBytes < hc.blockSize) {
+		return fmt.Errorf("namespace %q disk quota must be 0 or at least one block of %d bytes",
+			cfg.Prefix, hc.blockSize)
+	}
+
+	mc := memcache.NewMemCache(0)
+	mc.MaxBytes = cfg.MemBytes
 
+	var dc cache.Cache
+	if hc.newDisk != nil && cfg.DiskBytes > 0 {
+		dc = hc.newDisk(len(hc.namespaces)+1, cfg.DiskBytes)
+	}
+
+	mc.Compressor = hc.compressor
+	mc.Pool = hc.pool
+
+	ns := newNamespace(cfg.Prefix, mc, dc, hc.handleEvicted)
+	ns.NamespaceConfig = cfg
+
+	hc.namespaces = append(hc.namespaces, ns)
+	sort.Slice(hc.namespaces, func(i, j int) bool {
+		return len(hc.namespaces[i].Prefix) > len(hc.namespaces[j].Prefix)
+	})
+	log.Infof("Added cache namespace %q. Memory: %d bytes. Disk: %d bytes",
+		cfg.Prefix, cfg.MemBytes, cfg.DiskBytes)
+	return nil
 }
 
-func (hc *HybridCache) handleMemEvict(key string, value []byte) {
-	// Insert to disk
-	hc.dc.Add(key, value)
+// SetCompression makes the memory tier store blocks compressed with c.
+// Memory limits are then accounted in compressed bytes rather than
+// entries, so more blocks fit in the same budget. Must be called before
+// the cache is used.
+func (hc *HybridCache) SetCompression(c codec.Codec) {
+	if c == nil {
+		return
+	}
+
+	hc.compressor = codec.NewAdaptive(c)
+	for _, ns := range hc.allNamespaces() {
+		if ns.mc.MaxEntries != 0 && hc.blockSize != 0 {
+			ns.mc.MaxBytes = ns.mc.MaxEntries * hc.blockSize
+			ns.mc.MaxEntries = 0
+		}
+		ns.mc.Compressor = hc.compressor
+	}
+	log.Infof("Compressing memory cache with %v", c.Name())
+}
+
+// SetPool makes the memory tier hold blocks in buffers from p. Must be
+// called before the cache is used.
+func (hc *HybridCache) SetPool(p *bufpool.Pool) {
+	hc.pool = p
+	for _, ns := range hc.allNamespaces() {
+		ns.mc.Pool = p
+	}
+}
+
+func (hc *HybridCache) handleEvicted(key string) {
+	if hc.OnEvicted != nil {
+		hc.OnEvicted(key)
+	}
+}
+
+// Contains checks both tiers for key without updating its recency
+func (hc *HybridCache) Contains(key string) bool {
+	ns := hc.namespaceFor(key)
+	if ns.mc.Contains(key) {
+		return true
+	}
+	c, ok := ns.dc.(cache.Container)
+	return ok && c.Contains(key)
+}
+
+func (hc *HybridCache) namespaceFor(key string) *Namespace {
+	for _, ns := range hc.namespaces {
+		if ns.matches(key) {
+			return ns
+		}
+	}
+	return hc.def
+}
+
+func (hc *HybridCache) allNamespaces() []*Namespace {
+	return append([]*Namespace{hc.def}, hc.namespaces...)
 }
 
 // Add, Get, Remove, Len, Clear
 func (hc *HybridCache) Add(key string, value []byte) {
 	// Only add to memcache
-	hc.mc.Add(key, value)
+	hc.namespaceFor(key).mc.Add(key, value)
+}
+
+// AddBuffer adds buf to the memory tier without copying it
+func (hc *HybridCache) AddBuffer(key string, buf *bufpool.Buffer) {
+	hc.namespaceFor(key).mc.AddBuffer(key, buf)
+}
+
+// GetBuffer is Get without copying memory hits. The caller must release
+// the returned buffer.
+func (hc *HybridCache) GetBuffer(key string) (*bufpool.Buffer, bool) {
+	ns := hc.namespaceFor(key)
+
+	if buf, ok := ns.mc.GetBuffer(key); ok {
+		return buf, true
+	}
+
+	if ns.dc == nil {
+		return nil, false
+	}
+
+	if data, ok := ns.dc.Get(key); ok {
+		ns.mc.Add(key, data)
+		return bufpool.Wrap(data), true
+	}
+	return nil, false
 }
 
 func (hc *HybridCache) Get(key string) ([]byte, bool) {
 	log.Info("Hybrid Cache Get ", key)
+	ns := hc.namespaceFor(key)
+
 	// In memcache?
-	if data, ok := hc.mc.Get(key); ok {
+	if data, ok := ns.mc.Get(key); ok {
 		log.Info("Memcache hit", key)
 		return data, true
 	}
 
-	if data, ok := hc.dc.Get(key); ok {
+	if ns.dc == nil {
+		log.Info("No hit", key)
+		return nil, false
+	}
+
+	if data, ok := ns.dc.Get(key); ok {
 		// Also insert in memcache
 		log.Info("Diskcache hit", key)
-		hc.mc.Add(key, data)
+		ns.mc.Add(key, data)
 		return data, true
 	}
 
@@ -61,21 +206,88 @@ func (hc *HybridCache) Get(key string) ([]byte, bool) {
 	return nil, false
 }
 
+// Open returns a reader for key. Memory hits are served from the cached
+// slice. Disk hits are streamed straight from the disk cache and, unlike
+// Get, are not promoted to memory so large scans don't churn the memory
+// tier.
+func (hc *HybridCache) Open(key string) (cache.Reader, bool) {
+	ns := hc.namespaceFor(key)
+
+	if buf, ok := ns.mc.GetBuffer(key); ok {
+		return buf, true
+	}
+
+	if dc, ok := ns.dc.(cache.Opener); ok {
+		return dc.Open(key)
+	}
+
+	if ns.dc != nil {
+		if data, ok := ns.dc.Get(key); ok {
+			return cache.NewBytesReader(data), true
+		}
+	}
+	return nil, false
+}
+
 // Approximate number of elements in the cache
 func (hc *HybridCache) Len() int64 {
-	return hc.mc.Len() + hc.dc.Len()
+	n := int64(0)
+	for _, ns := range hc.allNamespaces() {
+		n += ns.len()
+	}
+	return n
 }
 
 func (hc *HybridCache) Remove(key string) {
-	hc.mc.Remove(key)
-	hc.dc.Remove(key)
+	ns := hc.namespaceFor(key)
+	ns.mc.Remove(key)
+	if ns.dc != nil {
+		ns.dc.Remove(key)
+	}
 }
 
-func (hc *HybridCache) Clear() {
-	temp := hc.mc.OnEvicted
-	hc.mc.OnEvicted = nil
-	hc.mc.Clear()
-	hc.mc.OnEvicted = temp
+// Pin exempts key from eviction in both tiers. Returns false if neither
+// tier holds the key.
+func (hc *HybridCache) Pin(key string, ttl time.Duration) bool {
+	ns := hc.namespaceFor(key)
+	ok := ns.mc.Pin(key, ttl)
+	if dc, isPinner := ns.dc.(cache.Pinner); isPinner {
+		ok = dc.Pin(key, ttl) || ok
+	}
+	return ok
+}
+
+func (hc *HybridCache) Unpin(key string) {
+	ns := hc.namespaceFor(key)
+	ns.mc.Unpin(key)
+	if dc, isPinner := ns.dc.(cache.Pinner); isPinner {
+		dc.Unpin(key)
+	}
+}
 
-	hc.dc.Clear()
+func (hc *HybridCache) UnpinPrefix(prefix string) int {
+	n := 0
+	for _, ns := range hc.allNamespaces() {
+		n += ns.mc.UnpinPrefix(prefix)
+		if dc, isPinner := ns.dc.(cache.Pinner); isPinner {
+			n += dc.UnpinPrefix(prefix)
+		}
+	}
+	return n
+}
+
+// Usage reports quota and usage of every namespace, starting with the
+// default namespace.
+func (hc *HybridCache) Usage() []cache.Usage {
+	var result []cache.Usage
+	for _, ns := range hc.allNamespaces() {
+		result = append(result, ns.usage(hc.blockSize))
+	}
+	return result
+}
+
+func (hc *HybridCache) Clear() {
+	for _, ns := range hc.allNamespaces() {
+		ns.clear()
+	}
 }
@@ -0,0 +1,175 @@
+package hybridcache
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rahulgovind/fastfs/bufpool"
+	"github.com/rahulgovind/fastfs/cache"
+	"github.com/rahulgovind/fastfs/cache/diskcache"
+	"github.com/rahulgovind/fastfs/cache/memcache"
+	"strconv"
+	"strings"
+)
+
+// Namespace is a slice of the cache reserved for keys under a path prefix.
+// It has its own memory and disk eviction queues so a scan in one
+// namespace can't evict blocks belonging to another.
+type Namespace struct {
+	NamespaceConfig
+
+	mc *memcache.MemCache
+	dc cache.Cache
+
+	// onEvicted is called for keys leaving the namespace
+	onEvicted func(key string)
+}
+
+// NamespaceConfig is the prefix and quotas of a namespace in bytes
+type NamespaceConfig struct {
+	Prefix    string
+	MemBytes  int64
+	DiskBytes int64
+}
+
+type sizer interface {
+	Size() int64
+}
+
+func newNamespace(prefix string, mc *memcache.MemCache, dc cache.Cache, onEvicted func(key string)) *Namespace {
+	ns := new(Namespace)
+	ns.Prefix = prefix
+	ns.mc = mc
+	ns.dc = dc
+	ns.onEvicted = onEvicted
+	ns.mc.OnEvicted = ns.handleMemEvict
+	ns.mc.OnEvictedBuffer = ns.handleMemEvictBuffer
+	if en, ok := dc.(cache.EvictionNotifier); ok {
+		en.SetOnEvicted(onEvicted)
+	}
+	return ns
+}
+
+func (ns *Namespace) matches(key string) bool {
+	return strings.HasPrefix(key, ns.Prefix)
+}
+
+func (ns *Namespace) handleMemEvict(key string, value []byte) {
+	// Insert to disk
+	if ns.dc != nil {
+		ns.dc.Add(key, value)
+	} else {
+		ns.onEvicted(key)
+	}
+}
+
+func (ns *Namespace) handleMemEvictBuffer(key string, buf *bufpool.Buffer) {
+	if ns.dc == nil {
+		ns.onEvicted(key)
+		return
+	}
+	if bc, ok := ns.dc.(cache.BufferCache); ok {
+		bc.AddBuffer(key, buf)
+		return
+	}
+	// buf is recycled once the memory cache lets go of it
+	ns.dc.Add(key, append([]byte(nil), buf.Bytes()...))
+}
+
+func (ns *Namespace) len() int64 {
+	n := ns.mc.Len()
+	if ns.dc != nil {
+		n += ns.dc.Len()
+	}
+	return n
+}
+
+func (ns *Namespace) usage(blockSize int64) cache.Usage {
+	u := cache.Usage{
+		Prefix:    ns.Prefix,
+		MemBytes:  ns.MemBytes,
+		MemUsed:   ns.mc.Size(),
+		DiskBytes: ns.DiskBytes,
+		Entries:   ns.len(),
+	}
+
+	if ns.MemBytes == 0 {
+		u.MemBytes = ns.mc.MaxBytes
+		if u.MemBytes == 0 {
+			u.MemBytes = ns.mc.MaxEntries * blockSize
+		}
+	}
+
+	if ns.mc.Compressor != nil {
+		u.CompressionRatio = ns.mc.Compressor.Ratio()
+	}
+
+	if dc, ok := ns.dc.(*diskcache.DiskCache); ok && ns.DiskBytes == 0 {
+		u.DiskBytes = dc.MaxEntries * blockSize
+	}
+
+	if ns.dc != nil {
+		if s, ok := ns.dc.(sizer); ok {
+			u.DiskUsed = s.Size()
+		} else {
+			u.DiskUsed = ns.dc.Len() * blockSize
+		}
+	}
+	return u
+}
+
+func (ns *Namespace) clear() {
+	temp, tempBuffer := ns.mc.OnEvicted, ns.mc.OnEvictedBuffer
+	ns.mc.OnEvicted, ns.mc.OnEvictedBuffer = nil, nil
+	ns.mc.Clear()
+	ns.mc.OnEvicted, ns.mc.OnEvictedBuffer = temp, tempBuffer
+
+	if ns.dc != nil {
+		ns.dc.Clear()
+	}
+}
+
+// ParseNamespaces parses a comma separated list of namespaces of the form
+// prefix=memMB:diskMB, e.g. "teamA/=256:1024,teamB/=128:512". The memory
+// quota must be positive. A disk quota of 0 gives the namespace no disk tier.
+func ParseNamespaces(spec string) ([]NamespaceConfig, error) {
+	var result []NamespaceConfig
+	if strings.TrimSpace(spec) == "" {
+		return result, nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		eq := strings.LastIndex(item, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid namespace %q. Expected prefix=memMB:diskMB", item)
+		}
+
+		quotas := strings.Split(item[eq+1:], ":")
+		if len(quotas) != 2 {
+			return nil, fmt.Errorf("invalid namespace %q. Expected prefix=memMB:diskMB", item)
+		}
+
+		memMB, err := strconv.ParseInt(quotas[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		diskMB, err := strconv.ParseInt(quotas[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if memMB < 0 || diskMB < 0 {
+			return nil, errors.New("namespace quotas can't be negative")
+		}
+		if memMB == 0 {
+			// A zero limit would make the memory tier unbounded
+			return nil, fmt.Errorf("invalid namespace %q. Memory quota must be positive", item)
+		}
+
+		result = append(result, NamespaceConfig{
+			Prefix:    item[:eq],
+			MemBytes:  memMB * 1024 * 1024,
+			DiskBytes: diskMB * 1024 * 1024,
+		})
+	}
+	return result, nil
+}
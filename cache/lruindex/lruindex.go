@@ -0,0 +1,185 @@
+package lruindex
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Index keeps the keys of a cache backend in LRU order along with their
+// size and age, for backends that can't evict or expire entries by
+// themselves. The backend deletes the data of keys the index drops in
+// onEvicted. Safe for concurrent use.
+type Index struct {
+	maxBytes  int64
+	ttl       time.Duration
+	onEvicted func(key string)
+
+	ll    *list.List
+	items map[string]*list.Element
+	size  int64
+	mu    sync.Mutex
+}
+
+type item struct {
+	key    string
+	size   int64
+	expiry time.Time
+}
+
+// New creates an index holding up to maxBytes. Entries expire after ttl.
+// Zero means no limit for either.
+func New(maxBytes int64, ttl time.Duration, onEvicted func(key string)) *Index {
+	idx := &Index{
+		maxBytes:  maxBytes,
+		ttl:       ttl,
+		onEvicted: onEvicted,
+		ll:        list.New(),
+		items:     make(map[string]*list.Element),
+	}
+
+	if ttl > 0 {
+		go idx.janitor()
+	}
+	return idx
+}
+
+// Add records key with the given size and evicts the least recently used
+// keys until the index fits in maxBytes
+func (idx *Index) Add(key string, size int64) {
+	idx.mu.Lock()
+	it := &item{key: key, size: size}
+	if idx.ttl > 0 {
+		it.expiry = time.Now().Add(idx.ttl)
+	}
+
+	if ele, ok := idx.items[key]; ok {
+		idx.size += size - ele.Value.(*item).size
+		ele.Value = it
+		idx.ll.MoveToFront(ele)
+	} else {
+		idx.items[key] = idx.ll.PushFront(it)
+		idx.size += size
+	}
+
+	var evicted []string
+	for idx.maxBytes != 0 && idx.size > idx.maxBytes && idx.ll.Len() > 1 {
+		evicted = append(evicted, idx.removeElement(idx.ll.Back()))
+	}
+	idx.mu.Unlock()
+
+	idx.evict(evicted)
+}
+
+// Get marks key as recently used. Returns false if the key is unknown or
+// has expired, in which case it is evicted.
+func (idx *Index) Get(key string) bool {
+	idx.mu.Lock()
+	ele, ok := idx.items[key]
+	if !ok {
+		idx.mu.Unlock()
+		return false
+	}
+
+	if idx.expired(ele.Value.(*item), time.Now()) {
+		idx.removeElement(ele)
+		idx.mu.Unlock()
+		idx.evict([]string{key})
+		return false
+	}
+
+	idx.ll.MoveToFront(ele)
+	idx.mu.Unlock()
+	return true
+}
+
+// Contains checks for key without updating its recency
+func (idx *Index) Contains(key string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	_, ok := idx.items[key]
+	return ok
+}
+
+// Remove forgets key without calling onEvicted
+func (idx *Index) Remove(key string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if ele, ok := idx.items[key]; ok {
+		idx.removeElement(ele)
+	}
+}
+
+func (idx *Index) Len() int64 {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return int64(idx.ll.Len())
+}
+
+// Size returns the total size of the indexed entries
+func (idx *Index) Size() int64 {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.size
+}
+
+// Clear forgets every key without calling onEvicted
+func (idx *Index) Clear() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.ll = list.New()
+	idx.items = make(map[string]*list.Element)
+	idx.size = 0
+}
+
+func (idx *Index) expired(it *item, now time.Time) bool {
+	return !it.expiry.IsZero() && now.After(it.expiry)
+}
+
+func (idx *Index) removeElement(ele *list.Element) string {
+	it := ele.Value.(*item)
+	idx.ll.Remove(ele)
+	delete(idx.items, it.key)
+	idx.size -= it.size
+	return it.key
+}
+
+// evict runs onEvicted outside the lock so backends can take their own
+func (idx *Index) evict(keys []string) {
+	if idx.onEvicted == nil {
+		return
+	}
+	for _, key := range keys {
+		idx.onEvicted(key)
+	}
+}
+
+// janitor periodically evicts expired entries that are never read again
+func (idx *Index) janitor() {
+	interval := idx.ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		now := time.Now()
+		var evicted []string
+
+		idx.mu.Lock()
+		for ele := idx.ll.Back(); ele != nil; {
+			prev := ele.Prev()
+			if idx.expired(ele.Value.(*item), now) {
+				evicted = append(evicted, idx.removeElement(ele))
+			}
+			ele = prev
+		}
+		idx.mu.Unlock()
+
+		idx.evict(evicted)
+	}
+}
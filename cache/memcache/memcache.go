@@ -2,8 +2,12 @@ package memcache
 
 import (
 	"container/list"
+	"github.com/rahulgovind/fastfs/bufpool"
+	"github.com/rahulgovind/fastfs/cache/codec"
 	log "github.com/sirupsen/logrus"
+	"strings"
 	"sync"
+	"time"
 )
 
 // MemCache is an LRU cache. It is not safe for concurrent access.
@@ -12,19 +16,62 @@ type MemCache struct {
 	// an item is evicted. Zero means no limit.
 	MaxEntries int64
 
+	// MaxBytes is the maximum total size of cached values before an
+	// item is evicted. Zero means no limit.
+	MaxBytes int64
+
+	// Compressor optionally compresses values before they are stored.
+	// Sizes are then accounted in compressed bytes.
+	Compressor *codec.Adaptive
+
+	// Pool optionally holds uncompressed values in pooled buffers
+	// instead of heap slices.
+	Pool *bufpool.Pool
+
 	// OnEvicted optionally specifies a callback function to be
 	// executed when an entry is purged from the cache.
 	OnEvicted func(key string, value []byte)
 
+	// OnEvictedBuffer is called instead of OnEvicted for values held in
+	// pooled buffers. The callback must retain buf to keep it.
+	OnEvictedBuffer func(key string, buf *bufpool.Buffer)
+
 	ll    *list.List
 	cache map[interface{}]*list.Element
+	size  int64
 	mu    sync.RWMutex
+
+	// pinnedSize and pinnedLen count the pinned entries. Pins are refused
+	// once they would fill MaxBytes or MaxEntries so eviction always
+	// has something to remove.
+	pinnedSize int64
+	pinnedLen  int64
 }
 
 // A Key may be any value that is comparable. See http://golang.org/ref/spec#Comparison_operators
 type entry struct {
-	key   string
-	value []byte
+	key        string
+	value      []byte
+	compressed bool
+
+	// buf holds value if it is pooled
+	buf *bufpool.Buffer
+
+	// pinned entries are skipped by RemoveOldest until pinExpiry passes.
+	// A zero pinExpiry keeps the entry pinned until it is unpinned.
+	pinned    bool
+	pinExpiry time.Time
+}
+
+func (e *entry) isPinned(now time.Time) bool {
+	return e.pinned && (e.pinExpiry.IsZero() || now.Before(e.pinExpiry))
+}
+
+func (e *entry) release() {
+	if e.buf != nil {
+		e.buf.Release()
+		e.buf = nil
+	}
 }
 
 // NewMemCache creates a new MemCache.
@@ -38,8 +85,37 @@ func NewMemCache(maxEntries int64) *MemCache {
 	}
 }
 
-// Add adds a value to the cache.
+// Add adds a value to the cache. The value is copied into a pooled buffer
+// if the cache has a pool.
 func (mc *MemCache) Add(key string, value []byte) {
+	e := &entry{key: key, value: value}
+	if mc.Compressor != nil {
+		e.value, e.compressed = mc.Compressor.Compress(value)
+	}
+
+	if !e.compressed && mc.Pool != nil {
+		e.buf = mc.Pool.Get()
+		e.buf.Write(value)
+		e.value = e.buf.Bytes()
+	}
+	mc.add(e)
+}
+
+// AddBuffer adds the contents of buf without copying them. The cache
+// takes its own reference to buf.
+func (mc *MemCache) AddBuffer(key string, buf *bufpool.Buffer) {
+	e := &entry{key: key, value: buf.Bytes()}
+	if mc.Compressor != nil {
+		e.value, e.compressed = mc.Compressor.Compress(buf.Bytes())
+	}
+
+	if !e.compressed {
+		e.buf = buf.Retain()
+	}
+	mc.add(e)
+}
+
+func (mc *MemCache) add(e *entry) {
 	mc.mu.Lock()
 	defer mc.mu.Unlock()
 
@@ -48,31 +124,123 @@ func (mc *MemCache) Add(key string, value []byte) {
 		mc.ll = list.New()
 	}
 
-	log.Info("Adding to cache: ", key)
-	if ee, ok := mc.cache[key]; ok {
+	log.Info("Adding to cache: ", e.key)
+	if ee, ok := mc.cache[e.key]; ok {
 		mc.ll.MoveToFront(ee)
-		ee.Value.(*entry).value = value
-		return
+		old := ee.Value.(*entry)
+		pinned := old.pinned
+		mc.unpin(old)
+		mc.size += int64(len(e.value) - len(old.value))
+		old.release()
+		old.value = e.value
+		old.compressed = e.compressed
+		old.buf = e.buf
+		if pinned {
+			// Keeps its pin only if the new value still fits
+			mc.pin(old)
+		}
+	} else {
+		ele := mc.ll.PushFront(e)
+		mc.cache[e.key] = ele
+		mc.size += int64(len(e.value))
 	}
-	ele := mc.ll.PushFront(&entry{key, value})
-	mc.cache[key] = ele
-	if mc.MaxEntries != 0 && int64(mc.ll.Len()) > mc.MaxEntries {
-		mc.RemoveOldest()
+
+	for mc.overLimit() {
+		if !mc.removeOldest() {
+			// Everything left is pinned
+			break
+		}
 	}
 }
 
+func (mc *MemCache) overLimit() bool {
+	return (mc.MaxEntries != 0 && int64(mc.ll.Len()) > mc.MaxEntries) ||
+		(mc.MaxBytes != 0 && mc.size > mc.MaxBytes)
+}
+
 // Get looks up a key's value from the cache.
 func (mc *MemCache) Get(key string) (value []byte, ok bool) {
 	mc.mu.Lock()
-	defer mc.mu.Unlock()
 	if mc.cache == nil {
+		mc.mu.Unlock()
 		return
 	}
-	if ele, hit := mc.cache[key]; hit {
-		mc.ll.MoveToFront(ele)
-		return ele.Value.(*entry).value, true
+	ele, hit := mc.cache[key]
+	if !hit {
+		mc.mu.Unlock()
+		return
+	}
+	mc.ll.MoveToFront(ele)
+	e := *ele.Value.(*entry)
+	if e.buf != nil {
+		e.buf.Retain()
+	}
+	mc.mu.Unlock()
+
+	if e.buf != nil {
+		// Pooled buffers are recycled once evicted so hand out a copy
+		value = append([]byte(nil), e.value...)
+		e.buf.Release()
+		return value, true
+	}
+
+	// Decompress outside the lock
+	value, err := mc.decode(&e)
+	if err != nil {
+		log.Errorf("Dropping corrupt cache entry %v: %v", key, err)
+		mc.Remove(key)
+		return nil, false
+	}
+	return value, true
+}
+
+// GetBuffer looks up a key's value without copying it. The caller must
+// release the returned buffer.
+func (mc *MemCache) GetBuffer(key string) (*bufpool.Buffer, bool) {
+	mc.mu.Lock()
+	if mc.cache == nil {
+		mc.mu.Unlock()
+		return nil, false
+	}
+	ele, hit := mc.cache[key]
+	if !hit {
+		mc.mu.Unlock()
+		return nil, false
+	}
+	mc.ll.MoveToFront(ele)
+	e := *ele.Value.(*entry)
+	if e.buf != nil {
+		e.buf.Retain()
 	}
-	return
+	mc.mu.Unlock()
+
+	if e.buf != nil {
+		return e.buf, true
+	}
+
+	value, err := mc.decode(&e)
+	if err != nil {
+		log.Errorf("Dropping corrupt cache entry %v: %v", key, err)
+		mc.Remove(key)
+		return nil, false
+	}
+	return bufpool.Wrap(value), true
+}
+
+func (mc *MemCache) decode(e *entry) ([]byte, error) {
+	if !e.compressed {
+		return e.value, nil
+	}
+	return mc.Compressor.Decompress(e.value, true)
+}
+
+// Contains checks for key without updating its recency
+func (mc *MemCache) Contains(key string) bool {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	_, ok := mc.cache[key]
+	return ok
 }
 
 // Remove removes the provided key from the cache.
@@ -88,25 +256,147 @@ func (mc *MemCache) Remove(key string) {
 	}
 }
 
-// RemoveOldest removes the oldest item from the cache.
+// RemoveOldest removes the oldest unpinned item from the cache.
 func (mc *MemCache) RemoveOldest() {
+	mc.removeOldest()
+}
+
+func (mc *MemCache) removeOldest() bool {
+	if mc.cache == nil {
+		return false
+	}
+	now := time.Now()
+	for ele := mc.ll.Back(); ele != nil; ele = ele.Prev() {
+		if !ele.Value.(*entry).isPinned(now) {
+			mc.removeElement(ele)
+			return true
+		}
+	}
+	return false
+}
+
+// Pin exempts key from eviction for ttl, or until Unpin if ttl is zero.
+// Returns false if the key is not in the cache or pinning it would exceed
+// MaxBytes or MaxEntries.
+func (mc *MemCache) Pin(key string, ttl time.Duration) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.cache == nil {
+		return false
+	}
+	if ele, hit := mc.cache[key]; hit {
+		e := ele.Value.(*entry)
+		if !mc.pin(e) {
+			return false
+		}
+		e.pinExpiry = time.Time{}
+		if ttl > 0 {
+			e.pinExpiry = time.Now().Add(ttl)
+		}
+		return true
+	}
+	return false
+}
+
+// Unpin makes key eligible for eviction again.
+func (mc *MemCache) Unpin(key string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
 	if mc.cache == nil {
 		return
 	}
-	ele := mc.ll.Back()
-	if ele != nil {
-		mc.removeElement(ele)
+	if ele, hit := mc.cache[key]; hit {
+		mc.unpin(ele.Value.(*entry))
+	}
+}
+
+// UnpinPrefix unpins every key starting with prefix and returns how many
+// pinned entries were released.
+func (mc *MemCache) UnpinPrefix(prefix string) int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	n := 0
+	for key, ele := range mc.cache {
+		e := ele.Value.(*entry)
+		if e.pinned && strings.HasPrefix(key.(string), prefix) {
+			mc.unpin(e)
+			n += 1
+		}
+	}
+	return n
+}
+
+// pin marks e pinned if the pinned entries still fit in the cache's
+// limits. Expired pins are released first if they don't.
+func (mc *MemCache) pin(e *entry) bool {
+	if e.pinned {
+		return true
+	}
+	n := int64(len(e.value))
+	if !mc.pinFits(n) {
+		now := time.Now()
+		for _, ele := range mc.cache {
+			if pe := ele.Value.(*entry); pe.pinned && !pe.isPinned(now) {
+				mc.unpin(pe)
+			}
+		}
+		if !mc.pinFits(n) {
+			return false
+		}
+	}
+	e.pinned = true
+	mc.pinnedSize += n
+	mc.pinnedLen += 1
+	return true
+}
+
+func (mc *MemCache) pinFits(n int64) bool {
+	return (mc.MaxEntries == 0 || mc.pinnedLen+1 <= mc.MaxEntries) &&
+		(mc.MaxBytes == 0 || mc.pinnedSize+n <= mc.MaxBytes)
+}
+
+func (mc *MemCache) unpin(e *entry) {
+	if !e.pinned {
+		return
 	}
+	e.pinned = false
+	mc.pinnedSize -= int64(len(e.value))
+	mc.pinnedLen -= 1
 }
 
 func (mc *MemCache) removeElement(e *list.Element) {
 	kv := e.Value.(*entry)
-	if mc.OnEvicted != nil {
-		log.Error("Evicting ", kv.key)
-		mc.OnEvicted(kv.key, kv.value)
-	}
+	mc.unpin(kv)
+	mc.evict(kv)
 	mc.ll.Remove(e)
 	delete(mc.cache, kv.key)
+	mc.size -= int64(len(kv.value))
+}
+
+// evict hands kv to the eviction callbacks and drops the cache's reference
+// to its buffer
+func (mc *MemCache) evict(kv *entry) {
+	defer kv.release()
+
+	if kv.buf != nil && mc.OnEvictedBuffer != nil {
+		log.Error("Evicting ", kv.key)
+		mc.OnEvictedBuffer(kv.key, kv.buf)
+		return
+	}
+	if mc.OnEvicted == nil {
+		return
+	}
+
+	log.Error("Evicting ", kv.key)
+	value, err := mc.decode(kv)
+	if err != nil {
+		log.Errorf("Dropping corrupt cache entry %v: %v", kv.key, err)
+		return
+	}
+	mc.OnEvicted(kv.key, value)
 }
 
 // Len returns the number of items in the cache.
@@ -120,17 +410,25 @@ func (mc *MemCache) Len() int64 {
 	return int64(mc.ll.Len())
 }
 
+// Size returns the total size in bytes of the cached values.
+func (mc *MemCache) Size() int64 {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	return mc.size
+}
+
 // Clear purges all stored items from the cache.
 func (mc *MemCache) Clear() {
 	mc.mu.Lock()
 	defer mc.mu.Unlock()
 
-	if mc.OnEvicted != nil {
-		for _, e := range mc.cache {
-			kv := e.Value.(*entry)
-			mc.OnEvicted(kv.key, kv.value)
-		}
+	for _, e := range mc.cache {
+		mc.evict(e.Value.(*entry))
 	}
 	mc.ll = nil
 	mc.cache = nil
+	mc.size = 0
+	mc.pinnedSize = 0
+	mc.pinnedLen = 0
 }
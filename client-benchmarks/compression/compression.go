@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/rahulgovind/fastfs/cache/codec"
+	"github.com/rahulgovind/fastfs/cache/memcache"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Replays a skewed block access pattern against the memory cache with each
+// codec and reports hit rate against CPU time spent.
+
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func main() {
+	var srcFlag = flag.String("src", "parking-citations-500k.csv", "File to split into cache blocks")
+	var blockSizeFlag = flag.Int("block-size", 1024, "Block size in KB")
+	var memFlag = flag.Int("mem-max", 64, "Memory cache size in MB")
+	var requestsFlag = flag.Int("requests", 100000, "Number of block requests to replay")
+	var skewFlag = flag.Float64("skew", 1.1, "Zipf skew of the access pattern. Must be > 1")
+	var codecsFlag = flag.String("codecs", "none,"+strings.Join(codec.Codecs, ","), "Codecs to compare")
+
+	flag.Parse()
+
+	// The cache logs every insertion at info level
+	logrus.SetLevel(logrus.ErrorLevel)
+
+	data, err := ioutil.ReadFile(*srcFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	blockSize := *blockSizeFlag * 1024
+	var blocks [][]byte
+	for offset := 0; offset < len(data); offset += blockSize {
+		end := offset + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		blocks = append(blocks, data[offset:end])
+	}
+	if len(blocks) < 2 {
+		log.Fatal("Source file must span at least two blocks")
+	}
+
+	fmt.Printf("%d blocks of %d KB. Cache: %d MB. Requests: %d\n\n",
+		len(blocks), *blockSizeFlag, *memFlag, *requestsFlag)
+	fmt.Printf("%-8s %10s %10s %14s %14s\n", "Codec", "Hit rate", "Ratio", "CPU time", "Wall time")
+
+	for _, name := range strings.Split(*codecsFlag, ",") {
+		c, err := codec.New(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		mc := memcache.NewMemCache(0)
+		mc.MaxBytes = int64(*memFlag) * 1024 * 1024
+		if c != nil {
+			mc.Compressor = codec.NewAdaptive(c)
+		}
+
+		// Same access pattern for every codec
+		zipf := rand.NewZipf(rand.New(rand.NewSource(1)), *skewFlag, 1, uint64(len(blocks)-1))
+
+		hits := 0
+		startCPU := cpuTime()
+		start := time.Now()
+		for i := 0; i < *requestsFlag; i += 1 {
+			idx := zipf.Uint64()
+			key := fmt.Sprintf("%d", idx)
+			if _, ok := mc.Get(key); ok {
+				hits += 1
+				continue
+			}
+			mc.Add(key, blocks[idx])
+		}
+		elapsed := time.Since(start)
+		cpu := cpuTime() - startCPU
+
+		ratio := 1.0
+		if mc.Compressor != nil {
+			ratio = mc.Compressor.Ratio()
+		}
+		fmt.Printf("%-8s %9.2f%% %10.2f %14v %14v\n", name,
+			100*float64(hits)/float64(*requestsFlag), ratio, cpu, elapsed)
+	}
+}
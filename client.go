@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/rahulgovind/fastfs/bufpool"
+	"github.com/rahulgovind/fastfs/common"
 	"github.com/rahulgovind/fastfs/datamanager"
 	"github.com/rahulgovind/fastfs/partitioner"
+	"github.com/rahulgovind/fastfs/transport"
 	"io"
 	"log"
 	"net/http"
@@ -32,36 +36,46 @@ func (c *Client) GetBlockSize() int64 {
 	return c.BlockSize
 }
 
-func (c *Client) DirectGet(path string, block int64, addr string, cache bool) ([]byte, error) {
+var errNotCached = errors.New("block not cached")
+
+// DirectGet fetches a block from addr into a pooled buffer. The caller must
+// release it. With onlyCache the block is moved out of addr's cache and
+// errNotCached is returned if addr doesn't have it.
+func (c *Client) DirectGet(path string, block int64, addr string, onlyCache bool) (*bufpool.Buffer, error) {
+	maxRetries := 3
+	numRetries := 0
 	for {
-		url := fmt.Sprintf("http://%s/data/%s?block=%d&force=1&cache=%v",
-			addr, path, block, cache)
+		url := transport.URL("%s/data/%s?block=%d&force=1&onlyCache=%v",
+			addr, path, block, onlyCache)
 
-		maxRetries := 3
-		numRetries := 0
-		var buffer *bytes.Buffer
+		var buffer *bufpool.Buffer
 
-		resp, err := http.Get(url)
+		resp, err := transport.Get(url)
 
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
 			numRetries += 1
 			if numRetries <= maxRetries {
 				time.Sleep(2 * time.Second)
 				continue
 			}
-			log.Fatal(err)
 			return nil, err
 		}
 
 		if resp.StatusCode == 404 {
-			return nil, errors.New("file not found")
+			resp.Body.Close()
+			return nil, errNotCached
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("get block %d of %v from %v: %v", block, path, addr, resp.Status)
 		}
 
-		defer resp.Body.Close()
-		buffer = new(bytes.Buffer)
-		_, err = io.Copy(buffer, resp.Body)
+		buffer = c.dm.NewBuffer()
+		_, err = buffer.ReadFrom(resp.Body)
+		resp.Body.Close()
 		if err != nil {
+			buffer.Release()
 			numRetries += 1
 			if numRetries <= maxRetries {
 				time.Sleep(2 * time.Second)
@@ -70,7 +84,7 @@ func (c *Client) DirectGet(path string, block int64, addr string, cache bool) ([
 			return nil, err
 		}
 
-		return buffer.Bytes(), nil
+		return buffer, nil
 	}
 }
 
@@ -82,13 +96,13 @@ func (c *Client) Get(path string, block int64, ) ([]byte, error) {
 			return c.dm.Get(path, block)
 		}
 
-		url := fmt.Sprintf("http://%s/data/%s?block=%d&force=1", addr, path, block)
+		url := transport.URL("%s/data/%s?block=%d&force=1", addr, path, block)
 
 		maxRetries := 3
 		numRetries := 0
 		var buffer *bytes.Buffer
 
-		resp, err := http.Get(url)
+		resp, err := transport.Get(url)
 		if err != nil {
 			numRetries += 1
 			if numRetries <= maxRetries {
@@ -116,7 +130,7 @@ func (c *Client) Get(path string, block int64, ) ([]byte, error) {
 }
 
 func (c *Client) Put(path string, block int64, data []byte) error {
-	url := fmt.Sprintf("http://%s/put/%s?block=%d", c.ServerAddr, path, block)
+	url := transport.URL("%s/put/%s?block=%d", c.ServerAddr, path, block)
 
 	maxRetries := 3
 	numRetries := 0
@@ -141,8 +155,7 @@ func (c *Client) Put(path string, block int64, data []byte) error {
 			return err
 		}
 
-		client := &http.Client{}
-		res, err := client.Do(req)
+		res, err := transport.Do(req)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -151,4 +164,60 @@ func (c *Client) Put(path string, block int64, data []byte) error {
 		break
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// Warm asks addr to load a block into its cache and optionally pin it there
+func (c *Client) Warm(path string, block int64, addr string, pin bool, ttl time.Duration) error {
+	url := transport.URL("%s/admin/warmblock/%s?block=%d&pin=%v&ttl=%d",
+		addr, path, block, pin, int64(ttl/time.Second))
+
+	resp, err := transport.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("warming %v block %v on %v failed: %v", path, block, addr, resp.Status)
+	}
+	return nil
+}
+
+// Unpin releases pins on addr for every block of files starting with prefix
+func (c *Client) Unpin(prefix string, addr string) (int, error) {
+	url := transport.URL("%s/admin/unpin?prefix=%s&local=1", addr, prefix)
+
+	resp, err := transport.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result common.UnpinResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return 0, err
+	}
+	return result.Unpinned, nil
+}
+
+// Invalidate drops cached blocks and metadata of files on addr
+func (c *Client) Invalidate(invalidations []common.Invalidation, addr string) error {
+	url := transport.URL("%s/admin/invalidate", addr)
+
+	data, err := json.Marshal(invalidations)
+	if err != nil {
+		return err
+	}
+
+	resp, err := transport.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalidating on %v failed: %v", addr, resp.Status)
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 type FileList struct {
 	Files []FileInfo
 }
@@ -7,5 +9,103 @@ type FileList struct {
 type FileInfo struct {
 	Path string
 	Size int64
+	// Generation changes every time the file is written through FastFS or
+	// found changed in S3. Files as first seen in S3 are generation 0.
+	Generation int64 `json:",omitempty"`
+}
+
+// WarmProgress is streamed back while a prefix is being loaded into the cache
+type WarmProgress struct {
+	Prefix   string
+	Files    int
+	Blocks   int64
+	Done     int64
+	Failed   int64
+	Complete bool
+}
+
+type UnpinResponse struct {
+	Unpinned int
+}
+
+// PresignedURL is a URL anyone can make Method requests to until Expires
+type PresignedURL struct {
+	URL     string
+	Method  string
+	Expires time.Time
+}
+
+// NodeMeta is what a node advertises about itself in memberlist
+type NodeMeta struct {
+	// Address of the node's raft transport when metadata is kept in raft
+	RaftAddr string `json:",omitempty"`
+
+	// Cache capacity of the node. Nodes with more get more blocks.
+	MemoryBytes int64 `json:",omitempty"`
+	DiskBytes   int64 `json:",omitempty"`
+
+	// Load is the number of requests for blocks the node served per
+	// second recently. Only advertised with bounded loads.
+	Load float64 `json:",omitempty"`
 }
 
+// ReconcileReport is the drift one reconciliation of a prefix found
+// between S3 and the metadata store
+type ReconcileReport struct {
+	Prefix  string
+	Scanned int
+	Added   int
+	Removed int
+	Changed int
+	Seconds float64
+	Error   string `json:",omitempty"`
+}
+
+// DriftMetrics add up every reconciliation since the node started
+type DriftMetrics struct {
+	Runs     int64
+	Failures int64
+	Added    int64
+	Removed  int64
+	Changed  int64
+	Last     map[string]ReconcileReport
+}
+
+// Invalidation drops a file's cached blocks and metadata on a node
+type Invalidation struct {
+	Path   string
+	Blocks int64
+}
+
+// Types of WatchEvent
+const (
+	EventCreate    = "create"
+	EventOverwrite = "overwrite"
+	EventDelete    = "delete"
+)
+
+// WatchEvent is a change to a file. Token resumes watching right after
+// the event.
+type WatchEvent struct {
+	Token      string
+	Type       string
+	Path       string
+	Size       int64 `json:",omitempty"`
+	Generation int64 `json:",omitempty"`
+}
+
+// WatchResponse is a batch of events from a long-poll watch. Token resumes
+// after everything the server looked at, which may be past the last event.
+type WatchResponse struct {
+	Events []WatchEvent
+	Token  string
+}
+
+// Lock is an advisory lock on a path. Token increases every time the lock
+// is acquired so writes of holders whose lock expired can be told apart.
+type Lock struct {
+	Path   string
+	Holder string
+	Token  int64
+	Expiry time.Time
+}
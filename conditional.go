@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rahulgovind/fastfs/common"
+	"github.com/rahulgovind/fastfs/metadatamanager"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net/http"
+	"sync"
+)
+
+func parsePrecondition(req *http.Request) metadatamanager.Precondition {
+	return metadatamanager.Precondition{
+		IfMatch:     req.Header.Get("If-Match"),
+		IfNoneMatch: req.Header.Get("If-None-Match"),
+	}
+}
+
+func writeMetadataError(w http.ResponseWriter, err error) {
+	switch err {
+	case metadatamanager.ErrPreconditionFailed:
+		w.WriteHeader(http.StatusPreconditionFailed)
+	case metadatamanager.ErrNotLockHolder:
+		w.WriteHeader(http.StatusConflict)
+	case metadatamanager.ErrDegraded:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		log.Error(err)
+		w.WriteHeader(500)
+	}
+}
+
+// handleConditionalPut writes path only if the If-Match / If-None-Match
+// headers hold. The data is uploaded next to path first and moved over it
+// once the metadata is committed, so a writer that loses the race leaves
+// path alone.
+func (s *Server) handleConditionalPut(w http.ResponseWriter, req *http.Request, path string,
+	cond metadatamanager.Precondition) {
+	defer req.Body.Close()
+
+	// Fail early instead of after the upload
+	err := s.mm.Check(path, cond)
+	if err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+
+	tmp := fmt.Sprintf("%s.fastfs-%x", path, rand.Int63())
+	rag := s.dm.NewReverseAggregator(tmp, req.Body, s.aggregatorParallelism)
+	size, err := s.dm.Persist(tmp, rag)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	blockSize := s.localClient.BlockSize
+	invalidations := []common.Invalidation{{Path: tmp, Blocks: (size + blockSize - 1) / blockSize}}
+	defer func() {
+		s.invalidateAll(invalidations)
+	}()
+
+	// Commits are moved into place in the order they were made, by
+	// writers on this node and on the others
+	unlock := s.commitLocks.lock(path)
+	defer unlock()
+	unlockCommit, err := s.mm.LockCommit(path)
+	if err != nil {
+		discardErr := s.dm.Discard(tmp)
+		if discardErr != nil {
+			log.Error(discardErr)
+		}
+		writeMetadataError(w, err)
+		return
+	}
+	defer unlockCommit()
+
+	commit, err := s.mm.CommitFile(path, size, cond)
+	if err != nil {
+		discardErr := s.dm.Discard(tmp)
+		if discardErr != nil {
+			log.Error(discardErr)
+		}
+		writeMetadataError(w, err)
+		return
+	}
+
+	// Blocks of the previous version can't be served anymore
+	if commit.Previous > 0 {
+		invalidations = append(invalidations,
+			common.Invalidation{Path: path, Blocks: (commit.Previous + blockSize - 1) / blockSize})
+	}
+
+	err = s.dm.Rename(tmp, path)
+	if err != nil {
+		log.Errorf("%v was committed but not moved into place: %v", path, err)
+		revertErr := s.mm.RevertCommit(path, commit)
+		if revertErr != nil {
+			log.Errorf("Failed to revert commit of %v: %v", path, revertErr)
+		}
+		discardErr := s.dm.Discard(tmp)
+		if discardErr != nil {
+			log.Error(discardErr)
+		}
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("ETag", metadatamanager.ETag(commit.Generation))
+	w.Header().Set(GenerationHeader, fmt.Sprintf("%d", commit.Generation))
+}
+
+// pathLocks serializes writers of the same path on this node
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks path and returns the function that unlocks it
+func (pl *pathLocks) lock(path string) func() {
+	pl.mu.Lock()
+	if pl.locks == nil {
+		pl.locks = make(map[string]*pathLock)
+	}
+	l, ok := pl.locks[path]
+	if !ok {
+		l = new(pathLock)
+		pl.locks[path] = l
+	}
+	l.waiters += 1
+	pl.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		pl.mu.Lock()
+		l.waiters -= 1
+		if l.waiters == 0 {
+			delete(pl.locks, path)
+		}
+		pl.mu.Unlock()
+	}
+}
+
+func (s *Server) handleConditionalDelete(w http.ResponseWriter, path string, cond metadatamanager.Precondition) {
+	// A commit made meanwhile must not lose its data
+	unlock := s.commitLocks.lock(path)
+	defer unlock()
+	unlockCommit, err := s.mm.LockCommit(path)
+	if err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+	defer unlockCommit()
+
+	err = s.mm.RemoveFile(path, cond)
+	if err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+
+	err = s.dm.Discard(path)
+	if err != nil {
+		log.Error(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
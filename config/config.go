@@ -0,0 +1,399 @@
+// Package config holds the settings of a FastFS node. Settings come from,
+// in increasing order of precedence, defaults, a YAML or TOML file, FASTFS_*
+// environment variables and command line flags.
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Config is every setting of a node. Keys in files and flag names are the
+// same. Settings tagged reload can be changed without a restart.
+type Config struct {
+	Bucket  string `yaml:"bucket" toml:"bucket"`
+	Buckets string `yaml:"buckets" toml:"buckets"`
+	Region  string `yaml:"region" toml:"region"`
+
+	S3Endpoint     string `yaml:"s3-endpoint" toml:"s3-endpoint"`
+	S3Profile      string `yaml:"s3-profile" toml:"s3-profile"`
+	S3PathStyle    bool   `yaml:"s3-path-style" toml:"s3-path-style"`
+	S3ACL          string `yaml:"s3-acl" toml:"s3-acl"`
+	S3StorageClass string `yaml:"s3-storage-class" toml:"s3-storage-class"`
+	S3SSE          string `yaml:"s3-sse" toml:"s3-sse"`
+	S3SSEKMSKeyID  string `yaml:"s3-sse-kms-key-id" toml:"s3-sse-kms-key-id"`
+
+	Address     string `yaml:"address" toml:"address"`
+	Port        int    `yaml:"port" toml:"port"`
+	FSPort      int    `yaml:"fsport" toml:"fsport"`
+	PrimaryAddr string `yaml:"primary-addr" toml:"primary-addr"`
+	PrimaryPort int    `yaml:"primary-port" toml:"primary-port"`
+	Seeds       string `yaml:"seeds" toml:"seeds"`
+	JoinTimeout int    `yaml:"join-timeout" toml:"join-timeout"`
+	Bootstrap   bool   `yaml:"bootstrap" toml:"bootstrap"`
+
+	BootstrapExpect int `yaml:"bootstrap-expect" toml:"bootstrap-expect"`
+
+	DiscoveryDNS      string `yaml:"discovery-dns" toml:"discovery-dns"`
+	DiscoveryFile     string `yaml:"discovery-file" toml:"discovery-file"`
+	DiscoveryInterval int    `yaml:"discovery-interval" toml:"discovery-interval"`
+
+	TLSCert      string `yaml:"tls-cert" toml:"tls-cert"`
+	TLSKey       string `yaml:"tls-key" toml:"tls-key"`
+	TLSCA        string `yaml:"tls-ca" toml:"tls-ca"`
+	MutualTLS    bool   `yaml:"mutual-tls" toml:"mutual-tls"`
+	NodeCerts    string `yaml:"node-certs" toml:"node-certs"`
+	AuthToken    string `yaml:"auth-token" toml:"auth-token"`
+	AuthHMACKey  string `yaml:"auth-hmac-key" toml:"auth-hmac-key"`
+	GossipKey    string `yaml:"gossip-key" toml:"gossip-key"`
+	AuthTokens   string `yaml:"auth-tokens" toml:"auth-tokens"`
+	AuthHMACKeys string `yaml:"auth-hmac-keys" toml:"auth-hmac-keys"`
+	ACLFile      string `yaml:"acl-file" toml:"acl-file"`
+	AuditLog     string `yaml:"audit-log" toml:"audit-log"`
+	PresignKey   string `yaml:"presign-key" toml:"presign-key"`
+
+	RedisAddr         string `yaml:"redis-addr" toml:"redis-addr"`
+	RedisMaster       string `yaml:"redis-master" toml:"redis-master"`
+	RedisPassword     string `yaml:"redis-password" toml:"redis-password"`
+	MetadataBackend   string `yaml:"metadata-backend" toml:"metadata-backend"`
+	RaftPort          int    `yaml:"raft-port" toml:"raft-port"`
+	RaftDir           string `yaml:"raft-dir" toml:"raft-dir"`
+	RaftFailedTimeout int    `yaml:"raft-failed-timeout" toml:"raft-failed-timeout"`
+	MetadataLease     int    `yaml:"metadata-lease" toml:"metadata-lease" reload:"true"`
+
+	NumDownloaders        int `yaml:"num-downloaders" toml:"num-downloaders"`
+	NumUploaders          int `yaml:"num-uploaders" toml:"num-uploaders"`
+	NumBlockUploaders     int `yaml:"num-block-uploaders" toml:"num-block-uploaders"`
+	AggregatorParallelism int `yaml:"aggregator-parallelism" toml:"aggregator-parallelism"`
+	HashReplicas          int `yaml:"hash-replicas" toml:"hash-replicas"`
+
+	Partitioner string  `yaml:"partitioner" toml:"partitioner"`
+	LoadFactor  float64 `yaml:"load-factor" toml:"load-factor"`
+
+	BlockSizeKB    int    `yaml:"block-size" toml:"block-size"`
+	MemMaxMB       int    `yaml:"mem-max" toml:"mem-max"`
+	DiskMaxMB      int    `yaml:"disk-max" toml:"disk-max"`
+	DiskLocation   string `yaml:"disk-location" toml:"disk-location"`
+	DiskBackend    string `yaml:"disk-backend" toml:"disk-backend"`
+	DiskTTL        int    `yaml:"disk-ttl" toml:"disk-ttl"`
+	Namespaces     string `yaml:"namespaces" toml:"namespaces"`
+	MemCompression string `yaml:"mem-compression" toml:"mem-compression"`
+	MemArena       bool   `yaml:"mem-arena" toml:"mem-arena"`
+
+	ReconcilePrefixes string `yaml:"reconcile-prefixes" toml:"reconcile-prefixes" reload:"true"`
+	ReconcileInterval int    `yaml:"reconcile-interval" toml:"reconcile-interval" reload:"true"`
+
+	Verbose    bool `yaml:"verbose" toml:"verbose" reload:"true"`
+	CPUProfile bool `yaml:"cpu-profile" toml:"cpu-profile"`
+}
+
+// Default returns the settings used when nothing else is given. Ports of -1
+// are derived from Port.
+func Default() *Config {
+	return &Config{
+		Region:                "us-east-2",
+		S3ACL:                 "private",
+		Address:               "localhost",
+		Port:                  8000,
+		FSPort:                -1,
+		PrimaryAddr:           "localhost",
+		PrimaryPort:           8000,
+		JoinTimeout:           60,
+		DiscoveryInterval:     30,
+		RedisAddr:             "localhost:6379",
+		MetadataBackend:       "redis",
+		RaftPort:              -1,
+		RaftDir:               "/tmp/fastfs-raft",
+		RaftFailedTimeout:     3600,
+		MetadataLease:         5,
+		NumDownloaders:        16,
+		NumUploaders:          3,
+		NumBlockUploaders:     32,
+		AggregatorParallelism: 16,
+		HashReplicas:          7,
+		Partitioner:           "hash",
+		LoadFactor:            1.25,
+		BlockSizeKB:           1024,
+		MemMaxMB:              512,
+		DiskMaxMB:             1024,
+		DiskLocation:          "/tmp/testdata",
+		DiskBackend:           "blockmanager",
+		MemCompression:        "none",
+	}
+}
+
+// Load reads settings from a file on top of cfg. Files ending in .toml are
+// TOML and everything else is YAML. Unknown keys are errors.
+func (cfg *Config) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%v: unknown settings %v", path, undecoded)
+		}
+		return nil
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(cfg)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return nil
+}
+
+// derive fills in the settings that default to others
+func (cfg *Config) derive() {
+	if cfg.FSPort == -1 {
+		cfg.FSPort = cfg.Port + 100
+	}
+	if cfg.RaftPort == -1 {
+		cfg.RaftPort = cfg.Port + 200
+	}
+}
+
+// SeedList returns the addresses to join the cluster through. Without
+// seeds or other discovery the primary is the only one.
+func (cfg *Config) SeedList() []string {
+	if cfg.Seeds == "" && (cfg.DiscoveryDNS != "" || cfg.DiscoveryFile != "") {
+		return nil
+	}
+	if cfg.Seeds == "" {
+		return []string{fmt.Sprintf("%v:%v", cfg.PrimaryAddr, cfg.PrimaryPort)}
+	}
+	var seeds []string
+	for _, seed := range strings.Split(cfg.Seeds, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds
+}
+
+// NodeCertNames returns the common names of node-certs
+func (cfg *Config) NodeCertNames() []string {
+	var names []string
+	for _, name := range strings.Split(cfg.NodeCerts, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// TokenIdentities returns the identities of auth-tokens by token
+func (cfg *Config) TokenIdentities() (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(cfg.AuthTokens, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("auth-tokens must be identity=token pairs")
+		}
+		tokens[parts[1]] = parts[0]
+	}
+	return tokens, nil
+}
+
+// HMACKeyIdentities returns the keys of auth-hmac-keys by identity
+func (cfg *Config) HMACKeyIdentities() (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(cfg.AuthHMACKeys, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("auth-hmac-keys must be identity=key pairs")
+		}
+		if strings.Contains(parts[0], ":") {
+			return nil, fmt.Errorf("auth-hmac-keys identity %q can't contain a colon", parts[0])
+		}
+		keys[parts[0]] = parts[1]
+	}
+	return keys, nil
+}
+
+// GossipSecret returns the decoded gossip-key, or nil if there is none
+func (cfg *Config) GossipSecret() ([]byte, error) {
+	if cfg.GossipKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(cfg.GossipKey)
+	if err != nil {
+		return nil, fmt.Errorf("gossip-key is not base64: %v", err)
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, fmt.Errorf("gossip-key must be 16, 24 or 32 bytes, not %d", len(key))
+	}
+	return key, nil
+}
+
+// Validate returns an error listing every invalid setting
+func (cfg *Config) Validate() error {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if cfg.Bucket == "" && cfg.Buckets == "" {
+		fail("bucket or buckets is required")
+	}
+	for _, bucket := range strings.Split(cfg.Buckets, ",") {
+		if cfg.Bucket != "" && strings.TrimSpace(bucket) == cfg.Bucket {
+			fail("bucket %v can't be in buckets too", cfg.Bucket)
+		}
+	}
+	for name, port := range map[string]int{
+		"port": cfg.Port, "fsport": cfg.FSPort, "primary-port": cfg.PrimaryPort, "raft-port": cfg.RaftPort,
+	} {
+		if port <= 0 || port > 65535 {
+			fail("%v %d is not a valid port", name, port)
+		}
+	}
+	if cfg.MetadataBackend != "redis" && cfg.MetadataBackend != "raft" {
+		fail("metadata-backend must be redis or raft, not %q", cfg.MetadataBackend)
+	}
+	switch cfg.S3SSE {
+	case "", "AES256", "aws:kms":
+	default:
+		fail("s3-sse must be AES256 or aws:kms, not %q", cfg.S3SSE)
+	}
+	if cfg.S3SSEKMSKeyID != "" && cfg.S3SSE != "aws:kms" {
+		fail("s3-sse-kms-key-id needs s3-sse aws:kms")
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		fail("tls-cert and tls-key must be given together")
+	}
+	if cfg.MutualTLS && (cfg.TLSCert == "" || cfg.TLSCA == "") {
+		fail("mutual-tls needs tls-cert, tls-key and tls-ca")
+	}
+	if cfg.NodeCerts != "" && !cfg.MutualTLS {
+		fail("node-certs needs mutual-tls")
+	}
+	tokens, err := cfg.TokenIdentities()
+	if err != nil {
+		fail("%v", err)
+	}
+	keys, err := cfg.HMACKeyIdentities()
+	if err != nil {
+		fail("%v", err)
+	}
+	// Raft traffic is only authenticated by certificates
+	auth := cfg.AuthToken != "" || cfg.AuthHMACKey != "" || len(tokens) > 0 || len(keys) > 0
+	if cfg.MetadataBackend == "raft" && auth && !cfg.MutualTLS {
+		fail("metadata-backend raft with authentication needs mutual-tls")
+	}
+	// Every node that gossips its raft address becomes a voter
+	if cfg.MetadataBackend == "raft" && cfg.GossipKey == "" {
+		fail("metadata-backend raft needs gossip-key")
+	}
+	if _, err := cfg.GossipSecret(); err != nil {
+		fail("%v", err)
+	}
+	switch cfg.Partitioner {
+	case "hash", "bounded", "rendezvous":
+	default:
+		fail("partitioner must be hash, bounded or rendezvous, not %q", cfg.Partitioner)
+	}
+	if cfg.LoadFactor < 1 {
+		fail("load-factor must be at least 1")
+	}
+	switch cfg.DiskBackend {
+	case "", "blockmanager", "badger", "diskv":
+	default:
+		fail("disk-backend must be blockmanager, badger or diskv, not %q", cfg.DiskBackend)
+	}
+	switch cfg.MemCompression {
+	case "", "none", "snappy", "zstd", "lz4":
+	default:
+		fail("mem-compression must be none, snappy, zstd or lz4, not %q", cfg.MemCompression)
+	}
+	for name, n := range map[string]int{
+		"block-size":             cfg.BlockSizeKB,
+		"num-downloaders":        cfg.NumDownloaders,
+		"num-uploaders":          cfg.NumUploaders,
+		"num-block-uploaders":    cfg.NumBlockUploaders,
+		"aggregator-parallelism": cfg.AggregatorParallelism,
+		"hash-replicas":          cfg.HashReplicas,
+	} {
+		if n <= 0 {
+			fail("%v must be positive", name)
+		}
+	}
+	for name, n := range map[string]int{
+		"join-timeout":        cfg.JoinTimeout,
+		"bootstrap-expect":    cfg.BootstrapExpect,
+		"raft-failed-timeout": cfg.RaftFailedTimeout,
+		"discovery-interval":  cfg.DiscoveryInterval,
+		"mem-max":             cfg.MemMaxMB,
+		"disk-max":            cfg.DiskMaxMB,
+		"disk-ttl":            cfg.DiskTTL,
+		"metadata-lease":      cfg.MetadataLease,
+		"reconcile-interval":  cfg.ReconcileInterval,
+	} {
+		if n < 0 {
+			fail("%v can't be negative", name)
+		}
+	}
+
+	if len(problems) > 0 {
+		// Map iteration order is random
+		sort.Strings(problems)
+		return fmt.Errorf("invalid configuration: %v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// String returns the settings as YAML with secrets left out
+func (cfg *Config) String() string {
+	printed := *cfg
+	for _, secret := range []*string{
+		&printed.RedisPassword, &printed.AuthToken, &printed.AuthHMACKey, &printed.GossipKey, &printed.AuthTokens,
+		&printed.AuthHMACKeys, &printed.PresignKey,
+	} {
+		if *secret != "" {
+			*secret = "<hidden>"
+		}
+	}
+	data, _ := yaml.Marshal(&printed)
+	return string(data)
+}
+
+// Changes returns the keys of the settings that differ between cfg and
+// other, split by whether they can be reloaded
+func (cfg *Config) Changes(other *Config) (reloadable []string, restart []string) {
+	a, b := reflect.ValueOf(cfg).Elem(), reflect.ValueOf(other).Elem()
+	t := a.Type()
+	for i := 0; i < t.NumField(); i += 1 {
+		if a.Field(i).Interface() == b.Field(i).Interface() {
+			continue
+		}
+		key := t.Field(i).Tag.Get("yaml")
+		if t.Field(i).Tag.Get("reload") == "true" {
+			reloadable = append(reloadable, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	return reloadable, restart
+}
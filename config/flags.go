@@ -0,0 +1,236 @@
+package config
+
+import (
+	"github.com/urfave/cli"
+	"strings"
+)
+
+// EnvPrefix prefixes the environment variable of every setting. The
+// setting raft-dir is read from FASTFS_RAFT_DIR.
+const EnvPrefix = "FASTFS_"
+
+// option is a setting that can be given as a flag or environment variable
+type option struct {
+	flag  cli.Flag
+	apply func(c *cli.Context, cfg *Config)
+}
+
+func envVar(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func stringOption(name string, usage string, field func(*Config) *string) option {
+	return option{
+		flag: cli.StringFlag{Name: name, Usage: usage, EnvVar: envVar(name), Value: *field(Default())},
+		apply: func(c *cli.Context, cfg *Config) {
+			*field(cfg) = c.String(name)
+		},
+	}
+}
+
+func intOption(name string, usage string, field func(*Config) *int) option {
+	return option{
+		flag: cli.IntFlag{Name: name, Usage: usage, EnvVar: envVar(name), Value: *field(Default())},
+		apply: func(c *cli.Context, cfg *Config) {
+			*field(cfg) = c.Int(name)
+		},
+	}
+}
+
+func floatOption(name string, usage string, field func(*Config) *float64) option {
+	return option{
+		flag: cli.Float64Flag{Name: name, Usage: usage, EnvVar: envVar(name), Value: *field(Default())},
+		apply: func(c *cli.Context, cfg *Config) {
+			*field(cfg) = c.Float64(name)
+		},
+	}
+}
+
+func boolOption(name string, usage string, field func(*Config) *bool) option {
+	return option{
+		flag: cli.BoolFlag{Name: name, Usage: usage, EnvVar: envVar(name)},
+		apply: func(c *cli.Context, cfg *Config) {
+			*field(cfg) = c.Bool(name)
+		},
+	}
+}
+
+var options = []option{
+	stringOption("bucket", "S3 Bucket to use as backing store. Paths not starting with one of --buckets are in it",
+		func(c *Config) *string { return &c.Bucket }),
+	stringOption("buckets", "Comma separated S3 buckets to serve too. Their files are at <bucket>/<key>",
+		func(c *Config) *string { return &c.Buckets }),
+	stringOption("region", "AWS region of the bucket",
+		func(c *Config) *string { return &c.Region }),
+	stringOption("s3-endpoint", "S3 endpoint to use instead of AWS, e.g. for MinIO or a VPC endpoint",
+		func(c *Config) *string { return &c.S3Endpoint }),
+	stringOption("s3-profile", "Profile in the AWS shared config to take credentials from",
+		func(c *Config) *string { return &c.S3Profile }),
+	boolOption("s3-path-style", "Address buckets in the path instead of the host name, as MinIO needs",
+		func(c *Config) *bool { return &c.S3PathStyle }),
+	stringOption("s3-acl", "Canned ACL of objects written to S3",
+		func(c *Config) *string { return &c.S3ACL }),
+	stringOption("s3-storage-class", "Storage class of objects written to S3. Defaults to the bucket's",
+		func(c *Config) *string { return &c.S3StorageClass }),
+	stringOption("s3-sse", "Server side encryption of objects written to S3. AES256 or aws:kms",
+		func(c *Config) *string { return &c.S3SSE }),
+	stringOption("s3-sse-kms-key-id", "KMS key to encrypt objects written to S3 with. Defaults to the AWS managed key",
+		func(c *Config) *string { return &c.S3SSEKMSKeyID }),
+	stringOption("address", "System Address",
+		func(c *Config) *string { return &c.Address }),
+	intOption("port", "Port to use for membership service",
+		func(c *Config) *int { return &c.Port }),
+	intOption("fsport", "Port to use for filesystem service. Defaults to port + 100",
+		func(c *Config) *int { return &c.FSPort }),
+	stringOption("primary-addr", "Address of the node to join through if there are no --seeds",
+		func(c *Config) *string { return &c.PrimaryAddr }),
+	intOption("primary-port", "Port of the node to join through if there are no --seeds",
+		func(c *Config) *int { return &c.PrimaryPort }),
+	stringOption("seeds", "Comma separated address:port of nodes to join the cluster through. "+
+		"A node that is its only seed starts a new cluster",
+		func(c *Config) *string { return &c.Seeds }),
+	intOption("join-timeout", "Seconds to keep retrying to join through the seeds before giving up",
+		func(c *Config) *int { return &c.JoinTimeout }),
+	boolOption("bootstrap", "Start a new cluster instead of exiting if no seed can be reached",
+		func(c *Config) *bool { return &c.Bootstrap }),
+	intOption("bootstrap-expect", "Number of nodes to wait for before the lowest named one bootstraps Raft "+
+		"with all of them. Defaults to the number of --seeds when the node is one of them",
+		func(c *Config) *int { return &c.BootstrapExpect }),
+	stringOption("discovery-dns", "DNS name to find seeds in. An SRV name like _fastfs._tcp.example.com, "+
+		"or host:port to use every address of host",
+		func(c *Config) *string { return &c.DiscoveryDNS }),
+	stringOption("discovery-file", "JSON or YAML file listing address:port of seeds",
+		func(c *Config) *string { return &c.DiscoveryFile }),
+	intOption("discovery-interval", "Seconds between looking for new nodes through --seeds, --discovery-dns and "+
+		"--discovery-file. 0 only looks when starting",
+		func(c *Config) *int { return &c.DiscoveryInterval }),
+	stringOption("tls-cert", "PEM certificate of this node. Enables HTTPS for clients and between nodes",
+		func(c *Config) *string { return &c.TLSCert }),
+	stringOption("tls-key", "PEM private key of --tls-cert",
+		func(c *Config) *string { return &c.TLSKey }),
+	stringOption("tls-ca", "PEM CA certificates to verify other nodes with. Defaults to the system roots",
+		func(c *Config) *string { return &c.TLSCA }),
+	boolOption("mutual-tls", "Require certificates signed by --tls-ca from other nodes, and from clients "+
+		"unless they use --auth-token or --auth-hmac-key",
+		func(c *Config) *bool { return &c.MutualTLS }),
+	stringOption("node-certs", "Comma separated common names of node certificates. Requests presenting them "+
+		"may do everything",
+		func(c *Config) *string { return &c.NodeCerts }),
+	stringOption("auth-token", "Bearer token requests must carry",
+		func(c *Config) *string { return &c.AuthToken }),
+	stringOption("auth-hmac-key", "Key requests can be signed with instead of carrying --auth-token",
+		func(c *Config) *string { return &c.AuthHMACKey }),
+	stringOption("auth-tokens", "Comma separated identity=token bearer tokens of clients with their own identity",
+		func(c *Config) *string { return &c.AuthTokens }),
+	stringOption("auth-hmac-keys", "Comma separated identity=key HMAC keys of clients with their own identity",
+		func(c *Config) *string { return &c.AuthHMACKeys }),
+	stringOption("acl-file", "YAML or JSON rules of what every identity may do on which path prefixes",
+		func(c *Config) *string { return &c.ACLFile }),
+	stringOption("audit-log", "File to append denied requests to. Defaults to the log",
+		func(c *Config) *string { return &c.AuditLog }),
+	stringOption("presign-key", "Key to sign presigned URLs with. Every node needs the same one",
+		func(c *Config) *string { return &c.PresignKey }),
+	stringOption("gossip-key", "Base64 16, 24 or 32 byte key to encrypt membership gossip with",
+		func(c *Config) *string { return &c.GossipKey }),
+	stringOption("redis-addr", "Comma separated addresses of redis servers",
+		func(c *Config) *string { return &c.RedisAddr }),
+	stringOption("redis-master", "Name of the redis master monitored by sentinel. --redis-addr then lists the "+
+		"sentinels. Without it, more than one --redis-addr connects to a redis cluster",
+		func(c *Config) *string { return &c.RedisMaster }),
+	stringOption("redis-password", "Password of the redis server",
+		func(c *Config) *string { return &c.RedisPassword }),
+	stringOption("metadata-backend", "Where to keep metadata. redis, or raft to replicate it between the nodes themselves",
+		func(c *Config) *string { return &c.MetadataBackend }),
+	intOption("raft-port", "Port to use for raft. Defaults to port + 200",
+		func(c *Config) *int { return &c.RaftPort }),
+	stringOption("raft-dir", "Directory to keep the raft log and snapshots in",
+		func(c *Config) *string { return &c.RaftDir }),
+	intOption("raft-failed-timeout", "Seconds before a failed node is removed from raft. 0 never removes it",
+		func(c *Config) *int { return &c.RaftFailedTimeout }),
+	intOption("metadata-lease", "Seconds file info is cached by a node. Bounds how stale sizes can be after an overwrite",
+		func(c *Config) *int { return &c.MetadataLease }),
+	intOption("num-downloaders", "Number of downloaders",
+		func(c *Config) *int { return &c.NumDownloaders }),
+	intOption("num-uploaders", "Number of files written to S3 at once",
+		func(c *Config) *int { return &c.NumUploaders }),
+	intOption("num-block-uploaders", "Number of written blocks sent to their nodes at once",
+		func(c *Config) *int { return &c.NumBlockUploaders }),
+	intOption("aggregator-parallelism", "Number of blocks of a file being written that are buffered at once",
+		func(c *Config) *int { return &c.AggregatorParallelism }),
+	intOption("hash-replicas", "Number of points on the consistent hash ring of a node with 1GB of cache. "+
+		"Nodes get points in proportion to --mem-max plus --disk-max",
+		func(c *Config) *int { return &c.HashReplicas }),
+	stringOption("partitioner", "How blocks are placed on nodes. hash for consistent hashing, bounded for "+
+		"consistent hashing with bounded loads or rendezvous for highest random weight hashing",
+		func(c *Config) *string { return &c.Partitioner }),
+	floatOption("load-factor", "With --partitioner bounded, how many times its share of requests a node may "+
+		"serve before blocks go to the next node",
+		func(c *Config) *float64 { return &c.LoadFactor }),
+	intOption("block-size", "Block size for storage and tramission",
+		func(c *Config) *int { return &c.BlockSizeKB }),
+	intOption("mem-max", "Maximum memory to use in MB. Cache entries = Max memory / num entries",
+		func(c *Config) *int { return &c.MemMaxMB }),
+	intOption("disk-max", "Maximum disk space to use in MB. Cache entries = Max disk space / num entries",
+		func(c *Config) *int { return &c.DiskMaxMB }),
+	stringOption("disk-location", "Location to store disk cache",
+		func(c *Config) *string { return &c.DiskLocation }),
+	stringOption("disk-backend", "Disk cache engine. One of blockmanager, badger or diskv",
+		func(c *Config) *string { return &c.DiskBackend }),
+	intOption("disk-ttl", "Seconds a block stays valid in the disk cache. 0 keeps blocks until they are evicted",
+		func(c *Config) *int { return &c.DiskTTL }),
+	stringOption("namespaces", "Comma separated cache namespaces with their own quota as prefix=memMB:diskMB. "+
+		"e.g. teamA/=256:1024,teamB/=128:512",
+		func(c *Config) *string { return &c.Namespaces }),
+	stringOption("mem-compression", "Compress blocks in the memory cache. One of none, snappy, zstd or lz4",
+		func(c *Config) *string { return &c.MemCompression }),
+	boolOption("mem-arena", "Keep the memory cache in an mmap arena outside the Go heap",
+		func(c *Config) *bool { return &c.MemArena }),
+	stringOption("reconcile-prefixes", "Comma separated prefixes to reconcile with S3. Defaults to the whole bucket",
+		func(c *Config) *string { return &c.ReconcilePrefixes }),
+	intOption("reconcile-interval", "Seconds between reconciliations of metadata with S3 by the coordinator. 0 disables them",
+		func(c *Config) *int { return &c.ReconcileInterval }),
+	boolOption("verbose", "Verbose logging",
+		func(c *Config) *bool { return &c.Verbose }),
+	boolOption("cpu-profile", "Profile CPU",
+		func(c *Config) *bool { return &c.CPUProfile }),
+}
+
+// Flags returns the command line flags of every setting, plus --config to
+// read a file and --print-config to print the effective settings
+func Flags() []cli.Flag {
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "YAML or TOML file to read settings from. Flags and FASTFS_* variables take precedence",
+			EnvVar: envVar("config"),
+		},
+		cli.BoolFlag{
+			Name:  "print-config",
+			Usage: "Print the effective settings and exit",
+		},
+	}
+	for _, o := range options {
+		flags = append(flags, o.flag)
+	}
+	return flags
+}
+
+// FromContext returns the settings given by the defaults, the --config file,
+// environment variables and flags. It can be called again to reload them.
+func FromContext(c *cli.Context) (*Config, error) {
+	cfg := Default()
+	if path := c.String("config"); path != "" {
+		err := cfg.Load(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, o := range options {
+		if c.IsSet(o.flag.GetName()) {
+			o.apply(c, cfg)
+		}
+	}
+	cfg.derive()
+	return cfg, cfg.Validate()
+}
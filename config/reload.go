@@ -0,0 +1,52 @@
+package config
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// reloaded returns cfg with the reloadable settings of other
+func (cfg *Config) reloaded(other *Config) *Config {
+	next := *cfg
+	a, b := reflect.ValueOf(&next).Elem(), reflect.ValueOf(other).Elem()
+	t := a.Type()
+	for i := 0; i < t.NumField(); i += 1 {
+		if t.Field(i).Tag.Get("reload") == "true" {
+			a.Field(i).Set(b.Field(i))
+		}
+	}
+	return &next
+}
+
+// Reload reads the settings again every time the process gets SIGHUP and
+// calls apply with them. Only settings tagged reload change. Changes to
+// the others are logged and wait for a restart. Never returns.
+func Reload(c *cli.Context, current *Config, apply func(cfg *Config)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		cfg, err := FromContext(c)
+		if err != nil {
+			log.Errorf("Not reloading configuration: %v", err)
+			continue
+		}
+
+		reloadable, restart := current.Changes(cfg)
+		if len(restart) > 0 {
+			log.Errorf("Restart to apply changes to %v", strings.Join(restart, ", "))
+		}
+		if len(reloadable) == 0 {
+			continue
+		}
+
+		log.Infof("Reloading %v", strings.Join(reloadable, ", "))
+		current = current.reloaded(cfg)
+		apply(current)
+	}
+}
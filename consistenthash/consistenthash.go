@@ -3,6 +3,7 @@ package consistenthash
 // https://github.com/golang/groupcache/blob/master/consistenthash/consistenthash.go
 import (
 	"github.com/rahulgovind/fastfs/hash"
+	"math"
 	"sort"
 	"strconv"
 	"sync"
@@ -17,6 +18,8 @@ type Map struct {
 	replicas int
 	keys     []int // Sorted
 	hashMap  map[int]string
+	// counts is the number of replicas of every key
+	counts map[string]int
 }
 
 func New(replicas int, fn Hash) *Map {
@@ -24,6 +27,7 @@ func New(replicas int, fn Hash) *Map {
 		replicas: replicas,
 		hash:     fn,
 		hashMap:  make(map[int]string),
+		counts:   make(map[string]int),
 	}
 	if m.hash == nil {
 		m.hash = hash.HashInt32
@@ -46,15 +50,43 @@ func (m *Map) Add(keys ...string) {
 	defer m.mu.Unlock()
 
 	for _, key := range keys {
-		for i := 0; i < m.replicas; i++ {
-			hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
-			m.keys = append(m.keys, hash)
-			m.hashMap[hash] = key
-		}
+		m.add(key, m.replicas)
+	}
+	sort.Ints(m.keys)
+}
+
+// AddWeighted adds key with replicas in proportion to weight, so it gets
+// weight times the share of a key added with Add. Every key has at least
+// one replica. A key already in the hash gets the new weight.
+func (m *Map) AddWeighted(key string, weight float64) {
+	replicas := int(math.Round(float64(m.replicas) * weight))
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.counts[key] == replicas {
+		return
 	}
+	m.remove(key)
+	m.add(key, replicas)
 	sort.Ints(m.keys)
 }
 
+// add appends the replicas of key. The caller sorts the keys.
+func (m *Map) add(key string, replicas int) {
+	// Replica i hashes the same whatever the weight, so changing a weight
+	// only moves the replicas added or removed
+	for i := 0; i < replicas; i++ {
+		hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
+		m.keys = append(m.keys, hash)
+		m.hashMap[hash] = key
+	}
+	m.counts[key] = replicas
+}
+
 // Get gets the closest item in the hash to the provided key.
 func (m *Map) Get(key string) string {
 	m.mu.RLock()
@@ -77,11 +109,56 @@ func (m *Map) Get(key string) string {
 	return m.hashMap[m.keys[idx]]
 }
 
+// GetBounded gets the owner of key under consistent hashing with bounded
+// loads. Going clockwise from key, the first item whose load is at most c
+// times its share of the total load is returned. Shares are in proportion
+// to replicas and load returns the current load of an item. Loads of
+// items below their bound are not changed, so with c > 1 most keys stay
+// where Get puts them.
+func (m *Map) GetBounded(key string, c float64, load func(item string) float64) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.keys) == 0 {
+		return ""
+	}
+
+	// Every lookup adds one to the total, so idle items aren't all full
+	total := 1.0
+	loads := make(map[string]float64, len(m.counts))
+	for item := range m.counts {
+		loads[item] = load(item)
+		total += loads[item]
+	}
+
+	hash := int(m.hash([]byte(key)))
+	start := sort.Search(len(m.keys), func(i int) bool { return m.keys[i] >= hash })
+	for i := 0; i < len(m.keys); i++ {
+		item := m.hashMap[m.keys[(start+i)%len(m.keys)]]
+		bound := c * total * float64(m.counts[item]) / float64(len(m.keys))
+		if loads[item]+1 <= bound {
+			return item
+		}
+	}
+	// Only possible with c < 1
+	return m.hashMap[m.keys[start%len(m.keys)]]
+}
+
 func (m *Map) Remove(key string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for i := 0; i < m.replicas; i++ {
+	m.remove(key)
+}
+
+func (m *Map) remove(key string) {
+	replicas, ok := m.counts[key]
+	if !ok {
+		return
+	}
+	delete(m.counts, key)
+
+	for i := 0; i < replicas; i++ {
 		hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
 		idx := sort.Search(len(m.keys), func(i int) bool { return m.keys[i] >= hash })
 
@@ -70,6 +70,41 @@ func TestConsistency(t *testing.T) {
 
 }
 
+func TestWeighted(t *testing.T) {
+	hash := New(50, nil)
+	hash.AddWeighted("small", 1)
+	hash.AddWeighted("big", 4)
+
+	counts := make(map[string]int)
+	for i := 0; i < 100000; i++ {
+		counts[hash.Get(fmt.Sprintf("file:%d", i))] += 1
+	}
+
+	share := float64(counts["big"]) / 100000
+	if share < 0.7 || share > 0.9 {
+		t.Errorf("Node with 4 times the weight got %.2f of the keys, expected about 0.8", share)
+	}
+
+	// Raising the weight only moves keys to the node
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("file:%d", i)
+		before[key] = hash.Get(key)
+	}
+	hash.AddWeighted("small", 2)
+	for key, owner := range before {
+		if owner == "small" && hash.Get(key) != "small" {
+			t.Errorf("%s moved away from the node whose weight was raised", key)
+		}
+	}
+
+	hash.Remove("big")
+	hash.Remove("small")
+	if !hash.IsEmpty() {
+		t.Errorf("Removing weighted keys should leave the hash empty")
+	}
+}
+
 func BenchmarkGet8(b *testing.B)   { benchmarkGet(b, 8) }
 func BenchmarkGet32(b *testing.B)  { benchmarkGet(b, 32) }
 func BenchmarkGet128(b *testing.B) { benchmarkGet(b, 128) }
@@ -92,3 +127,89 @@ func benchmarkGet(b *testing.B, shards int) {
 		hash.Get(buckets[i&(shards-1)])
 	}
 }
+
+// placement returns where keys go among nodes
+type placement func(nodes []string) func(key string) string
+
+func ringPlacement(nodes []string) func(key string) string {
+	hash := New(50, nil)
+	hash.Add(nodes...)
+	return hash.Get
+}
+
+// boundedPlacement counts every lookup as load of the node it returns
+func boundedPlacement(nodes []string) func(key string) string {
+	hash := New(50, nil)
+	hash.Add(nodes...)
+	loads := make(map[string]float64)
+	return func(key string) string {
+		node := hash.GetBounded(key, 1.25, func(node string) float64 { return loads[node] })
+		loads[node] += 1
+		return node
+	}
+}
+
+func rendezvousPlacement(nodes []string) func(key string) string {
+	r := NewRendezvous()
+	for _, node := range nodes {
+		r.Add(node, 1)
+	}
+	return r.Get
+}
+
+func benchmarkNodes(n int) []string {
+	var nodes []string
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, fmt.Sprintf("10.0.0.%d:8100", i))
+	}
+	return nodes
+}
+
+func BenchmarkDistributionRing(b *testing.B)       { benchmarkDistribution(b, ringPlacement) }
+func BenchmarkDistributionBounded(b *testing.B)    { benchmarkDistribution(b, boundedPlacement) }
+func BenchmarkDistributionRendezvous(b *testing.B) { benchmarkDistribution(b, rendezvousPlacement) }
+
+// benchmarkDistribution reports how many times the mean number of keys the
+// busiest of 16 nodes gets
+func benchmarkDistribution(b *testing.B, p placement) {
+	nodes := benchmarkNodes(16)
+	get := p(nodes)
+	counts := make(map[string]int)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		counts[get(fmt.Sprintf("file-%d:%d", i/64, i%64))] += 1
+	}
+	b.StopTimer()
+
+	max := 0
+	for _, count := range counts {
+		if count > max {
+			max = count
+		}
+	}
+	b.ReportMetric(float64(max)*float64(len(nodes))/float64(b.N), "max/mean")
+}
+
+func BenchmarkChurnRing(b *testing.B)       { benchmarkChurn(b, ringPlacement) }
+func BenchmarkChurnBounded(b *testing.B)    { benchmarkChurn(b, boundedPlacement) }
+func BenchmarkChurnRendezvous(b *testing.B) { benchmarkChurn(b, rendezvousPlacement) }
+
+// benchmarkChurn reports the fraction of keys that move when a 17th node
+// joins. 1/17 of them have to.
+func benchmarkChurn(b *testing.B, p placement) {
+	const keys = 10000
+	nodes := benchmarkNodes(17)
+	moved := 0
+
+	for i := 0; i < b.N; i++ {
+		before, after := p(nodes[:16]), p(nodes)
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("file-%d:%d", k/64, k%64)
+			if before(key) != after(key) {
+				moved += 1
+			}
+		}
+	}
+	b.ReportMetric(float64(moved)/float64(b.N*keys), "moved/key")
+}
@@ -0,0 +1,90 @@
+package consistenthash
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// Rendezvous assigns every key to the item with the highest score for it,
+// also known as highest random weight hashing. Adding or removing an item
+// only moves the keys it gains or loses. Scores are weighted, so an item
+// of weight 2 gets twice the keys of one of weight 1.
+type Rendezvous struct {
+	mu      sync.RWMutex
+	weights map[string]float64
+}
+
+func NewRendezvous() *Rendezvous {
+	r := new(Rendezvous)
+	r.weights = make(map[string]float64)
+	return r
+}
+
+// Add adds item with weight or changes its weight
+func (r *Rendezvous) Add(item string, weight float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.weights[item] = weight
+}
+
+func (r *Rendezvous) Remove(item string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.weights, item)
+}
+
+// Weights returns the weight of every item
+func (r *Rendezvous) Weights() map[string]float64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	weights := make(map[string]float64, len(r.weights))
+	for item, weight := range r.weights {
+		weights[item] = weight
+	}
+	return weights
+}
+
+func (r *Rendezvous) IsEmpty() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.weights) == 0
+}
+
+// score is -weight / ln(u) for u uniform in (0, 1) given by the hash of
+// item and key. The highest score of a key is then at every item with
+// probability proportional to its weight.
+func score(item string, key string, weight float64) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+
+	// Similar strings have similar FNV hashes. Mix the bits.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// Get returns the item with the highest score for key
+func (r *Rendezvous) Get(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	best, bestScore := "", math.Inf(-1)
+	for item, weight := range r.weights {
+		s := score(item, key, weight)
+		// Ties go to the lowest item, so every node agrees
+		if s > bestScore || (s == bestScore && item < best) {
+			best, bestScore = item, s
+		}
+	}
+	return best
+}
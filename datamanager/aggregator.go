@@ -1,7 +1,6 @@
 package datamanager
 
 import (
-	"bytes"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"sync"
@@ -208,6 +207,7 @@ type ReverseAggregator struct {
 
 func (dm *DataManager) NewReverseAggregator(path string, reader io.Reader, lookAhaead int) *ReverseAggregator {
 	rag := new(ReverseAggregator)
+	rag.dm = dm
 	rag.path = path
 
 	// TODO: Add uploaders
@@ -234,7 +234,7 @@ func (rag *ReverseAggregator) ReadFrom(reader io.Reader) {
 
 	for {
 		out <- true
-		buf := bytes.NewBuffer(nil)
+		buf := rag.dm.NewBuffer()
 
 		_, readErr := io.CopyN(buf, reader, rag.blockSize)
 
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/golang/groupcache/singleflight"
+	"github.com/rahulgovind/fastfs/bufpool"
 	"github.com/rahulgovind/fastfs/cache"
 	"github.com/rahulgovind/fastfs/metadatamanager"
 	"github.com/rahulgovind/fastfs/partitioner"
 	"github.com/rahulgovind/fastfs/s3"
+	"github.com/rahulgovind/fastfs/transport"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
@@ -33,7 +35,8 @@ func StringToCacheKey(s string) (string, int64) {
 
 type DataManager struct {
 	cache          cache.Cache
-	bucket         string
+	pool           *bufpool.Pool
+	Buckets        *s3.Buckets
 	numDownloaders int
 	downloader     *s3manager.Downloader
 	requestCh      chan DownloadElement
@@ -43,15 +46,16 @@ type DataManager struct {
 	mm             *metadatamanager.MetadataManager
 	uploadChan     chan *UploadInput
 	partitioner    partitioner.Partitioner
+	evictedChan    chan string
 }
 
 type DownloadElement struct {
 	fLink string
-	out   chan []byte
+	out   chan *bufpool.Buffer
 }
 
 type UploadInput struct {
-	buf   *bytes.Buffer
+	buf   *bufpool.Buffer
 	path  string
 	block int64
 	sem   chan bool
@@ -68,11 +72,17 @@ type BlockPutter interface {
 	GetBlockSize() int64
 }
 
-func New(bucket string, numDownloaders int, hc cache.Cache, blockSize int64,
+// New creates a DataManager. Blocks are read into buffers from pool, or
+// from a heap backed pool if pool is nil.
+func New(buckets *s3.Buckets, numDownloaders int, numUploaders int, hc cache.Cache, pool *bufpool.Pool, blockSize int64,
 	serverAddr string, mm *metadatamanager.MetadataManager, p partitioner.Partitioner) *DataManager {
 	dm := new(DataManager)
 	dm.cache = hc
-	dm.bucket = bucket
+	dm.pool = pool
+	if dm.pool == nil {
+		dm.pool = bufpool.New(blockSize)
+	}
+	dm.Buckets = buckets
 	dm.numDownloaders = numDownloaders
 	dm.downloader = s3.GetDownloader()
 	dm.BlockSize = blockSize
@@ -82,8 +92,13 @@ func New(bucket string, numDownloaders int, hc cache.Cache, blockSize int64,
 
 	dm.uploadChan = make(chan *UploadInput, 128)
 	dm.partitioner = p
+	dm.evictedChan = make(chan string, 4096)
+
+	if dm.mm != nil {
+		go dm.locationRemover()
+	}
 
-	for i := 0; i < 32; i += 1 {
+	for i := 0; i < numUploaders; i += 1 {
 		go dm.uploader()
 	}
 
@@ -97,21 +112,31 @@ func (dm *DataManager) Start() {
 	}
 }
 
+// NewBuffer returns an empty block buffer. The caller must release it.
+func (dm *DataManager) NewBuffer() *bufpool.Buffer {
+	return dm.pool.Get()
+}
+
 // Given Path and block number download file
-func (dm *DataManager) download(path string, block int64) ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0, dm.BlockSize))
+func (dm *DataManager) download(path string, block int64) (*bufpool.Buffer, error) {
+	bucket, key, err := dm.Buckets.Split(path)
+	if err != nil {
+		return nil, err
+	}
 
-	err := s3.DownloadToWriterPartial(dm.bucket, dm.downloader, path, buf,
+	buf := dm.pool.Get()
+	err = s3.DownloadToWriterPartial(bucket, dm.downloader, key, buf,
 		block*dm.BlockSize,
 		dm.BlockSize,
 	)
 
 	if err != nil {
 		log.Error(err)
+		buf.Release()
 		return nil, err
 	}
 
-	return buf.Bytes(), nil
+	return buf, nil
 }
 
 func (dm *DataManager) downloadWorker() {
@@ -127,13 +152,14 @@ func (dm *DataManager) downloadWorker() {
 
 		var err error = nil
 
-		data, err := dm.download(path, block)
+		buf, err := dm.download(path, block)
 
 		if err != nil {
 			log.Error(err)
+			buf = bufpool.Wrap(nil)
 		}
 
-		req.out <- data
+		req.out <- buf
 	}
 }
 
@@ -142,47 +168,184 @@ func (dm *DataManager) CacheGet(path string, block int64) ([]byte, bool) {
 	return dm.cache.Get(fLink)
 }
 
+// CacheOpen returns a reader for a cached block that streams it without
+// copying where the cache supports it. The reader must be closed.
+func (dm *DataManager) CacheOpen(path string, block int64) (cache.Reader, bool) {
+	fLink := CacheKeyToString(path, block)
+	if opener, ok := dm.cache.(cache.Opener); ok {
+		return opener.Open(fLink)
+	}
+
+	data, ok := dm.cache.Get(fLink)
+	if !ok {
+		return nil, false
+	}
+	return cache.NewBytesReader(data), true
+}
+
+// HandleEvicted is called by the cache when a block is evicted. The block
+// location registry is updated in batches.
+func (dm *DataManager) HandleEvicted(fLink string) {
+	if dm.mm == nil {
+		return
+	}
+
+	select {
+	case dm.evictedChan <- fLink:
+	default:
+		// Readers drop stale locations when the node doesn't have the block
+		log.Errorf("Location update queue full. Dropping eviction of %v", fLink)
+	}
+}
+
+func (dm *DataManager) locationRemover() {
+	var batch []string
+	ticker := time.NewTicker(100 * time.Millisecond)
+	for {
+		select {
+		case fLink := <-dm.evictedChan:
+			batch = append(batch, fLink)
+			if len(batch) < 512 {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+
+		// Blocks read from disk are also copied to memory, so the
+		// cache may still have a block one of its tiers evicted
+		container, canCheck := dm.cache.(cache.Container)
+		var gone []string
+		for _, fLink := range batch {
+			if !canCheck || !container.Contains(fLink) {
+				gone = append(gone, fLink)
+			}
+		}
+
+		log.Debugf("Removing %d block locations", len(gone))
+		dm.mm.RemoveLocations(gone, dm.ServerAddr)
+		batch = nil
+	}
+}
+
 func (dm *DataManager) CacheDelete(path string, block int64) {
 	fLink := CacheKeyToString(path, block)
 	dm.cache.Remove(fLink)
 }
 
-func (dm *DataManager) uniqueGet(path string, block int64) ([]byte, error) {
+// CachePin exempts a cached block from eviction. Returns false if the block
+// isn't cached or the cache doesn't support pinning.
+func (dm *DataManager) CachePin(path string, block int64, ttl time.Duration) bool {
+	pc, ok := dm.cache.(cache.Pinner)
+	if !ok {
+		return false
+	}
+	return pc.Pin(CacheKeyToString(path, block), ttl)
+}
+
+// CacheUnpinPrefix releases pins on all cached blocks of files starting with prefix
+func (dm *DataManager) CacheUnpinPrefix(prefix string) int {
+	pc, ok := dm.cache.(cache.Pinner)
+	if !ok {
+		return 0
+	}
+	return pc.UnpinPrefix(prefix)
+}
+
+// CacheUsage reports usage of every cache namespace
+func (dm *DataManager) CacheUsage() []cache.Usage {
+	ur, ok := dm.cache.(cache.UsageReporter)
+	if !ok {
+		return []cache.Usage{{Entries: dm.cache.Len()}}
+	}
+	return ur.Usage()
+}
+
+func (dm *DataManager) cacheGetBuffer(fLink string) (*bufpool.Buffer, bool) {
+	if bc, ok := dm.cache.(cache.BufferCache); ok {
+		return bc.GetBuffer(fLink)
+	}
+
+	data, ok := dm.cache.Get(fLink)
+	if !ok {
+		return nil, false
+	}
+	return bufpool.Wrap(data), true
+}
+
+func (dm *DataManager) cacheAddBuffer(fLink string, buf *bufpool.Buffer) {
+	if bc, ok := dm.cache.(cache.BufferCache); ok {
+		bc.AddBuffer(fLink, buf)
+		return
+	}
+	// The cache keeps the slice so it can't share a pooled buffer
+	dm.cache.Add(fLink, append([]byte(nil), buf.Bytes()...))
+}
+
+// fetch downloads a block through the download workers
+func (dm *DataManager) fetch(fLink string) *bufpool.Buffer {
+	ch := make(chan *bufpool.Buffer, 1)
+	dm.requestCh <- DownloadElement{fLink, ch}
+	return <-ch
+}
+
+func (dm *DataManager) uniqueGet(path string, block int64) {
 	log.Debugf("uniqueGet: %v %v", path, block)
 
 	// In Cache?
 	fLink := CacheKeyToString(path, block)
-	data, ok := dm.cache.Get(fLink)
+	buf, ok := dm.cacheGetBuffer(fLink)
 	if !ok {
 		// Need to download :(
-		ch := make(chan []byte, 1)
-		dm.requestCh <- DownloadElement{fLink, ch}
-		data = <-ch
-		dm.cache.Add(fLink, data)
+		buf = dm.fetch(fLink)
+		dm.cacheAddBuffer(fLink, buf)
 
 		if dm.mm != nil {
-			dm.mm.SetLocation(path, block, dm.ServerAddr)
+			dm.mm.AddLocation(path, block, dm.ServerAddr)
 		}
 	}
-	return data, nil
+	buf.Release()
 }
 
-// Get deduplicates identical requests
-func (dm *DataManager) Get(path string, block int64) ([]byte, error) {
+// GetBuffer returns a block without copying it. Identical requests are
+// deduplicated and handed the block through the cache. The caller must
+// release the returned buffer.
+func (dm *DataManager) GetBuffer(path string, block int64) (*bufpool.Buffer, error) {
 	log.Debugf("Get: %v %v", path, block)
 	fLink := CacheKeyToString(path, block)
-	data, err := dm.g.Do(fLink, func() (data interface{}, err error) {
-		data, err = dm.uniqueGet(path, block)
-		return
+
+	if buf, ok := dm.cacheGetBuffer(fLink); ok {
+		return buf, nil
+	}
+
+	dm.g.Do(fLink, func() (interface{}, error) {
+		dm.uniqueGet(path, block)
+		return nil, nil
 	})
 
+	if buf, ok := dm.cacheGetBuffer(fLink); ok {
+		log.Debugf("Get done: %v %v %v", path, block, buf.Len())
+		return buf, nil
+	}
+
+	// Evicted before we got to it
+	return dm.fetch(fLink), nil
+}
+
+// Get returns a copy of a block
+func (dm *DataManager) Get(path string, block int64) ([]byte, error) {
+	buf, err := dm.GetBuffer(path, block)
 	if err != nil {
 		log.Fatal(err)
 		return nil, err
 	}
 
-	log.Debugf("Get done: %v %v %v", path, block, len(data.([]byte)))
-	return data.([]byte), nil
+	data := append([]byte(nil), buf.Bytes()...)
+	buf.Release()
+	return data, nil
 }
 
 func (dm *DataManager) GetBlockSize() int64 {
@@ -196,12 +359,22 @@ func (dm *DataManager) CachePut(path string, block int64, data []byte) error {
 	dm.cache.Add(fLink, data)
 
 	if dm.mm != nil {
-		dm.mm.SetLocation(path, block, dm.ServerAddr)
+		dm.mm.AddLocation(path, block, dm.ServerAddr)
 	}
 
 	return nil
 }
 
+// CachePutBuffer is CachePut without copying buf. The cache takes its own
+// reference.
+func (dm *DataManager) CachePutBuffer(path string, block int64, buf *bufpool.Buffer) {
+	dm.cacheAddBuffer(CacheKeyToString(path, block), buf)
+
+	if dm.mm != nil {
+		dm.mm.AddLocation(path, block, dm.ServerAddr)
+	}
+}
+
 type CountingReader struct {
 	r    io.ReadCloser
 	size int64
@@ -247,9 +420,9 @@ func (cr *CountingWriter) Size() int64 {
 	return cr.size
 }
 
+// Upload writes a file to S3 and records it in the metadata
 func (dm *DataManager) Upload(path string, r io.ReadCloser) {
-	cr := &CountingReader{r, 0}
-	err := s3.PutOjbect(dm.bucket, path, cr)
+	size, err := dm.Persist(path, r)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -259,13 +432,54 @@ func (dm *DataManager) Upload(path string, r io.ReadCloser) {
 		if lastIndex != -1 {
 			dir = path[:lastIndex+1]
 		}
-		dm.mm.AddToList(dir, path, cr.Size())
-		log.Infof("Adding to metadata: Dir:%s\tFile:%s\tSize: %d", dir, path, cr.Size())
+		dm.mm.AddToList(dir, path, size)
+		log.Infof("Adding to metadata: Dir:%s\tFile:%s\tSize: %d", dir, path, size)
+	}
+}
+
+// Persist writes a file to S3 without touching the metadata, for files
+// that were recorded when they were written to the cache. Returns the size.
+// Nothing is written if r fails.
+func (dm *DataManager) Persist(path string, r io.ReadCloser) (int64, error) {
+	cr := &CountingReader{r, 0}
+	bucket, key, err := dm.Buckets.Split(path)
+	if err != nil {
+		return 0, err
+	}
+	err = s3.PutOjbect(bucket, key, cr)
+	if err != nil {
+		return 0, err
+	}
+	return cr.Size(), nil
+}
+
+// Rename moves a file in S3 without touching the metadata
+func (dm *DataManager) Rename(src string, dest string) error {
+	bucket, srcKey, err := dm.Buckets.Split(src)
+	if err != nil {
+		return err
+	}
+	destBucket, destKey, err := dm.Buckets.Split(dest)
+	if err != nil {
+		return err
+	}
+	if destBucket != bucket {
+		return fmt.Errorf("Can't move %v to another bucket", src)
+	}
+	return s3.MoveObject(bucket, srcKey, destKey)
+}
+
+// Discard deletes a file from S3 without touching the metadata
+func (dm *DataManager) Discard(path string) error {
+	bucket, key, err := dm.Buckets.Split(path)
+	if err != nil {
+		return err
 	}
+	return s3.DeleteObject(bucket, key)
 }
 
 func (dm *DataManager) Delete(path string) {
-	err := s3.DeleteObject(dm.bucket, path)
+	err := dm.Discard(path)
 	dm.mm.RemoveFromList(path)
 	if err != nil {
 		log.Error(err)
@@ -279,18 +493,19 @@ func (dm *DataManager) uploader() {
 		target := dm.partitioner.GetServer(u.path, u.block)
 		if target == dm.ServerAddr {
 			//log.Errorf("Inserting locally %v %v for %v", u.Path, u.block, target)
-			dm.CachePut(u.path, u.block, u.buf.Bytes())
+			dm.CachePutBuffer(u.path, u.block, u.buf)
+			u.buf.Release()
 			<-u.sem
 			continue
 		}
 
-		url := fmt.Sprintf("http://%s/put/%s?block=%d", target, u.path, u.block)
+		url := transport.URL("%s/put/%s?block=%d", target, u.path, u.block)
 
 		maxRetries := 3
 		numRetries := 0
 
 		for {
-			req, err := http.NewRequest("PUT", url, u.buf)
+			req, err := http.NewRequest("PUT", url, bytes.NewReader(u.buf.Bytes()))
 			if err == io.EOF {
 				break
 			}
@@ -304,8 +519,7 @@ func (dm *DataManager) uploader() {
 				log.Fatal(err)
 			}
 
-			client := &http.Client{}
-			res, err := client.Do(req)
+			res, err := transport.Do(req)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -313,7 +527,7 @@ func (dm *DataManager) uploader() {
 			res.Body.Close()
 			break
 		}
-		u.buf.Reset()
+		u.buf.Release()
 		<-u.sem
 	}
 }
@@ -0,0 +1,85 @@
+// Package discovery finds the nodes a FastFS node can join the cluster
+// through. Sources are resolved again periodically, so nodes started later,
+// e.g. by an autoscaling group, are found without restarting anyone.
+package discovery
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// Source returns the memberlist addresses, as address:port, of nodes that
+// may be in the cluster
+type Source interface {
+	Peers() ([]string, error)
+}
+
+// Static is a fixed list of peers
+type Static []string
+
+func (s Static) Peers() ([]string, error) {
+	return s, nil
+}
+
+// Sources returns the peers of every source. A source failing doesn't hide
+// the peers of the others.
+type Sources []Source
+
+func (s Sources) Peers() ([]string, error) {
+	seen := make(map[string]bool)
+	var peers []string
+	var lastErr error
+	for _, source := range s {
+		found, err := source.Peers()
+		if err != nil {
+			lastErr = err
+		}
+		for _, peer := range found {
+			if !seen[peer] {
+				seen[peer] = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+	if len(peers) > 0 {
+		return peers, nil
+	}
+	return nil, lastErr
+}
+
+// Watch resolves source every interval and calls found with the peers that
+// weren't in the previous resolution. Errors are logged. Returns once stop
+// is closed.
+func Watch(source Source, interval time.Duration, found func(peers []string), stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	known := make(map[string]bool)
+	for {
+		peers, err := source.Peers()
+		if err != nil {
+			log.Errorf("Discovering peers failed: %v", err)
+		} else {
+			current := make(map[string]bool)
+			var added []string
+			for _, peer := range peers {
+				current[peer] = true
+				if !known[peer] {
+					added = append(added, peer)
+				}
+			}
+			known = current
+			if len(added) > 0 {
+				sort.Strings(added)
+				found(added)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
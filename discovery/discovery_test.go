@@ -0,0 +1,195 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type failing struct{}
+
+func (failing) Peers() ([]string, error) {
+	return nil, errors.New("unreachable")
+}
+
+func TestStatic(t *testing.T) {
+	peers, err := Static{"10.0.0.1:8000", "10.0.0.2:8000"}.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(peers, []string{"10.0.0.1:8000", "10.0.0.2:8000"}) {
+		t.Errorf("Got %v", peers)
+	}
+}
+
+func TestSources(t *testing.T) {
+	testCases := []struct {
+		name    string
+		sources Sources
+		peers   []string
+		err     bool
+	}{
+		{"merged", Sources{Static{"a:1", "b:1"}, Static{"b:1", "c:1"}}, []string{"a:1", "b:1", "c:1"}, false},
+		{"one failing", Sources{failing{}, Static{"a:1"}}, []string{"a:1"}, false},
+		{"all failing", Sources{failing{}, failing{}}, nil, true},
+		{"empty", Sources{Static{}}, nil, false},
+	}
+
+	for _, tc := range testCases {
+		peers, err := tc.sources.Peers()
+		if (err != nil) != tc.err {
+			t.Errorf("%v: got error %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(peers, tc.peers) {
+			t.Errorf("%v: got %v, expected %v", tc.name, peers, tc.peers)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		name    string
+		content string
+		peers   []string
+		err     bool
+	}{
+		{"json", `["10.0.0.1:8000", "10.0.0.2:8000"]`, []string{"10.0.0.1:8000", "10.0.0.2:8000"}, false},
+		{"yaml", "- 10.0.0.1:8000\n- 10.0.0.2:8000\n", []string{"10.0.0.1:8000", "10.0.0.2:8000"}, false},
+		{"invalid", `{"peers": 1}`, nil, true},
+	}
+
+	for _, tc := range testCases {
+		path := filepath.Join(dir, tc.name)
+		err := ioutil.WriteFile(path, []byte(tc.content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers, err := NewFile(path).Peers()
+		if (err != nil) != tc.err {
+			t.Errorf("%v: got error %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(peers, tc.peers) {
+			t.Errorf("%v: got %v, expected %v", tc.name, peers, tc.peers)
+		}
+	}
+
+	_, err = NewFile(filepath.Join(dir, "missing")).Peers()
+	if err == nil {
+		t.Error("Reading a missing file should fail")
+	}
+}
+
+// serveDNS answers queries on a local UDP port from records, keyed by
+// question name and type. Other names are NXDOMAIN.
+func serveDNS(t *testing.T, records map[dnsmessage.Question][]dnsmessage.Resource) (*net.Resolver, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil || len(query.Questions) != 1 {
+				continue
+			}
+			question := query.Questions[0]
+			question.Class = dnsmessage.ClassINET
+
+			reply := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+				Questions: query.Questions,
+			}
+			answers, found := records[question]
+			if !found {
+				// The name may exist with other record types
+				for q := range records {
+					found = found || q.Name == question.Name
+				}
+			}
+			if !found {
+				reply.RCode = dnsmessage.RCodeNameError
+			}
+			reply.Answers = answers
+			packed, err := reply.Pack()
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+	return resolver, func() { conn.Close() }
+}
+
+func TestDNS(t *testing.T) {
+	srvName := dnsmessage.MustNewName("_fastfs._tcp.fastfs.test.")
+	hostName := dnsmessage.MustNewName("nodes.fastfs.test.")
+	header := func(name dnsmessage.Name, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: dnsmessage.ClassINET, TTL: 60}
+	}
+
+	resolver, stop := serveDNS(t, map[dnsmessage.Question][]dnsmessage.Resource{
+		{Name: srvName, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}: {
+			{Header: header(srvName, dnsmessage.TypeSRV), Body: &dnsmessage.SRVResource{
+				Target: dnsmessage.MustNewName("node1.fastfs.test."), Port: 8000}},
+			{Header: header(srvName, dnsmessage.TypeSRV), Body: &dnsmessage.SRVResource{
+				Target: dnsmessage.MustNewName("node2.fastfs.test."), Port: 8001}},
+		},
+		{Name: hostName, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}: {
+			{Header: header(hostName, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}},
+			{Header: header(hostName, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 2}}},
+		},
+	})
+	defer stop()
+
+	testCases := []struct {
+		name  string
+		peers []string
+		err   bool
+	}{
+		{"_fastfs._tcp.fastfs.test", []string{"node1.fastfs.test:8000", "node2.fastfs.test:8001"}, false},
+		{"nodes.fastfs.test:8000", []string{"10.0.0.1:8000", "10.0.0.2:8000"}, false},
+		{"_missing._tcp.fastfs.test", nil, true},
+		{"missing.fastfs.test:8000", nil, true},
+		{"nodes.fastfs.test", nil, true},
+	}
+
+	for _, tc := range testCases {
+		d := NewDNS(tc.name)
+		d.Resolver = resolver
+		peers, err := d.Peers()
+		if (err != nil) != tc.err {
+			t.Errorf("%v: got error %v", tc.name, err)
+		}
+		sort.Strings(peers)
+		if !reflect.DeepEqual(peers, tc.peers) {
+			t.Errorf("%v: got %v, expected %v", tc.name, peers, tc.peers)
+		}
+	}
+}
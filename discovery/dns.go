@@ -0,0 +1,67 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookupTimeout bounds every DNS query
+const lookupTimeout = 5 * time.Second
+
+// DNS finds peers in DNS. Names starting with an underscore, like
+// _fastfs._tcp.example.com, are SRV records giving both hosts and ports.
+// Other names are host:port, and every A or AAAA record of host is a peer
+// on port.
+type DNS struct {
+	Name string
+
+	// Resolver optionally specifies the resolver to use, e.g. one dialing a
+	// local DNS server. The default resolver is used if nil.
+	Resolver *net.Resolver
+}
+
+func NewDNS(name string) *DNS {
+	d := new(DNS)
+	d.Name = name
+	return d
+}
+
+func (d *DNS) Peers() ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	if strings.HasPrefix(d.Name, "_") {
+		_, records, err := resolver.LookupSRV(ctx, "", "", d.Name)
+		if err != nil {
+			return nil, err
+		}
+		var peers []string
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			peers = append(peers, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+		return peers, nil
+	}
+
+	host, port, err := net.SplitHostPort(d.Name)
+	if err != nil {
+		return nil, fmt.Errorf("DNS discovery needs an SRV name or host:port, not %q", d.Name)
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var peers []string
+	for _, addr := range addrs {
+		peers = append(peers, net.JoinHostPort(addr, port))
+	}
+	return peers, nil
+}
@@ -0,0 +1,35 @@
+package discovery
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+)
+
+// File reads peers from a JSON or YAML list of address:port, e.g. one kept
+// up to date by configuration management. It is read again on every
+// resolution, so edits are picked up without a restart.
+type File struct {
+	Path string
+}
+
+func NewFile(path string) *File {
+	f := new(File)
+	f.Path = path
+	return f
+}
+
+func (f *File) Peers() ([]string, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is YAML too
+	var peers []string
+	err = yaml.Unmarshal(data, &peers)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", f.Path, err)
+	}
+	return peers, nil
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/memberlist"
+	"github.com/rahulgovind/fastfs/common"
 	log "github.com/sirupsen/logrus"
+	"net"
+	"strconv"
 	"sync"
+	"time"
 )
 
 //import (
@@ -39,36 +44,161 @@ type FastFS struct {
 	servers     []string
 	Event       memberlist.EventDelegate
 	mlist       *memberlist.Memberlist
+	meta        []byte
+	broadcasts  *memberlist.TransmitLimitedQueue
+
+	// OnInvalidate optionally specifies a callback function to be executed
+	// when another node changed the metadata of a file.
+	OnInvalidate func(path string)
+}
+
+// Joins are retried after joinBackoff, doubling up to maxJoinBackoff
+const (
+	joinBackoff    = 500 * time.Millisecond
+	maxJoinBackoff = 10 * time.Second
+)
+
+// updateTimeout bounds waiting for other nodes to ack new node metadata
+const updateTimeout = 5 * time.Second
+
+// Messages gossiped between nodes start with their type
+const (
+	msgInvalidate byte = iota + 1
+)
+
+type broadcast []byte
+
+func (b broadcast) Invalidates(other memberlist.Broadcast) bool {
+	return false
+}
+
+func (b broadcast) Message() []byte {
+	return b
+}
+
+func (b broadcast) Finished() {}
+
+// EventDelegates forwards membership events to every delegate in order
+type EventDelegates []memberlist.EventDelegate
+
+func (ed EventDelegates) NotifyJoin(n *memberlist.Node) {
+	for _, d := range ed {
+		d.NotifyJoin(n)
+	}
 }
 
-func NewFastFS(addr string, port int, fsport int, primaryAddr string, events memberlist.EventDelegate) *FastFS {
+func (ed EventDelegates) NotifyLeave(n *memberlist.Node) {
+	for _, d := range ed {
+		d.NotifyLeave(n)
+	}
+}
+
+func (ed EventDelegates) NotifyUpdate(n *memberlist.Node) {
+	for _, d := range ed {
+		d.NotifyUpdate(n)
+	}
+}
+
+// NewFastFS starts gossiping on port, encrypted with secretKey if it isn't
+// nil. The node is on its own until Join is called.
+func NewFastFS(addr string, port int, fsport int, meta common.NodeMeta,
+	events memberlist.EventDelegate, secretKey []byte) *FastFS {
 	ffs := new(FastFS)
 
-	localAddr := fmt.Sprintf("%v:%v", addr, port)
+	var err error
+	ffs.meta, err = json.Marshal(meta)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	config := memberlist.DefaultLocalConfig()
 
 	config.BindPort = port
 	config.AdvertisePort = port
 	config.Name = fmt.Sprintf("%v:%v", addr, fsport)
+	config.SecretKey = secretKey
 	config.Events = ffs
+	config.Delegate = ffs
 	ffs.Event = events
 
 	ffs.mlistConfig = config
+	ffs.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes: func() int {
+			return ffs.mlist.NumMembers()
+		},
+		RetransmitMult: 3,
+	}
 
 	list, err := memberlist.Create(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if primaryAddr != localAddr {
-		list.Join([]string{primaryAddr})
-	}
 	ffs.mlist = list
-
 	return ffs
 }
 
+// Join joins the cluster through any of seeds, retrying with backoff until
+// timeout passes. Returns the number of seeds that were reached.
+func (ffs *FastFS) Join(seeds []string, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := joinBackoff
+	for {
+		n, err := ffs.mlist.Join(seeds)
+		if n > 0 {
+			if err != nil {
+				// Some seeds are down. Gossip finds the rest of the cluster.
+				log.Errorf("Joined through %d of %v: %v", n, seeds, err)
+			}
+			return n, nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return 0, err
+		}
+
+		log.Errorf("Unable to join any of %v. Retrying in %v: %v", seeds, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxJoinBackoff {
+			backoff = maxJoinBackoff
+		}
+	}
+}
+
+// Unknown returns the peers that are neither this node nor a member yet
+func (ffs *FastFS) Unknown(peers []string) []string {
+	members := make(map[string]bool)
+	for _, node := range ffs.mlist.Members() {
+		members[net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port)))] = true
+	}
+
+	var unknown []string
+	for _, peer := range peers {
+		if !members[peer] {
+			unknown = append(unknown, peer)
+		}
+	}
+	return unknown
+}
+
+// Coordinator returns the node that does cluster wide chores like
+// reconciling with S3. It is the member with the lowest name, so every node
+// agrees on it once membership settles and another takes over when it
+// leaves.
+func (ffs *FastFS) Coordinator() string {
+	coordinator := ""
+	for _, node := range ffs.mlist.Members() {
+		if coordinator == "" || node.Name < coordinator {
+			coordinator = node.Name
+		}
+	}
+	return coordinator
+}
+
+func (ffs *FastFS) IsCoordinator() bool {
+	return ffs.Coordinator() == ffs.mlistConfig.Name
+}
+
 func (ffs *FastFS) NotifyJoin(n *memberlist.Node) {
 	if ffs.Event != nil {
 		ffs.Event.NotifyJoin(n)
@@ -87,6 +217,63 @@ func (ffs *FastFS) NotifyUpdate(n *memberlist.Node) {
 	}
 }
 
+// NodeMeta advertises this node's common.NodeMeta to the cluster
+func (ffs *FastFS) NodeMeta(limit int) []byte {
+	ffs.mu.RLock()
+	defer ffs.mu.RUnlock()
+	if len(ffs.meta) > limit {
+		log.Fatalf("Node meta is %d bytes. Limit is %d", len(ffs.meta), limit)
+	}
+	return ffs.meta
+}
+
+// UpdateMeta advertises meta in place of what the node advertised so far.
+// Every node gets it through NotifyUpdate.
+func (ffs *FastFS) UpdateMeta(meta common.NodeMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	ffs.mu.Lock()
+	ffs.meta = data
+	ffs.mu.Unlock()
+	return ffs.mlist.UpdateNode(updateTimeout)
+}
+
+// BroadcastInvalidate tells the other nodes that the metadata of path
+// changed. Delivery is best effort.
+func (ffs *FastFS) BroadcastInvalidate(path string) {
+	msg := append([]byte{msgInvalidate}, path...)
+	ffs.broadcasts.QueueBroadcast(broadcast(msg))
+}
+
+func (ffs *FastFS) NotifyMsg(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+
+	switch msg[0] {
+	case msgInvalidate:
+		if ffs.OnInvalidate != nil {
+			ffs.OnInvalidate(string(msg[1:]))
+		}
+	default:
+		log.Errorf("Unknown message type %d", msg[0])
+	}
+}
+
+func (ffs *FastFS) GetBroadcasts(overhead, limit int) [][]byte {
+	return ffs.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+// The remaining memberlist.Delegate methods are unused
+
+func (ffs *FastFS) LocalState(join bool) []byte {
+	return nil
+}
+
+func (ffs *FastFS) MergeRemoteState(buf []byte, join bool) {}
+
 func (ffs *FastFS) GetServers() []string {
 	var res []string
 	for _, node := range ffs.mlist.Members() {
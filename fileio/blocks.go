@@ -3,16 +3,24 @@ package fileio
 import (
 	"errors"
 	"github.com/golang-collections/go-datastructures/queue"
+	"github.com/rahulgovind/fastfs/bufpool"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"sync"
 	"time"
 )
 
 type Block struct {
 	data     []byte
+	buf      *bufpool.Buffer
 	inMemory bool
 	mu       sync.RWMutex
 	idx      int64
+
+	// The slot of a freed block is only reused once every reference
+	// (pending disk write, open readers) has been released
+	refs  int
+	freed bool
 }
 
 // Safe for concurrent use
@@ -78,17 +86,38 @@ func (bm *BlockManager) writer() {
 		elapsed := time.Since(startTime)
 		log.Debugf("Copy to block %d complete. Took %v seconds", idx, elapsed)
 
-
 		block.mu.Lock()
+		buf := block.buf
 		block.data = nil
+		block.buf = nil
 		block.inMemory = false
 		block.mu.Unlock()
+
+		buf.Release()
+		bm.release(block)
+	}
+}
+
+// release drops a reference to block and returns its slot to the free list
+// if it was the last reference to a freed block
+func (bm *BlockManager) release(block *Block) {
+	block.mu.Lock()
+	block.refs -= 1
+	reusable := block.freed && block.refs == 0
+	block.mu.Unlock()
+
+	if reusable {
+		bm.freeList.Put(block.idx)
 	}
 }
 
 // CachePut byte array data. Truncated to blockSize
 func (bm *BlockManager) Put(b []byte) (blockId int64, err error) {
+	return bm.PutBuffer(bufpool.Wrap(b))
+}
 
+// PutBuffer is Put without copying. buf is retained until it is on disk.
+func (bm *BlockManager) PutBuffer(buf *bufpool.Buffer) (blockId int64, err error) {
 	bm.mu.Lock()
 	defer bm.mu.Unlock()
 
@@ -107,7 +136,10 @@ func (bm *BlockManager) Put(b []byte) (blockId int64, err error) {
 	block := new(Block)
 	block.idx = idx
 	block.inMemory = true
-	block.data = b
+	block.buf = buf.Retain()
+	block.data = buf.Bytes()
+	// Held by the writer until the block is on disk
+	block.refs = 1
 
 	bm.blockMap[idx] = block
 	// Transfer to queue instead
@@ -144,15 +176,82 @@ func (bm *BlockManager) Get(blockId int64, n int64) ([]byte, error) {
 	return nil, nil
 }
 
-// Free block blockId
+// BlockReader streams a block without copying it onto the heap. The
+// block's slot isn't reused until the reader is closed.
+type BlockReader struct {
+	bm    *BlockManager
+	block *Block
+	buf   *bufpool.Buffer
+	n     int64
+}
+
+// Open returns a reader for the first n bytes of block blockId or nil if
+// the block doesn't exist
+func (bm *BlockManager) Open(blockId int64, n int64) *BlockReader {
+	bm.mu.RLock()
+	block, ok := bm.blockMap[blockId]
+	bm.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	block.mu.Lock()
+	defer block.mu.Unlock()
+	if block.freed {
+		return nil
+	}
+	block.refs += 1
+
+	br := &BlockReader{bm: bm, block: block, n: n}
+	if block.inMemory {
+		br.buf = block.buf.Retain()
+	}
+	return br
+}
+
+func (br *BlockReader) Len() int64 {
+	return br.n
+}
+
+func (br *BlockReader) WriteTo(w io.Writer) (int64, error) {
+	if br.buf != nil {
+		n, err := w.Write(br.buf.Bytes()[:br.n])
+		return int64(n), err
+	}
+	return br.bm.io.WriteTo(br.block.idx*br.bm.blockSize, br.n, w)
+}
+
+func (br *BlockReader) Close() error {
+	if br.buf != nil {
+		br.buf.Release()
+		br.buf = nil
+	}
+	if br.block != nil {
+		br.bm.release(br.block)
+		br.block = nil
+	}
+	return nil
+}
+
+// Free block blockId. Doesn't wait for open readers of the block.
 func (bm *BlockManager) Free(blockId int64) {
 	bm.mu.Lock()
-	defer bm.mu.Unlock()
-
-	if block, ok := bm.blockMap[blockId]; ok {
-		block.mu.Lock()
-		defer block.mu.Unlock()
+	block, ok := bm.blockMap[blockId]
+	if ok {
 		delete(bm.blockMap, blockId)
+	}
+	bm.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	block.mu.Lock()
+	block.freed = true
+	reusable := block.refs == 0
+	block.mu.Unlock()
+
+	if reusable {
 		bm.freeList.Put(blockId)
 	}
 }
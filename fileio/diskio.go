@@ -1,6 +1,10 @@
 package fileio
 
+import "io"
+
 type FileIO interface {
 	ReadAt(offset int64, size int64) []byte
 	WriteAt(offset int64, b []byte)
+	// WriteTo writes size bytes starting at offset to w
+	WriteTo(offset int64, size int64, w io.Writer) (int64, error)
 }
@@ -7,11 +7,13 @@ import (
 )
 
 type DirectFileIO struct {
-	file *os.File
+	file     *os.File
+	filename string
 }
 
 func NewDirectFileIO(filename string, size int64) *DirectFileIO {
 	dfio := new(DirectFileIO)
+	dfio.filename = filename
 
 	file, err := os.Create(filename)
 	if err != nil {
@@ -46,3 +48,20 @@ func (dfio *DirectFileIO) ReadAt(offset int64, size int64) []byte {
 func (dfio *DirectFileIO) WriteAt(offset int64, b []byte) {
 	dfio.file.WriteAt(b, int64(offset))
 }
+
+// WriteTo streams the range through its own file handle so concurrent
+// readers don't share a file offset. Handing w an *os.File wrapped in an
+// io.LimitedReader lets sockets use sendfile.
+func (dfio *DirectFileIO) WriteTo(offset int64, size int64, w io.Writer) (int64, error) {
+	file, err := os.Open(dfio.filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, io.LimitReader(file, size))
+}
@@ -3,6 +3,7 @@ package fileio
 import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"os"
 	"syscall"
 )
@@ -80,3 +81,8 @@ func (mmio *MMapIO) ReadAt(offset int64, size int64) []byte {
 func (mmio *MMapIO) WriteAt(offset int64, b []byte) {
 	copy(mmio.data[offset:int(offset)+len(b)], b)
 }
+
+func (mmio *MMapIO) WriteTo(offset int64, size int64, w io.Writer) (int64, error) {
+	n, err := w.Write(mmio.data[offset : offset+size])
+	return int64(n), err
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"github.com/rahulgovind/fastfs/transport"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"math/rand"
@@ -15,9 +16,9 @@ import (
 // Block Upload code
 func (c *Client) putBlock(filepath string, block int64, data []byte) error {
 	for {
-		target := c.cmap.Get(fmt.Sprintf("%s:%d", filepath, block))
+		target := c.locate(fmt.Sprintf("%s:%d", filepath, block))
 
-		url := fmt.Sprintf("http://%s/put/%s?block=%d", target, filepath, block)
+		url := transport.URL("%s/put/%s?block=%d", target, filepath, block)
 
 		maxRetries := 3
 		numRetries := 0
@@ -42,8 +43,7 @@ func (c *Client) putBlock(filepath string, block int64, data []byte) error {
 			return err
 		}
 
-		client := &http.Client{}
-		res, err := client.Do(req)
+		res, err := transport.Do(req)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -60,9 +60,9 @@ func (c *Client) finalizeBlocks(filepath string, numBlocks int64, numWritten int
 	}
 
 	for {
-		target := c.cmap.Get(fmt.Sprintf("%d", rand.Intn(1024*1024)))
+		target := c.locate(fmt.Sprintf("%d", rand.Intn(1024*1024)))
 
-		url := fmt.Sprintf("http://%s/confirm/%s?numblocks=%d&numwritten=%d", target, filepath, numBlocks, numWritten)
+		url := transport.URL("%s/confirm/%s?numblocks=%d&numwritten=%d", target, filepath, numBlocks, numWritten)
 
 		maxRetries := 3
 		numRetries := 0
@@ -80,8 +80,7 @@ func (c *Client) finalizeBlocks(filepath string, numBlocks int64, numWritten int
 			return err
 		}
 
-		client := &http.Client{}
-		res, err := client.Do(req)
+		res, err := transport.Do(req)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -145,6 +144,7 @@ func (u *BlockUploadWriter) Close() (err error) {
 	// Must wait for all uploads to finish and confirmation to be sent over :)
 	log.Info("Done?")
 	<-u.done
+	u.client.objectCache.Remove(u.filePath)
 	return nil
 }
 
@@ -9,29 +9,63 @@ import (
 	"github.com/hashicorp/golang-lru"
 	"github.com/rahulgovind/fastfs/common"
 	"github.com/rahulgovind/fastfs/consistenthash"
+	"github.com/rahulgovind/fastfs/partitioner"
 	"github.com/rahulgovind/fastfs/s3"
+	"github.com/rahulgovind/fastfs/transport"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"strconv"
 	"sync"
 	"time"
 )
 
+// ringRefreshInterval is how often clients fetch the servers and their
+// weights again, so nodes that joined or changed capacity are used
+const ringRefreshInterval = 30 * time.Second
+
 type Client struct {
 	primaryAddr  string
-	servers      []string
 	BlockSize    int64
 	LookAhead    int
 	Queue        chan *InputData
-	cmap         *consistenthash.Map
 	objectCache  *lru.Cache
 	S3UploadChan chan *BlockUploadInput
+
+	// servers and ring are replaced when the ring is refreshed
+	mu      sync.RWMutex
+	servers []string
+	ring    placement
+	stale   chan bool
+
+	// LeaseTTL is how long Stat results are cached. Files written or
+	// deleted through this client are dropped from the cache right away.
+	LeaseTTL time.Duration
 }
 
+// objectLease is a cached Stat result
+type objectLease struct {
+	fi     common.FileInfo
+	expiry time.Time
+}
+
+// generationHeader carries the generation of a file in HEAD responses
+const generationHeader = "X-Fastfs-Generation"
+
+// ErrLocked is returned when a lock is held by someone else or was lost
+var ErrLocked = errors.New("lock is held by someone else")
+
+// fencingTokenHeader carries the lock token of writes made under a lock
+const fencingTokenHeader = "X-Fastfs-Fencing-Token"
+
+// ErrPreconditionFailed is returned by conditional writes when the file
+// didn't match
+var ErrPreconditionFailed = errors.New("precondition failed")
+
 type InputData struct {
 	path  string
 	block int64
@@ -83,11 +117,13 @@ type UploadWriteCloser struct {
 	reader         io.ReadCloser
 	wg             sync.WaitGroup
 	c              *Client
+	path           string
 }
 
 func NewUploadWriteCloser(c *Client, path string) *UploadWriteCloser {
 	u := new(UploadWriteCloser)
 	u.c = c
+	u.path = path
 
 	u.reader, u.writer = io.Pipe()
 	u.bufferedWriter = bufio.NewWriterSize(u.writer, 1024*1024)
@@ -109,17 +145,17 @@ func (u *UploadWriteCloser) Close() error {
 	u.bufferedWriter.Flush()
 	u.writer.Close()
 	u.wg.Wait()
+	u.c.objectCache.Remove(u.path)
 	return nil
 }
 
 func makeRequest(url string, method string) (*http.Response, error) {
-	var client http.Client
 	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := transport.Do(req)
 	if err != nil {
 		return nil, err
 		log.Fatal(err)
@@ -129,14 +165,13 @@ func makeRequest(url string, method string) (*http.Response, error) {
 }
 
 func makeRangeRequest(url string, method string, start int64, end int64) (*http.Response, error) {
-	var client http.Client
 	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 	req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", start, end))
 
-	resp, err := client.Do(req)
+	resp, err := transport.Do(req)
 	if err != nil {
 		return nil, err
 		log.Fatal(err)
@@ -151,11 +186,17 @@ func New(addr string, numDownloaders int, lookAhead int) *Client {
 	c.LookAhead = lookAhead
 	c.Queue = make(chan *InputData, 10000)
 
-	c.cmap = consistenthash.New(7, nil)
 	c.objectCache, _ = lru.New(10240)
+	c.LeaseTTL = 5 * time.Second
 	c.S3UploadChan = make(chan *BlockUploadInput, 32)
+	c.stale = make(chan bool, 1)
 
-	c.getServers()
+	setup, err := c.getServers()
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.BlockSize = setup.BlockSize
+	go c.refresher()
 
 	for i := 0; i < lookAhead; i += 1 {
 		go c.downloader()
@@ -167,9 +208,17 @@ func New(addr string, numDownloaders int, lookAhead int) *Client {
 	return c
 }
 
+// placement is a consistenthash.Map or consistenthash.Rendezvous
+type placement interface {
+	Get(key string) string
+}
+
 type ServerResponse struct {
-	Servers   []string
-	BlockSize int64
+	Servers     []string
+	BlockSize   int64
+	Partitioner string
+	Replicas    int
+	Weights     map[string]float64
 }
 
 func (c *Client) downloader() {
@@ -182,47 +231,126 @@ func (c *Client) downloader() {
 	}
 }
 
-func (c *Client) getServers() {
-	var client http.Client
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/setup", c.primaryAddr), nil)
+// getServers fetches the servers and rebuilds the ring from them
+func (c *Client) getServers() (ServerResponse, error) {
+	req, err := http.NewRequest("GET", transport.URL("%s/setup", c.primaryAddr), nil)
 	if err != nil {
-		log.Fatal(err)
+		return ServerResponse{}, err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := transport.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return ServerResponse{}, err
 	}
 	defer resp.Body.Close()
-
-	buf := bytes.NewBuffer(nil)
-	io.Copy(buf, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return ServerResponse{}, fmt.Errorf("Getting servers from %v failed: %v", c.primaryAddr, resp.Status)
+	}
 
 	var result ServerResponse
-	err = json.Unmarshal(buf.Bytes(), &result)
+	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
-		log.Fatal(err)
+		return ServerResponse{}, err
 	}
+	if len(result.Servers) == 0 {
+		return ServerResponse{}, fmt.Errorf("%v knows no servers", c.primaryAddr)
+	}
+
+	c.mu.Lock()
 	c.servers = result.Servers
-	c.BlockSize = result.BlockSize
-	c.cmap.Add(c.servers...)
+	c.ring = newPlacement(result)
+	c.mu.Unlock()
+	return result, nil
+}
+
+// newPlacement places blocks like the servers of setup. Bounded loads
+// aren't known to clients, so they use the plain ring and follow the
+// redirects of busy servers.
+func newPlacement(setup ServerResponse) placement {
+	weight := func(server string) float64 {
+		if weight, ok := setup.Weights[server]; ok {
+			return weight
+		}
+		return 1
+	}
+
+	if setup.Partitioner == partitioner.Rendezvous {
+		r := consistenthash.NewRendezvous()
+		for _, server := range setup.Servers {
+			r.Add(server, weight(server))
+		}
+		return r
+	}
+
+	replicas := setup.Replicas
+	if replicas <= 0 {
+		replicas = 7
+	}
+	cmap := consistenthash.New(replicas, nil)
+	for _, server := range setup.Servers {
+		cmap.AddWeighted(server, weight(server))
+	}
+	return cmap
+}
+
+// refresher fetches the ring every ringRefreshInterval, or sooner once a
+// server redirected a request the ring sent to it
+func (c *Client) refresher() {
+	ticker := time.NewTicker(ringRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stale:
+		}
+		_, err := c.getServers()
+		if err != nil {
+			log.Errorf("Refreshing servers failed: %v", err)
+		}
+	}
+}
+
+// checkTarget refreshes the ring if resp didn't come from target, which
+// means the servers place blocks differently
+func (c *Client) checkTarget(resp *http.Response, target string) {
+	if resp.Request.URL.Host == target {
+		return
+	}
+	select {
+	case c.stale <- true:
+	default:
+	}
+}
+
+// locate returns the server key is placed on
+func (c *Client) locate(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.Get(key)
+}
+
+// pickServer returns a random server
+func (c *Client) pickServer() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.servers[rand.Intn(len(c.servers))]
 }
 
 func (c *Client) getBlock(path string, block int64, w io.Writer) error {
-	target := c.cmap.Get(fmt.Sprintf("%s:%d", path, block))
+	target := c.locate(fmt.Sprintf("%s:%d", path, block))
 
-	var client http.Client
 	req, err := http.NewRequest("GET",
-		fmt.Sprintf("http://%s/data/%s?block=%d", target, path, block), nil)
+		transport.URL("%s/data/%s?block=%d", target, path, block), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := transport.Do(req)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer resp.Body.Close()
+	c.checkTarget(resp, target)
 
 	io.Copy(w, resp.Body)
 
@@ -233,20 +361,14 @@ func (c *Client) getBlock(path string, block int64, w io.Writer) error {
 }
 
 func (c *Client) ReadFrom(r io.ReadCloser, path string) {
-	var client = &http.Client{
-		//CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		//	return http.ErrUseLastResponse
-		//},
-	}
-
-	url := fmt.Sprintf("http://%s/put/%s", c.servers[rand.Intn(len(c.servers))], path)
+	url := transport.URL("%s/put/%s", c.pickServer(), path)
 	req, err := http.NewRequest("PUT", url, r)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := transport.Do(req)
 
 	if err != nil {
 		log.Fatal(err)
@@ -523,7 +645,7 @@ func (c *Client) ListFiles(dir string) (common.FileList, error) {
 	//	dir = dir + "/"
 	//}
 
-	resp, err := makeRequest(fmt.Sprintf("http://%s/ls/%s", c.primaryAddr, dir), "GET")
+	resp, err := makeRequest(transport.URL("%s/ls/%s", c.primaryAddr, dir), "GET")
 	if err != nil {
 		return common.FileList{}, err
 	}
@@ -542,12 +664,15 @@ func (c *Client) ListFiles(dir string) (common.FileList, error) {
 }
 
 func (c *Client) Stat(filePath string) (common.FileInfo, error) {
-	fi, ok := c.objectCache.Get(filePath)
+	value, ok := c.objectCache.Get(filePath)
 	if ok {
-		return fi.(common.FileInfo), nil
+		l := value.(*objectLease)
+		if time.Now().Before(l.expiry) {
+			return l.fi, nil
+		}
 	}
 
-	resp, err := makeRequest(fmt.Sprintf("http://%s/data/%s", c.primaryAddr, filePath), "HEAD")
+	resp, err := makeRequest(transport.URL("%s/data/%s", c.primaryAddr, filePath), "HEAD")
 	if err != nil {
 		return common.FileInfo{}, err
 	}
@@ -555,20 +680,226 @@ func (c *Client) Stat(filePath string) (common.FileInfo, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 404 {
+		c.objectCache.Remove(filePath)
 		return common.FileInfo{}, errors.New("no file with given filename")
 	}
 
 	contentLength := resp.Header.Get("Content-Length")
 	length, _ := strconv.ParseInt(contentLength, 10, 64)
+	generation, _ := strconv.ParseInt(resp.Header.Get(generationHeader), 10, 64)
+
+	fi := common.FileInfo{Path: filePath, Size: length, Generation: generation}
+	c.objectCache.Add(filePath, &objectLease{fi, time.Now().Add(c.LeaseTTL)})
+
+	return fi, nil
+}
+
+// Warm loads every file under prefix into the cluster cache. If pin is set
+// the blocks are exempt from eviction until Unpin is called or ttl expires
+// (a zero ttl pins indefinitely). Intermediate progress is sent on progress
+// if it is non-nil.
+func (c *Client) Warm(prefix string, pin bool, ttl time.Duration,
+	progress chan<- common.WarmProgress) (common.WarmProgress, error) {
+	resp, err := makeRequest(transport.URL("%s/admin/warm?prefix=%s&pin=%v&ttl=%d",
+		c.primaryAddr, url.QueryEscape(prefix), pin, int64(ttl/time.Second)), "GET")
+	if err != nil {
+		return common.WarmProgress{}, err
+	}
+	defer resp.Body.Close()
+
+	var result common.WarmProgress
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var p common.WarmProgress
+		err = decoder.Decode(&p)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+
+		result = p
+		if progress != nil {
+			progress <- p
+		}
+	}
 
-	c.objectCache.Add(filePath, common.FileInfo{filePath, length})
+	if !result.Complete {
+		return result, errors.New("warm-up ended before completion")
+	}
+	return result, nil
+}
+
+// Unpin releases cluster-wide pins on all blocks of files under prefix
+func (c *Client) Unpin(prefix string) (int, error) {
+	resp, err := makeRequest(transport.URL("%s/admin/unpin?prefix=%s", c.primaryAddr, url.QueryEscape(prefix)), "GET")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
 
-	return common.FileInfo{filePath, length}, nil
+	var result common.UnpinResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return 0, err
+	}
+	return result.Unpinned, nil
 }
 
 func (c *Client) Delete(filename string) {
-	resp, _ := makeRequest(fmt.Sprintf("http://%s/data/%s", c.primaryAddr, filename), "DELETE")
+	resp, _ := makeRequest(transport.URL("%s/data/%s", c.primaryAddr, filename), "DELETE")
 	resp.Body.Close()
+	c.objectCache.Remove(filename)
+}
+
+// PutIf writes r to path if the file matches the given If-Match and
+// If-None-Match values, which are ETags (or generations) or "*". Empty
+// values are ignored, so PutIf(path, r, "", "*") only creates path if it
+// doesn't exist. Returns the new generation.
+func (c *Client) PutIf(path string, r io.Reader, ifMatch string, ifNoneMatch string) (int64, error) {
+	req, err := http.NewRequest("PUT", transport.URL("%s/put/%s", c.pickServer(), path), r)
+	if err != nil {
+		return 0, err
+	}
+	setPrecondition(req, ifMatch, ifNoneMatch)
+
+	resp, err := transport.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	c.objectCache.Remove(path)
+
+	err = preconditionError(resp)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(resp.Header.Get(generationHeader), 10, 64)
+}
+
+// DeleteIf deletes path if it matches ifMatch
+func (c *Client) DeleteIf(path string, ifMatch string) error {
+	req, err := http.NewRequest("DELETE", transport.URL("%s/data/%s", c.primaryAddr, path), nil)
+	if err != nil {
+		return err
+	}
+	setPrecondition(req, ifMatch, "")
+
+	resp, err := transport.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	c.objectCache.Remove(path)
+	return preconditionError(resp)
+}
+
+// AcquireLock locks path for holder for ttl. If someone else holds the
+// lock ErrLocked is returned along with their lock.
+func (c *Client) AcquireLock(path string, holder string, ttl time.Duration) (common.Lock, error) {
+	return c.lockRequest("POST", transport.URL("%s/lock/%s?holder=%s&ttl=%d",
+		c.primaryAddr, path, url.QueryEscape(holder), int64(ttl/time.Second)))
+}
+
+// RenewLock extends lock by ttl. ErrLocked means the lock expired and was
+// acquired by someone else.
+func (c *Client) RenewLock(lock common.Lock, ttl time.Duration) (common.Lock, error) {
+	return c.lockRequest("POST", transport.URL("%s/lock/%s?holder=%s&token=%d&ttl=%d",
+		c.primaryAddr, lock.Path, url.QueryEscape(lock.Holder), lock.Token, int64(ttl/time.Second)))
+}
+
+// ReleaseLock releases lock
+func (c *Client) ReleaseLock(lock common.Lock) error {
+	_, err := c.lockRequest("DELETE", transport.URL("%s/lock/%s?holder=%s&token=%d",
+		c.primaryAddr, lock.Path, url.QueryEscape(lock.Holder), lock.Token))
+	return err
+}
+
+// Locks returns the locks currently held on paths under prefix
+func (c *Client) Locks(prefix string) ([]common.Lock, error) {
+	resp, err := makeRequest(transport.URL("%s/lock/%s", c.primaryAddr, prefix), "GET")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing locks failed: %v", resp.Status)
+	}
+
+	var locks []common.Lock
+	err = json.NewDecoder(resp.Body).Decode(&locks)
+	return locks, err
+}
+
+func (c *Client) lockRequest(method string, lockURL string) (common.Lock, error) {
+	resp, err := makeRequest(lockURL, method)
+	if err != nil {
+		return common.Lock{}, err
+	}
+	defer resp.Body.Close()
+
+	var lock common.Lock
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&lock)
+		return lock, err
+	case http.StatusNoContent:
+		return lock, nil
+	case http.StatusConflict:
+		json.NewDecoder(resp.Body).Decode(&lock)
+		return lock, ErrLocked
+	}
+	return lock, fmt.Errorf("lock request failed: %v", resp.Status)
+}
+
+// PutLocked writes r to path under lock. The write is refused with
+// ErrLocked if the lock was lost in the meantime.
+func (c *Client) PutLocked(path string, r io.Reader, lock common.Lock) error {
+	req, err := http.NewRequest("PUT", transport.URL("%s/put/%s", c.pickServer(), path), r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(fencingTokenHeader, strconv.FormatInt(lock.Token, 10))
+
+	resp, err := transport.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	c.objectCache.Remove(path)
+
+	if resp.StatusCode == http.StatusConflict {
+		return ErrLocked
+	}
+	return preconditionError(resp)
+}
+
+// setPrecondition sets the conditional headers. Bare generations are sent
+// as ETags.
+func setPrecondition(req *http.Request, ifMatch string, ifNoneMatch string) {
+	quote := func(tag string) string {
+		if _, err := strconv.ParseInt(tag, 10, 64); err == nil {
+			return strconv.Quote(tag)
+		}
+		return tag
+	}
+	if ifMatch != "" {
+		req.Header.Set("If-Match", quote(ifMatch))
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", quote(ifNoneMatch))
+	}
+}
+
+func preconditionError(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("request failed: %v", resp.Status)
+	}
+	return nil
 }
 
 // Split query sends `numSplits` chunks to make queries on them
@@ -587,7 +918,7 @@ func (c *Client) Query(path string, numSplits int64, condition string, col int,
 	}
 
 	for offset := int64(0); offset < fi.Size; offset += chunkSize {
-		resp, err := makeRangeRequest(fmt.Sprintf("http://%s/query/%s?col=%d&condition=%s", c.primaryAddr, path, col, condition),
+		resp, err := makeRangeRequest(transport.URL("%s/query/%s?col=%d&condition=%s", c.primaryAddr, path, col, condition),
 			"GET", offset, min(offset + chunkSize - 1, fi.Size - 1))
 
 		if err != nil {
@@ -598,4 +929,110 @@ func (c *Client) Query(path string, numSplits int64, condition string, col int,
 		resp.Body.Close()
 	}
 	return nil
-}
\ No newline at end of file
+}
+// Watch sends create, overwrite and delete events of files under prefix
+// on the returned channel until stop is closed. Watching starts after token,
+// or from now on if it is empty. Every event carries the token to resume
+// from after it.
+func (c *Client) Watch(prefix string, token string, stop <-chan bool) <-chan common.WatchEvent {
+	events := make(chan common.WatchEvent, 64)
+
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			resp, err := makeRequest(transport.URL("%s/watch/%s?token=%s&timeout=30",
+				c.primaryAddr, prefix, url.QueryEscape(token)), "GET")
+			if err != nil {
+				log.Error(err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			var result common.WatchResponse
+			if resp.StatusCode == http.StatusOK {
+				err = json.NewDecoder(resp.Body).Decode(&result)
+			} else {
+				err = fmt.Errorf("watching %v failed: %v", prefix, resp.Status)
+			}
+			resp.Body.Close()
+			if err != nil {
+				log.Error(err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			for _, event := range result.Events {
+				select {
+				case events <- event:
+				case <-stop:
+					return
+				}
+			}
+			token = result.Token
+		}
+	}()
+	return events
+}
+
+// Presign returns a URL for method, GET or PUT, on path that anyone can use
+// until ttl passes, with the permissions of this client. GET URLs can be
+// limited to bytes start to end. An end of -1 means the whole file.
+func (c *Client) Presign(path string, method string, ttl time.Duration, start int64, end int64) (common.PresignedURL, error) {
+	var result common.PresignedURL
+	u := transport.URL("%s/presign/%s?method=%s&ttl=%d", c.primaryAddr, path, method, int64(ttl/time.Second))
+	if end != -1 {
+		u += fmt.Sprintf("&range=%d-%d", start, end)
+	}
+
+	resp, err := makeRequest(u, "GET")
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return result, fmt.Errorf("presigning %v failed: %v %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
+
+// GetPresigned reads the file of a presigned GET URL. It needs no
+// credentials or Client. The caller must close the reader.
+func GetPresigned(presigned string) (io.ReadCloser, error) {
+	resp, err := transport.NewClient(0).Get(presigned)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("presigned GET failed: %v", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// PutPresigned writes r to the file of a presigned PUT URL. It needs no
+// credentials or Client.
+func PutPresigned(presigned string, r io.Reader) error {
+	req, err := http.NewRequest("PUT", presigned, r)
+	if err != nil {
+		return err
+	}
+	resp, err := transport.NewClient(0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("presigned PUT failed: %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/rahulgovind/fastfs/common"
+	"github.com/rahulgovind/fastfs/metadatamanager"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// FencingTokenHeader carries the lock token of writers holding a lock on
+// the file they write. Writes are refused once the lock is lost.
+const FencingTokenHeader = "X-Fastfs-Fencing-Token"
+
+// DefaultLockTTL is used when a lock request has no ttl
+const DefaultLockTTL = 30 * time.Second
+
+// handleLock serves /lock/<path>. POST acquires the lock for holder or,
+// given a token, renews it. DELETE releases it and GET lists the locks held
+// under path.
+func (s *Server) handleLock(w http.ResponseWriter, req *http.Request, path string) {
+	if req.Method == "GET" {
+		locks, err := s.mm.Locks(path)
+		if err != nil {
+			writeMetadataError(w, err)
+			return
+		}
+		writeJSON(w, locks)
+		return
+	}
+
+	holder := req.URL.Query().Get("holder")
+	if holder == "" || path == "" {
+		w.WriteHeader(400)
+		return
+	}
+
+	var token int64
+	if t := req.URL.Query().Get("token"); t != "" {
+		var err error
+		token, err = strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	ttl := DefaultLockTTL
+	if t := req.URL.Query().Get("ttl"); t != "" {
+		seconds, err := strconv.ParseInt(t, 10, 64)
+		if err != nil || seconds <= 0 {
+			w.WriteHeader(400)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	switch req.Method {
+	case "POST", "PUT":
+		var lock common.Lock
+		var err error
+		if token != 0 {
+			lock, err = s.mm.RenewLock(path, holder, token, ttl)
+		} else {
+			lock, err = s.mm.AcquireLock(path, holder, ttl)
+		}
+		if err == metadatamanager.ErrLocked || err == metadatamanager.ErrNotLockHolder {
+			// The current lock tells the caller who holds it and until when
+			writeJSONStatus(w, http.StatusConflict, lock)
+			return
+		}
+		if err != nil {
+			writeMetadataError(w, err)
+			return
+		}
+		writeJSON(w, lock)
+	case "DELETE":
+		err := s.mm.ReleaseLock(path, holder, token)
+		if err == metadatamanager.ErrNotLockHolder {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if err != nil {
+			writeMetadataError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// fencingToken returns the lock token a write carries, 0 if it has none.
+// The token is checked when the write is committed so a writer whose lock
+// was lost in the meantime is refused. Returns false if the request was
+// answered.
+func fencingToken(w http.ResponseWriter, req *http.Request) (int64, bool) {
+	t := req.Header.Get(FencingTokenHeader)
+	if t == "" {
+		return 0, true
+	}
+	token, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || token <= 0 {
+		w.WriteHeader(400)
+		return 0, false
+	}
+	return token, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	res, _ := json.Marshal(v)
+	_, err := w.Write(res)
+	if err != nil {
+		log.Error(err)
+	}
+}
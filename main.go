@@ -3,162 +3,304 @@ package main
 import (
 	"fmt"
 	"github.com/pkg/profile"
+	"github.com/rahulgovind/fastfs/acl"
+	"github.com/rahulgovind/fastfs/bufpool"
+	"github.com/rahulgovind/fastfs/cache/codec"
 	"github.com/rahulgovind/fastfs/cache/hybridcache"
+	"github.com/rahulgovind/fastfs/common"
+	"github.com/rahulgovind/fastfs/config"
 	"github.com/rahulgovind/fastfs/datamanager"
-	"github.com/rahulgovind/fastfs/fileio"
+	"github.com/rahulgovind/fastfs/discovery"
 	"github.com/rahulgovind/fastfs/metadatamanager"
+	"github.com/rahulgovind/fastfs/metadatamanager/raftstore"
 	"github.com/rahulgovind/fastfs/partitioner"
+	"github.com/rahulgovind/fastfs/s3"
+	"github.com/rahulgovind/fastfs/transport"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"math"
 	"os"
 	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 func main() {
 	log.SetReportCaller(true)
 
 	//defer profile.Start(profile.MemProfile).Stop()
-	var bucket string
-	var port int
-	fsPort := -1
-	addr := "localhost"
-	var primaryAddr string
-	var primaryPort int
-	var redisAddr string
-	var numDownloaders int
-	var verbose bool
-	var blockSizeKB int
-	var maxMem int
-	var maxDisk int
-	var cpuProfile bool
-	var diskCache string
+	var cfg *config.Config
+	var ctx *cli.Context
 
 	app := cli.NewApp()
 	app.Name = "FastFS Node"
 	app.Usage = "Create FastFS Nodepoint"
-	app.Flags = []cli.Flag{
-		&cli.StringFlag{
-			Name:        "bucket",
-			Usage:       "S3 Bucket to use as backing store",
-			Destination: &bucket,
-		},
-		&cli.StringFlag{
-			Name:        "address",
-			Usage:       "System Address",
-			Destination: &addr,
-			Value:       "localhost",
-		},
-		&cli.IntFlag{
-			Name:        "port",
-			Usage:       "Port to use for membership service",
-			Destination: &port,
-			Value:       8000,
-		},
-		&cli.IntFlag{
-			Name:        "fsport",
-			Usage:       "Port to use for filesystem service",
-			Destination: &fsPort,
-			Value:       -1,
-		},
-		&cli.StringFlag{
-			Name:        "primary-addr",
-			Usage:       "Address of primary node",
-			Destination: &primaryAddr,
-			Value:       "localhost",
-		},
-		&cli.IntFlag{
-			Name:        "primary-port",
-			Usage:       "Port of primary node",
-			Destination: &primaryPort,
-			Value:       8000,
-		},
-		&cli.StringFlag{
-			Name:        "redis-addr",
-			Usage:       "Address of redis server",
-			Destination: &redisAddr,
-			Value:       "localhost:6379",
-		},
-		&cli.IntFlag{
-			Name:        "num-downloaders",
-			Usage:       "Number of downloaders",
-			Destination: &numDownloaders,
-			Value:       16,
-		},
-		&cli.BoolFlag{
-			Name:        "verbose",
-			Usage:       "Verbose logging",
-			Destination: &verbose,
-		},
-		&cli.IntFlag{
-			Name:        "block-size",
-			Usage:       "Block size for storage and tramission",
-			Destination: &blockSizeKB,
-			Value:       1024,
-		},
-		&cli.IntFlag{
-			Name:        "mem-max",
-			Usage:       "Maximum memory to use in MB. Cache entries = Max memory / num entries",
-			Destination: &maxMem,
-			Value:       512,
-		},
-		&cli.IntFlag{
-			Name:        "disk-max",
-			Usage:       "Maximum disk space to use in MB. Cache entries = Max disk space / num entries",
-			Destination: &maxDisk,
-			Value:       1024,
-		},
-		&cli.BoolFlag{
-			Name:        "cpu-profile",
-			Usage:       "Profile CPU",
-			Destination: &cpuProfile,
-		},
-		&cli.StringFlag{
-			Name:        "disk-location",
-			Usage:       "Location to store disk cache",
-			Destination: &diskCache,
-			Value:       "/tmp/testdata",
-		},
-	}
-
-	if !verbose {
-		log.SetLevel(log.ErrorLevel)
+	app.Flags = config.Flags()
+	app.Action = func(c *cli.Context) error {
+		var err error
+		cfg, err = config.FromContext(c)
+		ctx = c
+		return err
 	}
 
-	if cpuProfile {
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg == nil {
+		// Only help was shown
+		return
+	}
+	if ctx.Bool("print-config") {
+		fmt.Print(cfg)
+		return
+	}
+
+	setVerbose(cfg.Verbose)
+	log.Infof("Configuration:\n%v", cfg)
+
+	if cfg.CPUProfile {
 		defer profile.Start().Stop()
 	}
 
-	err := app.Run(os.Args)
+	tokens, err := cfg.TokenIdentities()
+	if err != nil {
+		log.Fatal(err)
+	}
+	hmacKeys, err := cfg.HMACKeyIdentities()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = transport.Configure(transport.Options{
+		CertFile:   cfg.TLSCert,
+		KeyFile:    cfg.TLSKey,
+		CAFile:     cfg.TLSCA,
+		MutualTLS:  cfg.MutualTLS,
+		Token:      cfg.AuthToken,
+		HMACKey:    cfg.AuthHMACKey,
+		Tokens:     tokens,
+		HMACKeys:   hmacKeys,
+		PresignKey: cfg.PresignKey,
+		NodeNames:  cfg.NodeCertNames(),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	gossipKey, err := cfg.GossipSecret()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if fsPort == -1 {
-		fsPort = port + 100
+	err = s3.Configure(s3.Options{
+		Region:       cfg.Region,
+		Endpoint:     cfg.S3Endpoint,
+		Profile:      cfg.S3Profile,
+		PathStyle:    cfg.S3PathStyle,
+		ACL:          cfg.S3ACL,
+		StorageClass: cfg.S3StorageClass,
+		SSE:          cfg.S3SSE,
+		SSEKMSKeyID:  cfg.S3SSEKMSKeyID,
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	blockSize := int64(1024 * blockSizeKB)
-	maxMemEntries := int64(1024*1024*maxMem) / blockSize
-	maxDiskEntries := int64(1024*1024*maxDisk) / blockSize
+	blockSize := int64(1024 * cfg.BlockSizeKB)
+	maxMemEntries := int64(1024*1024*cfg.MemMaxMB) / blockSize
 	//log.SetLevel(log.ErrorLevel)
-	hc := hybridcache.NewMemDiskHybridCache(maxMemEntries, maxDiskEntries, blockSize,
-		diskCache, fileio.FileInterface)
-	//c := diskv2.NewDiskV2Cache("/tmp/fastfs", 1024*1024)
-	//c.Clear()
-	//c := badgercache.NewBadgerCache()
-	//hc := hybridcache.NewHybridCache(32, c)
+	newDisk, err := hybridcache.NewDiskFactory(cfg.DiskBackend, cfg.DiskLocation, blockSize,
+		time.Duration(cfg.DiskTTL)*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hc := hybridcache.NewHybridCacheWithDisk(maxMemEntries, int64(1024*1024*cfg.DiskMaxMB), blockSize, newDisk)
+
+	memCodec, err := codec.New(cfg.MemCompression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hc.SetCompression(memCodec)
+
+	nsConfigs, err := hybridcache.ParseNamespaces(cfg.Namespaces)
+	if err != nil {
+		log.Fatal(err)
+	}
+	arenaBlocks := maxMemEntries
+	for _, nsConfig := range nsConfigs {
+		if err := hc.AddNamespace(nsConfig); err != nil {
+			log.Fatal(err)
+		}
+		arenaBlocks += nsConfig.MemBytes / blockSize
+	}
+
+	pool := bufpool.New(blockSize)
+	if cfg.MemArena {
+		// Leave room for blocks in flight to downloaders, the disk writer
+		// and readers. The pool falls back to the heap past that.
+		arenaBlocks += arenaBlocks/4 + int64(cfg.NumDownloaders)
+		pool, err = bufpool.NewArena(blockSize, arenaBlocks)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	hc.SetPool(pool)
+
+	addr := cfg.Address
+	serverAddr := fmt.Sprintf("%v:%v", addr, cfg.FSPort)
+	localAddr := fmt.Sprintf("%v:%v", addr, cfg.Port)
+
+	var pt partitioner.Partitioner
+	switch cfg.Partitioner {
+	case partitioner.Hash:
+		pt = partitioner.NewHashPartitioner(cfg.HashReplicas)
+	case partitioner.Bounded:
+		pt = partitioner.NewBoundedPartitioner(cfg.HashReplicas, cfg.LoadFactor)
+	case partitioner.Rendezvous:
+		pt = partitioner.NewRendezvousPartitioner()
+	}
+	events := EventDelegates{pt}
+	var meta common.NodeMeta
+	meta.MemoryBytes = int64(cfg.MemMaxMB) << 20
+	meta.DiskBytes = int64(cfg.DiskMaxMB) << 20
+
+	buckets, err := s3.NewBuckets(cfg.Bucket, strings.Split(cfg.Buckets, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var mm *metadatamanager.MetadataManager
+	var rs *raftstore.Store
+	switch cfg.MetadataBackend {
+	case "redis":
+		mm = metadatamanager.NewMetadataManager(strings.Split(cfg.RedisAddr, ","), cfg.RedisMaster,
+			cfg.RedisPassword, buckets)
+	case "raft":
+		meta.RaftAddr = fmt.Sprintf("%v:%v", addr, cfg.RaftPort)
+		// The node that starts the cluster bootstraps raft below. Everyone
+		// else is added once the leader sees them in memberlist.
+		rs = raftstore.New(serverAddr, meta.RaftAddr, cfg.RaftDir, time.Duration(cfg.RaftFailedTimeout)*time.Second)
+		events = append(events, rs)
+		mm = metadatamanager.NewMetadataManagerWithStore(rs, buckets)
+	}
 
-	serverAddr := fmt.Sprintf("%v:%v", addr, fsPort)
-	isPrimary := port == primaryPort && addr == primaryAddr
-	mm := metadatamanager.NewMetadataManager(redisAddr, bucket, isPrimary)
+	dm := datamanager.New(buckets, cfg.NumDownloaders, cfg.NumBlockUploaders, hc, pool, blockSize, serverAddr, mm, pt)
+	hc.OnEvicted = dm.HandleEvicted
 
-	pt := partitioner.NewHashPartitioner()
-	dm := datamanager.New(bucket, numDownloaders, hc, blockSize, serverAddr, mm, pt)
+	// Cached blocks live on the heap unless they are in the arena
+	if !pool.OffHeap() {
+		debug.SetGCPercent(80)
+	}
+	mm.SetLeaseTTL(time.Duration(cfg.MetadataLease) * time.Second)
+
+	fastfs := NewFastFS(addr, cfg.Port, cfg.FSPort, meta, events, gossipKey)
+	fastfs.OnInvalidate = mm.Invalidate
+	mm.OnChanged = fastfs.BroadcastInvalidate
 
-	debug.SetGCPercent(80)
-	fastfs := NewFastFS(addr, port, fsPort, fmt.Sprintf("%v:%v", primaryAddr, primaryPort), pt)
+	source := discoverySource(cfg)
+	peers, err := source.Peers()
+	if err != nil && !cfg.Bootstrap {
+		log.Fatalf("Unable to discover the cluster: %v", err)
+	}
+	var seeds []string
+	isSeed := false
+	for _, seed := range fastfs.Unknown(peers) {
+		if seed == localAddr {
+			isSeed = true
+		} else {
+			seeds = append(seeds, seed)
+		}
+	}
+	if len(seeds) == 0 && !isSeed && !cfg.Bootstrap {
+		log.Fatal("No seeds were discovered. Pass --bootstrap to start a new cluster")
+	}
+
+	// Seeds started together each wait for the others and the lowest named
+	// one bootstraps Raft with all of them, instead of none of them doing it
+	expect := cfg.BootstrapExpect
+	if expect == 0 && isSeed && cfg.Seeds != "" {
+		expect = len(cfg.SeedList())
+	}
+	if rs == nil || cfg.Bootstrap {
+		expect = 0
+	}
+
+	founder := len(seeds) == 0
+	if !founder {
+		_, err = fastfs.Join(seeds, time.Duration(cfg.JoinTimeout)*time.Second)
+		if err != nil && expect > 1 {
+			log.Errorf("Unable to join the cluster through any of %v. Waiting for %v nodes: %v", seeds, expect, err)
+		} else if err != nil && !cfg.Bootstrap {
+			log.Fatalf("Unable to join the cluster through any of %v: %v", seeds, err)
+		} else if err != nil {
+			log.Errorf("Unable to join the cluster through any of %v. Starting a new one: %v", seeds, err)
+			founder = true
+		}
+	}
+	if expect > 1 {
+		founder = false
+	}
+	if founder {
+		log.Infof("Starting a new cluster at %v", localAddr)
+		if rs != nil {
+			rs.Bootstrap()
+		}
+	}
+
+	if cfg.DiscoveryInterval > 0 {
+		// Nodes started later are found here. Gossip spreads them to the
+		// rest of the cluster.
+		go discovery.Watch(source, time.Duration(cfg.DiscoveryInterval)*time.Second, func(peers []string) {
+			peers = fastfs.Unknown(peers)
+			if len(peers) == 0 {
+				return
+			}
+			_, err := fastfs.Join(peers, 0)
+			if err != nil {
+				log.Errorf("Unable to join discovered nodes %v: %v", peers, err)
+			}
+		}, nil)
+	}
+
+	if expect > 1 {
+		err = rs.BootstrapExpect(expect, time.Duration(cfg.JoinTimeout)*time.Second)
+		if err != nil {
+			log.Fatalf("Unable to bootstrap Raft: %v", err)
+		}
+	} else if rs != nil {
+		err = rs.WaitForLeader(30 * time.Second)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	s := NewServer(addr, cfg.FSPort, dm, mm, pt, fastfs, cfg.NumUploaders, cfg.AggregatorParallelism)
+	if rs != nil {
+		s.raft = rs
+	}
+	if cfg.ACLFile != "" {
+		s.policy, err = acl.Load(cfg.ACLFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.audit, err = acl.NewAuditLog(cfg.AuditLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.Partitioner == partitioner.Bounded {
+		go advertiseLoad(s, meta)
+	}
+
+	stopReconciler := startReconciler(s, cfg)
+	go config.Reload(ctx, cfg, func(next *config.Config) {
+		setVerbose(next.Verbose)
+		mm.SetLeaseTTL(time.Duration(next.MetadataLease) * time.Second)
+		close(stopReconciler)
+		stopReconciler = startReconciler(s, next)
+	})
 
-	s := NewServer(addr, fsPort, dm, mm, pt, fastfs)
 	s.Serve()
 	//s.LoadServer("", 8081)
 
@@ -269,3 +411,56 @@ func main() {
 	//wg.Wait()
 
 }
+
+func setVerbose(verbose bool) {
+	if verbose {
+		log.SetLevel(log.InfoLevel)
+	} else {
+		log.SetLevel(log.ErrorLevel)
+	}
+}
+
+// discoverySource returns where to find the nodes of the cluster
+func discoverySource(cfg *config.Config) discovery.Source {
+	sources := discovery.Sources{discovery.Static(cfg.SeedList())}
+	if cfg.DiscoveryDNS != "" {
+		sources = append(sources, discovery.NewDNS(cfg.DiscoveryDNS))
+	}
+	if cfg.DiscoveryFile != "" {
+		sources = append(sources, discovery.NewFile(cfg.DiscoveryFile))
+	}
+	return sources
+}
+
+// loadInterval is how often nodes advertise their load
+const loadInterval = 5 * time.Second
+
+// advertiseLoad tells the other nodes how many block requests a second s
+// serves, for bounded loads. Never returns.
+func advertiseLoad(s *Server, meta common.NodeMeta) {
+	var last int64
+	for range time.Tick(loadInterval) {
+		requests := atomic.LoadInt64(&s.blockRequests)
+		load := math.Round(float64(requests-last) / loadInterval.Seconds())
+		last = requests
+		if load == meta.Load {
+			continue
+		}
+
+		meta.Load = load
+		err := s.fastfs.UpdateMeta(meta)
+		if err != nil {
+			log.Errorf("Advertising load failed: %v", err)
+		}
+	}
+}
+
+// startReconciler reconciles the configured prefixes while the node is the
+// coordinator. The returned channel stops it.
+func startReconciler(s *Server, cfg *config.Config) chan bool {
+	stop := make(chan bool)
+	if cfg.ReconcileInterval > 0 {
+		go s.reconciler(strings.Split(cfg.ReconcilePrefixes, ","), time.Duration(cfg.ReconcileInterval)*time.Second, stop)
+	}
+	return stop
+}
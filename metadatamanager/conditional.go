@@ -0,0 +1,295 @@
+package metadatamanager
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rahulgovind/fastfs/common"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+var ErrPreconditionFailed = errors.New("Precondition failed")
+
+// Precondition holds the If-Match and If-None-Match headers of a write.
+// Both are lists of ETags or "*". The ETag of a file is its generation.
+type Precondition struct {
+	IfMatch     string
+	IfNoneMatch string
+	// Token is the fencing token of the writer's lock on the file. The
+	// write fails with ErrNotLockHolder once the lock is lost. Zero if the
+	// writer holds no lock.
+	Token int64
+}
+
+func (p Precondition) IsSet() bool {
+	return p.IfMatch != "" || p.IfNoneMatch != "" || p.Token != 0
+}
+
+// checkFence returns ErrNotLockHolder if token isn't the token of the lock
+// held on filepath, or if value was written under a newer lock
+func (mm *MetadataManager) checkFence(filepath string, value string, token int64) error {
+	if token == 0 {
+		return nil
+	}
+	if token < parseFence(value) {
+		return ErrNotLockHolder
+	}
+	lock, _, err := mm.getLock(filepath)
+	if !mm.check(err) {
+		return err
+	}
+	if !held(lock) || lock.Token != token {
+		return ErrNotLockHolder
+	}
+	return nil
+}
+
+// ETag returns the ETag of a file at the given generation
+func ETag(generation int64) string {
+	return fmt.Sprintf("\"%d\"", generation)
+}
+
+// etagMatches returns true if the file matches any ETag in list. Weak
+// ETags compare like strong ones and bare generations are accepted too.
+func etagMatches(list string, exists bool, generation int64) bool {
+	if !exists {
+		return false
+	}
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == ETag(generation) || tag == strconv.FormatInt(generation, 10) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Precondition) check(exists bool, generation int64) bool {
+	if p.IfMatch != "" && !etagMatches(p.IfMatch, exists, generation) {
+		return false
+	}
+	if p.IfNoneMatch != "" && etagMatches(p.IfNoneMatch, exists, generation) {
+		return false
+	}
+	return true
+}
+
+// current returns the value stored for filepath or "" if there is no file.
+// If load is set files only in S3 are stored first, so preconditions see
+// them too.
+func (mm *MetadataManager) current(filepath string, load bool) (string, error) {
+	for {
+		value, ok, err := mm.centralServer.Get(fileKey(filepath))
+		if err != nil || ok || !load {
+			return value, err
+		}
+
+		fi, err := mm.queryDirect(filepath)
+		if err == FileNotFoundError {
+			return "", nil
+		}
+		value = formatFileValue(fi.Size, 0)
+		swapped, err := mm.centralServer.CompareAndSwap(fileKey(filepath), "", value)
+		if err != nil || swapped {
+			return value, err
+		}
+		// Someone else stored it first
+	}
+}
+
+// Check returns ErrPreconditionFailed if filepath doesn't satisfy cond
+// right now. Writes check again when they commit.
+func (mm *MetadataManager) Check(filepath string, cond Precondition) error {
+	if !cond.IsSet() {
+		return nil
+	}
+	if mm.Degraded() {
+		return ErrDegraded
+	}
+
+	value, err := mm.current(filepath, true)
+	if !mm.check(err) {
+		return err
+	}
+	err = mm.checkFence(filepath, value, cond.Token)
+	if err != nil {
+		return err
+	}
+	_, generation := parseFileValue(value)
+	if !cond.check(value != "", generation) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// Commit is a version of a file recorded by CommitFile
+type Commit struct {
+	Generation int64
+	// Previous is the size of the version it replaced, -1 if there was none
+	Previous int64
+
+	value string
+	old   string
+}
+
+// CommitFile records that filepath was written with the given size if cond
+// holds, atomically with the check
+func (mm *MetadataManager) CommitFile(filepath string, size int64, cond Precondition) (Commit, error) {
+	return mm.commit(dirOf(filepath), filepath, size, cond)
+}
+
+// RevertCommit restores the version c replaced, for writes that were
+// committed but couldn't be stored. Returns ErrPreconditionFailed if
+// filepath was committed again since.
+func (mm *MetadataManager) RevertCommit(filepath string, c Commit) error {
+	defer mm.changed(filepath)
+	if mm.Degraded() {
+		return ErrDegraded
+	}
+
+	swapped, err := mm.centralServer.CompareAndSwap(fileKey(filepath), c.value, c.old)
+	if !mm.check(err) {
+		return err
+	}
+	if !swapped {
+		return ErrPreconditionFailed
+	}
+
+	if c.old == "" {
+		err = mm.centralServer.ListDelete(dirOf(filepath), filepath)
+		if !mm.check(err) {
+			return err
+		}
+		mm.recordEvent(common.EventDelete, filepath, 0, 0)
+		return nil
+	}
+	size, generation := parseFileValue(c.old)
+	mm.recordEvent(common.EventOverwrite, filepath, size, generation)
+	return nil
+}
+
+func (mm *MetadataManager) commit(dir string, filename string, size int64, cond Precondition) (Commit, error) {
+	defer mm.changed(filename)
+	if mm.Degraded() {
+		if cond.IsSet() {
+			return Commit{Previous: -1}, ErrDegraded
+		}
+		log.Errorf("Metadata server unavailable. Recording %v once it is back", filename)
+		mm.deferWrite(fileKey(filename), func() error {
+			defer mm.changed(filename)
+			_, err := mm.commitStore(dir, filename, size, cond)
+			return err
+		})
+		return Commit{Previous: -1}, nil
+	}
+	return mm.commitStore(dir, filename, size, cond)
+}
+
+// commitStore is commit without the degraded mode handling
+func (mm *MetadataManager) commitStore(dir string, filename string, size int64, cond Precondition) (Commit, error) {
+	c := Commit{Previous: -1}
+	for {
+		var err error
+		c.old, err = mm.current(filename, cond.IsSet())
+		if !mm.check(err) {
+			return Commit{Previous: -1}, err
+		}
+		// The lock is checked on every attempt. A newer holder's write
+		// makes the swap below fail and is seen here.
+		err = mm.checkFence(filename, c.old, cond.Token)
+		if err != nil {
+			return Commit{Previous: -1}, err
+		}
+		_, oldGeneration := parseFileValue(c.old)
+		if !cond.check(c.old != "", oldGeneration) {
+			return Commit{Previous: -1}, ErrPreconditionFailed
+		}
+
+		c.Generation, err = mm.centralServer.Incr(generationKey(filename))
+		if !mm.check(err) {
+			return Commit{Previous: -1}, err
+		}
+		fence := parseFence(c.old)
+		if cond.Token > fence {
+			fence = cond.Token
+		}
+		c.value = formatFencedValue(size, c.Generation, fence)
+		swapped, err := mm.centralServer.CompareAndSwap(fileKey(filename), c.old, c.value)
+		if !mm.check(err) {
+			return Commit{Previous: -1}, err
+		}
+		if swapped {
+			break
+		}
+		// The file changed since it was read. The generation is skipped.
+	}
+
+	err := mm.centralServer.ListAdd(dir, filename)
+	if !mm.check(err) {
+		return c, err
+	}
+
+	eventType := common.EventCreate
+	if c.old != "" {
+		c.Previous, _ = parseFileValue(c.old)
+		eventType = common.EventOverwrite
+	}
+	mm.recordEvent(eventType, filename, size, c.Generation)
+	return c, nil
+}
+
+// RemoveFile removes filepath from the metadata if cond holds, atomically
+// with the check
+func (mm *MetadataManager) RemoveFile(filepath string, cond Precondition) error {
+	if strings.HasSuffix(filepath, "/") {
+		log.Fatal("Can't delete directorie yet")
+	}
+	defer mm.changed(filepath)
+	if mm.Degraded() {
+		if cond.IsSet() {
+			return ErrDegraded
+		}
+		mm.deferWrite(fileKey(filepath), func() error {
+			defer mm.changed(filepath)
+			return mm.removeStore(filepath, cond)
+		})
+		return nil
+	}
+	return mm.removeStore(filepath, cond)
+}
+
+// removeStore is RemoveFile without the degraded mode handling
+func (mm *MetadataManager) removeStore(filepath string, cond Precondition) error {
+	for {
+		old, err := mm.current(filepath, cond.IsSet())
+		if !mm.check(err) {
+			return err
+		}
+		err = mm.checkFence(filepath, old, cond.Token)
+		if err != nil {
+			return err
+		}
+		_, generation := parseFileValue(old)
+		if !cond.check(old != "", generation) {
+			return ErrPreconditionFailed
+		}
+		if old == "" {
+			break
+		}
+		swapped, err := mm.centralServer.CompareAndSwap(fileKey(filepath), old, "")
+		if !mm.check(err) {
+			return err
+		}
+		if swapped {
+			break
+		}
+	}
+
+	err := mm.centralServer.ListDelete(dirOf(filepath), filepath)
+	if !mm.check(err) {
+		return err
+	}
+	mm.recordEvent(common.EventDelete, filepath, 0, 0)
+	return nil
+}
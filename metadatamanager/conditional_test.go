@@ -0,0 +1,128 @@
+package metadatamanager
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memStore keeps values in memory for the parts of Store commits use.
+// Other methods panic.
+type memStore struct {
+	Store
+
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func newMemStore() *memStore {
+	return &memStore{values: make(map[string]string)}
+}
+
+func (s *memStore) Ping() error                { return nil }
+func (s *memStore) Unavailable(err error) bool { return false }
+
+func (s *memStore) Get(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	return value, ok, nil
+}
+
+func (s *memStore) CompareAndSwap(key string, expected string, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values[key] != expected {
+		return false, nil
+	}
+	if value == "" {
+		delete(s.values, key)
+	} else {
+		s.values[key] = value
+	}
+	return true, nil
+}
+
+func (s *memStore) Incr(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, _ := strconv.ParseInt(s.values[key], 10, 64)
+	n += 1
+	s.values[key] = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (s *memStore) ListAdd(key string, values ...string) error { return nil }
+
+func (s *memStore) StreamAdd(key string, maxLen int64, value string) (string, error) {
+	return "0", nil
+}
+
+// TestCommitLock has writers on two nodes commit a file and then move
+// their data into place slowly. The data left in place must be that of
+// the last commit.
+func TestCommitLock(t *testing.T) {
+	store := newMemStore()
+	nodes := []*MetadataManager{
+		NewMetadataManagerWithStore(store, nil),
+		NewMetadataManagerWithStore(store, nil),
+	}
+
+	var mu sync.Mutex
+	inPlace := int64(0)
+	var holders int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(mm *MetadataManager) {
+			defer wg.Done()
+			unlock, err := mm.LockCommit("a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unlock()
+			if atomic.AddInt32(&holders, 1) != 1 {
+				t.Error("Two writers hold the commit lock")
+			}
+			defer atomic.AddInt32(&holders, -1)
+
+			commit, err := mm.CommitFile("a", 1, Precondition{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			inPlace = commit.Generation
+			mu.Unlock()
+		}(nodes[i%2])
+	}
+	wg.Wait()
+
+	value, _, _ := store.Get(fileKey("a"))
+	_, generation := parseFileValue(value)
+	if generation != inPlace {
+		t.Errorf("Generation %v is committed but %v is in place", generation, inPlace)
+	}
+	if _, held, _ := store.Get(commitLockKey("a")); held {
+		t.Error("The commit lock wasn't released")
+	}
+}
+
+func TestCommitLockExpires(t *testing.T) {
+	store := newMemStore()
+	mm := NewMetadataManagerWithStore(store, nil)
+
+	// A node died holding the lock
+	store.values[commitLockKey("a")] = `{"Path":"a","Holder":"dead","Expiry":"2000-01-01T00:00:00Z"}`
+
+	unlock, err := mm.LockCommit("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
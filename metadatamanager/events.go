@@ -0,0 +1,78 @@
+package metadatamanager
+
+import (
+	"encoding/json"
+	"github.com/rahulgovind/fastfs/common"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// Changes to files are appended to one stream shared by all nodes
+const eventsKey = "e:events"
+
+// EventLogLength is about how many events are kept for watchers to resume
+// from
+const EventLogLength = 100000
+
+// recordEvent appends a change to the event log. Watchers miss the event
+// if it fails, so it is only logged.
+func (mm *MetadataManager) recordEvent(eventType string, filepath string, size int64, generation int64) {
+	if mm.Degraded() {
+		return
+	}
+
+	data, _ := json.Marshal(common.WatchEvent{
+		Type:       eventType,
+		Path:       filepath,
+		Size:       size,
+		Generation: generation,
+	})
+	_, err := mm.centralServer.StreamAdd(eventsKey, EventLogLength, string(data))
+	if !mm.check(err) {
+		log.Errorf("Unable to record %v of %v: %v", eventType, filepath, err)
+	}
+}
+
+// LatestToken returns a token to watch for events from now on
+func (mm *MetadataManager) LatestToken() (string, error) {
+	if mm.Degraded() {
+		return "", ErrDegraded
+	}
+	token, err := mm.centralServer.StreamLastID(eventsKey)
+	mm.check(err)
+	return token, err
+}
+
+// Events returns events of files under prefix after token, reading at most
+// count events from the log. The returned token resumes after everything
+// read, including events of other prefixes.
+func (mm *MetadataManager) Events(prefix string, token string, count int64) ([]common.WatchEvent, string, error) {
+	if mm.Degraded() {
+		return nil, token, ErrDegraded
+	}
+
+	// Errors aren't checked since a bad token fails too. Outages are
+	// still caught by the health check.
+	entries, err := mm.centralServer.StreamRead(eventsKey, token, count)
+	if err != nil {
+		return nil, token, err
+	}
+
+	var events []common.WatchEvent
+	for _, entry := range entries {
+		token = entry.ID
+
+		var event common.WatchEvent
+		err := json.Unmarshal([]byte(entry.Value), &event)
+		if err != nil {
+			log.Errorf("Invalid event %v: %v", entry.ID, err)
+			continue
+		}
+		if !strings.HasPrefix(event.Path, prefix) {
+			continue
+		}
+		event.Token = entry.ID
+		events = append(events, event)
+	}
+	return events, token, nil
+}
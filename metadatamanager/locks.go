@@ -0,0 +1,266 @@
+package metadatamanager
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/rahulgovind/fastfs/common"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLocked        = errors.New("Lock is held by someone else")
+	ErrNotLockHolder = errors.New("Lock is not held")
+)
+
+// Locks are stored as JSON and expire by the clock of the node that
+// acquired or renewed them. Tokens are counters that outlive the lock.
+func lockKey(path string) string {
+	return "k:" + path
+}
+
+func lockTokenKey(path string) string {
+	return "t:" + path
+}
+
+// commitLockKey is the lock writers hold from committing a file until its
+// data is in place. It is apart from the locks clients take.
+func commitLockKey(path string) string {
+	return "c:" + path
+}
+
+// commitLockTTL is how long a commit lock outlives a node that died
+// holding it. Holders renew it while they move data.
+const commitLockTTL = 30 * time.Second
+
+func (mm *MetadataManager) getLock(path string) (common.Lock, string, error) {
+	return mm.readLock(lockKey(path))
+}
+
+func (mm *MetadataManager) readLock(key string) (common.Lock, string, error) {
+	value, ok, err := mm.centralServer.Get(key)
+	if err != nil || !ok {
+		return common.Lock{}, "", err
+	}
+	var lock common.Lock
+	err = json.Unmarshal([]byte(value), &lock)
+	return lock, value, err
+}
+
+func held(lock common.Lock) bool {
+	return lock.Holder != "" && time.Now().Before(lock.Expiry)
+}
+
+// AcquireLock locks path for holder for ttl. Acquiring a lock holder
+// already holds renews it and keeps its token. If someone else holds it
+// ErrLocked is returned along with their lock.
+func (mm *MetadataManager) AcquireLock(path string, holder string, ttl time.Duration) (common.Lock, error) {
+	if mm.Degraded() {
+		return common.Lock{}, ErrDegraded
+	}
+
+	for {
+		lock, old, err := mm.getLock(path)
+		if !mm.check(err) {
+			return common.Lock{}, err
+		}
+		if held(lock) && lock.Holder != holder {
+			return lock, ErrLocked
+		}
+
+		if !held(lock) {
+			token, err := mm.centralServer.Incr(lockTokenKey(path))
+			if !mm.check(err) {
+				return common.Lock{}, err
+			}
+			lock = common.Lock{Path: path, Holder: holder, Token: token}
+		}
+		lock.Expiry = time.Now().Add(ttl)
+
+		data, _ := json.Marshal(lock)
+		swapped, err := mm.centralServer.CompareAndSwap(lockKey(path), old, string(data))
+		if !mm.check(err) {
+			return common.Lock{}, err
+		}
+		if swapped {
+			return lock, nil
+		}
+	}
+}
+
+// RenewLock extends a lock holder still holds with the given token
+func (mm *MetadataManager) RenewLock(path string, holder string, token int64, ttl time.Duration) (common.Lock, error) {
+	if mm.Degraded() {
+		return common.Lock{}, ErrDegraded
+	}
+
+	for {
+		lock, old, err := mm.getLock(path)
+		if !mm.check(err) {
+			return common.Lock{}, err
+		}
+		if !held(lock) || lock.Holder != holder || lock.Token != token {
+			return lock, ErrNotLockHolder
+		}
+
+		lock.Expiry = time.Now().Add(ttl)
+		data, _ := json.Marshal(lock)
+		swapped, err := mm.centralServer.CompareAndSwap(lockKey(path), old, string(data))
+		if !mm.check(err) {
+			return common.Lock{}, err
+		}
+		if swapped {
+			return lock, nil
+		}
+	}
+}
+
+// ReleaseLock releases a lock holder holds with the given token. Releasing
+// an expired lock succeeds as long as nobody acquired it since.
+func (mm *MetadataManager) ReleaseLock(path string, holder string, token int64) error {
+	if mm.Degraded() {
+		return ErrDegraded
+	}
+
+	for {
+		lock, old, err := mm.getLock(path)
+		if !mm.check(err) {
+			return err
+		}
+		if old == "" || lock.Holder != holder || lock.Token != token {
+			return ErrNotLockHolder
+		}
+
+		swapped, err := mm.centralServer.CompareAndSwap(lockKey(path), old, "")
+		if !mm.check(err) {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+}
+
+// CheckLock returns ErrNotLockHolder unless token is the token of a lock
+// currently held on path. Writers pass their token so that a writer whose
+// lock expired and was taken over is turned away.
+func (mm *MetadataManager) CheckLock(path string, token int64) error {
+	if mm.Degraded() {
+		return ErrDegraded
+	}
+
+	lock, _, err := mm.getLock(path)
+	if !mm.check(err) {
+		return err
+	}
+	if !held(lock) || lock.Token != token {
+		return ErrNotLockHolder
+	}
+	return nil
+}
+
+// Locks returns the locks currently held on paths under prefix
+func (mm *MetadataManager) Locks(prefix string) ([]common.Lock, error) {
+	if mm.Degraded() {
+		return nil, ErrDegraded
+	}
+
+	keys, err := mm.centralServer.Keys(lockKey(globEscape(prefix)) + "*")
+	if !mm.check(err) || len(keys) == 0 {
+		return nil, err
+	}
+	values, found, err := mm.centralServer.MGet(keys)
+	if !mm.check(err) {
+		return nil, err
+	}
+
+	var locks []common.Lock
+	for i, value := range values {
+		var lock common.Lock
+		if !found[i] || json.Unmarshal([]byte(value), &lock) != nil || !held(lock) {
+			continue
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+// LockCommit waits until no writer on any node is between committing path
+// and moving its data into place, and locks it until the returned function
+// is called. Without it a slower writer could move older data over the
+// data of a newer commit. While the store is unavailable only this node's
+// writers are ordered.
+func (mm *MetadataManager) LockCommit(path string) (func(), error) {
+	if mm.Degraded() {
+		return func() {}, nil
+	}
+
+	holder := strconv.FormatInt(rand.Int63(), 16)
+	key := commitLockKey(path)
+	for {
+		lock, old, err := mm.readLock(key)
+		if !mm.check(err) {
+			return nil, err
+		}
+		if held(lock) {
+			time.Sleep(10*time.Millisecond + time.Duration(rand.Int63n(int64(40*time.Millisecond))))
+			continue
+		}
+
+		lock = common.Lock{Path: path, Holder: holder, Expiry: time.Now().Add(commitLockTTL)}
+		data, _ := json.Marshal(lock)
+		swapped, err := mm.centralServer.CompareAndSwap(key, old, string(data))
+		if !mm.check(err) {
+			return nil, err
+		}
+		if swapped {
+			return mm.holdCommitLock(key, string(data)), nil
+		}
+	}
+}
+
+// holdCommitLock renews the commit lock stored as value at key until the
+// returned function releases it
+func (mm *MetadataManager) holdCommitLock(key string, value string) func() {
+	var mu sync.Mutex
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(commitLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			var lock common.Lock
+			json.Unmarshal([]byte(value), &lock)
+			lock.Expiry = time.Now().Add(commitLockTTL)
+			data, _ := json.Marshal(lock)
+
+			mu.Lock()
+			swapped, err := mm.centralServer.CompareAndSwap(key, value, string(data))
+			if swapped {
+				value = string(data)
+			}
+			mu.Unlock()
+			if !mm.check(err) || !swapped {
+				log.Errorf("Lost the commit lock %v: %v", key, err)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := mm.centralServer.CompareAndSwap(key, value, "")
+		if !mm.check(err) {
+			log.Errorf("Failed to release the commit lock %v: %v", key, err)
+		}
+	}
+}
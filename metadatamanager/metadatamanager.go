@@ -9,16 +9,121 @@ import (
 	log "github.com/sirupsen/logrus"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// MetadataManager keeps the namespace and block locations in a Store,
+// redis by default. While the store is unreachable it runs degraded: files
+// and directories are listed from S3 directly and there are no block
+// location hints.
+//
+// File info is cached locally under a lease of LeaseTTL. Writers bump the
+// generation of a file and call OnChanged so other nodes can drop their
+// lease early. Either way Query is never staler than the lease.
 type MetadataManager struct {
-	centralServer *RedisConn
+	centralServer Store
 	lru           *lru.Cache
-	bucket        string
+	buckets       *s3.Buckets
+	degraded      int32
+	leaseTTL      int64 // time.Duration
+
+	// deferred holds the writes made while degraded, the latest per key.
+	// They are replayed before leaving degraded mode so the store doesn't
+	// keep entries that went stale in the meantime.
+	deferredMu sync.Mutex
+	deferred   map[string]func() error
+
+	// OnChanged optionally specifies a callback function to be executed
+	// when this node changes the metadata of a file.
+	OnChanged func(filepath string)
+}
+
+// DefaultLeaseTTL bounds how stale cached file info can be
+const DefaultLeaseTTL = 5 * time.Second
+
+type lease struct {
+	fi     common.FileInfo
+	expiry time.Time
 }
 
 var FileNotFoundError = errors.New("File not found")
 
+// LocationTTL is how long a block location is kept without being refreshed.
+// Namespace metadata (files, sizes and directories) never expires.
+const LocationTTL = time.Hour
+
+// PendingUpload is a file written through FastFS that isn't in S3 yet
+type PendingUpload struct {
+	Path      string
+	NumBlocks int64
+	Size      int64
+}
+
+// Keys in the store are prefixed by what they hold. Directory sets are
+// prefixed by the Store with "__".
+func fileKey(filepath string) string {
+	return "f:" + filepath
+}
+
+// Generations are counters that outlive the file so a file that is deleted
+// and written again doesn't reuse one
+func generationKey(filepath string) string {
+	return "g:" + filepath
+}
+
+// File keys hold size:generation, followed by :fence once a writer holding
+// a lock wrote the file. Files stored before generations existed hold only
+// the size.
+func formatFileValue(size int64, generation int64) string {
+	return fmt.Sprintf("%d:%d", size, generation)
+}
+
+// formatFencedValue is formatFileValue for files written under a lock.
+// fence is the highest lock token the file was written with.
+func formatFencedValue(size int64, generation int64, fence int64) string {
+	if fence == 0 {
+		return formatFileValue(size, generation)
+	}
+	return fmt.Sprintf("%d:%d:%d", size, generation, fence)
+}
+
+func parseFileValue(value string) (size int64, generation int64) {
+	fields := strings.SplitN(value, ":", 3)
+	size, _ = strconv.ParseInt(fields[0], 10, 64)
+	if len(fields) > 1 {
+		generation, _ = strconv.ParseInt(fields[1], 10, 64)
+	}
+	return size, generation
+}
+
+// parseFence returns the highest lock token value was written with
+func parseFence(value string) int64 {
+	fields := strings.SplitN(value, ":", 3)
+	if len(fields) < 3 {
+		return 0
+	}
+	fence, _ := strconv.ParseInt(fields[2], 10, 64)
+	return fence
+}
+
+// Block locations are sets of the nodes holding the block in their cache
+func locationKey(filepath string, block int64) string {
+	return "l:" + CacheKeyToString(filepath, block)
+}
+
+// Pending uploads are kept per node in a hash of path => numBlocks:size
+func pendingKey(addr string) string {
+	return "p:" + addr
+}
+
+// dirOf returns the directory listing filepath is in, with a trailing
+// slash. Files at the root are in "".
+func dirOf(filepath string) string {
+	return filepath[:strings.LastIndex(filepath, "/")+1]
+}
+
 func CacheKeyToString(path string, block int64) string {
 	return fmt.Sprintf("%v-%v", path, block)
 }
@@ -32,102 +137,224 @@ func StringToCacheKey(s string) (string, int64) {
 	return s[:idx], block
 }
 
-func NewMetadataManager(addr string, bucket string, flush bool) *MetadataManager {
+// NewMetadataManager connects to redis at addrs. See NewRedisConn.
+func NewMetadataManager(addrs []string, masterName string, password string, buckets *s3.Buckets) *MetadataManager {
+	return NewMetadataManagerWithStore(NewRedisConn(addrs, masterName, password), buckets)
+}
+
+func NewMetadataManagerWithStore(store Store, buckets *s3.Buckets) *MetadataManager {
 	mm := new(MetadataManager)
-	mm.centralServer = NewRedisConn(addr)
-	if flush {
-		mm.centralServer.Flush()
-	}
+	mm.centralServer = store
 	mm.lru, _ = lru.New(1024 * 128)
-	mm.bucket = bucket
+	mm.buckets = buckets
+	mm.SetLeaseTTL(DefaultLeaseTTL)
+	mm.deferred = make(map[string]func() error)
 
+	mm.check(mm.centralServer.Ping())
+	go mm.healthCheck()
 	return mm
 }
 
-func (mm *MetadataManager) QueryLocation(filepath string, block int64) (string, bool) {
-	fLink := CacheKeyToString(filepath, block)
-	location, ok := mm.centralServer.Get(fLink)
+// LeaseTTL returns how long file info is cached
+func (mm *MetadataManager) LeaseTTL() time.Duration {
+	return time.Duration(atomic.LoadInt64(&mm.leaseTTL))
+}
 
-	if ok {
-		return location, true
+// SetLeaseTTL changes how long file info is cached from now on. It may be
+// called while serving.
+func (mm *MetadataManager) SetLeaseTTL(ttl time.Duration) {
+	atomic.StoreInt64(&mm.leaseTTL, int64(ttl))
+}
+
+// Degraded returns true while the store is unreachable
+func (mm *MetadataManager) Degraded() bool {
+	return atomic.LoadInt32(&mm.degraded) == 1
+}
+
+// check switches to degraded mode if err means the store is unreachable.
+// Returns true if there was no error.
+func (mm *MetadataManager) check(err error) bool {
+	if err == nil {
+		return true
+	}
+	if !mm.centralServer.Unavailable(err) {
+		log.Errorf("Metadata server error: %v", err)
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&mm.degraded, 0, 1) {
+		log.Errorf("Metadata server unavailable. Running degraded: %v", err)
+	}
+	return false
+}
+
+func (mm *MetadataManager) healthCheck() {
+	for range time.Tick(time.Second) {
+		err := mm.centralServer.Ping()
+		if err != nil {
+			mm.check(err)
+		} else if mm.Degraded() {
+			mm.replay()
+		}
+	}
+}
+
+// deferWrite runs write once the store is back, replacing any write
+// deferred under the same key. It runs now if the store is already back.
+func (mm *MetadataManager) deferWrite(key string, write func() error) {
+	mm.deferredMu.Lock()
+	defer mm.deferredMu.Unlock()
+
+	if !mm.Degraded() {
+		mm.check(write())
+		return
+	}
+	mm.deferred[key] = write
+}
+
+// replay applies the deferred writes and leaves degraded mode once they
+// all went through
+func (mm *MetadataManager) replay() {
+	mm.deferredMu.Lock()
+	defer mm.deferredMu.Unlock()
+
+	for key, write := range mm.deferred {
+		err := write()
+		if err != nil && mm.centralServer.Unavailable(err) {
+			return
+		}
+		if err != nil {
+			log.Errorf("Dropping write of %v made while degraded: %v", key, err)
+		}
+		delete(mm.deferred, key)
 	}
-	return "", false
+	if atomic.CompareAndSwapInt32(&mm.degraded, 1, 0) {
+		log.Error("Metadata server available again")
+	}
+}
+
+// QueryLocations returns every node that holds the block in its cache
+func (mm *MetadataManager) QueryLocations(filepath string, block int64) []string {
+	if mm.Degraded() {
+		return nil
+	}
+	locations, err := mm.centralServer.SetMembers(locationKey(filepath, block))
+	mm.check(err)
+	return locations
+}
+
+// AddLocation records that addr holds the block
+func (mm *MetadataManager) AddLocation(filepath string, block int64, addr string) {
+	if mm.Degraded() {
+		return
+	}
+	mm.check(mm.centralServer.SetAdd(locationKey(filepath, block), LocationTTL, addr))
 }
 
-func (mm *MetadataManager) SetLocation(filepath string, block int64, addr string) {
-	fLink := CacheKeyToString(filepath, block)
-	mm.centralServer.Set(fLink, addr)
+// RemoveLocation records that addr no longer holds the block
+func (mm *MetadataManager) RemoveLocation(filepath string, block int64, addr string) {
+	if mm.Degraded() {
+		return
+	}
+	mm.check(mm.centralServer.SetRemove([]string{locationKey(filepath, block)}, addr))
+}
+
+// RemoveLocations removes addr as a holder of many blocks at once. Blocks
+// are given as cache keys.
+func (mm *MetadataManager) RemoveLocations(fLinks []string, addr string) {
+	if mm.Degraded() {
+		return
+	}
+	var keys []string
+	for _, fLink := range fLinks {
+		keys = append(keys, locationKey(StringToCacheKey(fLink)))
+	}
+	mm.check(mm.centralServer.SetRemove(keys, addr))
 }
 
 func (mm *MetadataManager) queryDirect(filepath string) (common.FileInfo, error) {
-	for _, node := range s3.ListNodes(mm.bucket, filepath) {
-		if node.Path == filepath && !node.IsDirectory {
-			return common.FileInfo{node.Path, node.Size}, nil
+	bucket, key, err := mm.buckets.Split(filepath)
+	if err != nil {
+		return common.FileInfo{}, FileNotFoundError
+	}
+	for _, node := range s3.ListNodes(bucket, key) {
+		if node.Path == key && !node.IsDirectory {
+			return common.FileInfo{Path: filepath, Size: node.Size}, nil
 		}
 	}
 	return common.FileInfo{}, FileNotFoundError
 }
 
 func (mm *MetadataManager) queryServer(filepath string) (common.FileInfo, error) {
-	value, ok := mm.centralServer.Get(filepath)
-	if ok {
-		size, _ := strconv.ParseInt(value, 10, 64)
+	if mm.Degraded() {
+		return mm.queryDirect(filepath)
+	}
 
-		return common.FileInfo{filepath, size}, nil
+	value, ok, err := mm.centralServer.Get(fileKey(filepath))
+	if !mm.check(err) {
+		return mm.queryDirect(filepath)
+	}
+	if ok {
+		size, generation := parseFileValue(value)
+		return common.FileInfo{Path: filepath, Size: size, Generation: generation}, nil
 	}
 	result, err := mm.queryDirect(filepath)
 	if err == FileNotFoundError {
 		return result, err
 	}
 
-	mm.centralServer.Set(filepath, fmt.Sprintf("%v", result.Size))
+	mm.check(mm.centralServer.Set(fileKey(filepath), formatFileValue(result.Size, 0)))
 	return result, err
 }
 
+// Query returns the file info of filepath, at most LeaseTTL() old
 func (mm *MetadataManager) Query(filepath string) (common.FileInfo, error) {
 	value, ok := mm.lru.Get(filepath)
 	if ok {
-		return value.(common.FileInfo), nil
+		l := value.(*lease)
+		if time.Now().Before(l.expiry) {
+			return l.fi, nil
+		}
 	}
 
 	// Does the server have it?
 	fi, err := mm.queryServer(filepath)
 
 	if err != FileNotFoundError {
-		mm.lru.Add(filepath, fi)
+		mm.lru.Add(filepath, &lease{fi, time.Now().Add(mm.LeaseTTL())})
+	} else {
+		mm.lru.Remove(filepath)
 	}
 
 	return fi, err
 }
 
+func (mm *MetadataManager) changed(filepath string) {
+	mm.lru.Remove(filepath)
+	if mm.OnChanged != nil {
+		mm.OnChanged(filepath)
+	}
+}
+
+// AddToList records that filename was written with the given size and
+// bumps its generation
 func (mm *MetadataManager) AddToList(dir string, filename string, size int64) {
-	mm.centralServer.Set(filename, fmt.Sprintf("%d", size))
-	mm.centralServer.ListAdd(dir, filename)
+	mm.commit(dir, filename, size, Precondition{})
 }
 
 func (mm *MetadataManager) RemoveFromList(filepath string) {
-
-	if strings.HasSuffix(filepath, "/") {
-		// Is a directory
-		log.Fatal("Can't delete directorie yet")
-	}
-	// File
-	lastIndex := strings.LastIndex(filepath, "/")
-	dir := filepath
-	if lastIndex != -1 {
-		dir = dir[:lastIndex+1]
-	}
-	mm.centralServer.ListDelete(dir, filepath)
-	mm.centralServer.Delete(filepath)
-
+	mm.RemoveFile(filepath, Precondition{})
 }
 
 func (mm *MetadataManager) getListDirect(dir string) (common.FileList, error) {
 	fmt.Println("getListDirect ", dir)
 	var fl common.FileList
-	for _, node := range s3.ListNodes(mm.bucket, dir) {
-		if !node.IsDirectory {
-			fl.Files = append(fl.Files, common.FileInfo{node.Path, node.Size})
+	bucket, key, err := mm.buckets.Split(dir)
+	if err != nil {
+		return fl, err
+	}
+	for _, node := range s3.ListNodes(bucket, key) {
+		if !node.IsDirectory && mm.buckets.Reachable(bucket, node.Path) {
+			fl.Files = append(fl.Files, common.FileInfo{Path: mm.buckets.Path(bucket, node.Path), Size: node.Size})
 		}
 	}
 	return fl, nil
@@ -135,7 +362,14 @@ func (mm *MetadataManager) getListDirect(dir string) (common.FileList, error) {
 
 func (mm *MetadataManager) queryListServer(dir string) (common.FileList, error) {
 	log.Info("getListServer ", dir)
-	value, ok := mm.centralServer.ListGet(dir)
+	if mm.Degraded() {
+		return mm.getListDirect(dir)
+	}
+
+	value, ok, err := mm.centralServer.ListGet(dir)
+	if !mm.check(err) {
+		return mm.getListDirect(dir)
+	}
 	log.Info("ok: ", ok)
 	if ok {
 		var result common.FileList
@@ -154,15 +388,17 @@ func (mm *MetadataManager) queryListServer(dir string) (common.FileList, error)
 		filenames = append(filenames, file.Path)
 	}
 
-	mm.centralServer.ListAdd(dir, filenames...)
+	if !mm.check(mm.centralServer.ListAdd(dir, filenames...)) {
+		return result, nil
+	}
 
 	var keys, values []string
 	for _, fi := range result.Files {
-		keys = append(keys, fi.Path)
-		values = append(values, fmt.Sprintf("%d", fi.Size))
+		keys = append(keys, fileKey(fi.Path))
+		values = append(values, formatFileValue(fi.Size, 0))
 	}
 
-	mm.centralServer.MSet(keys, values)
+	mm.check(mm.centralServer.MSet(keys, values))
 
 	return result, nil
 }
@@ -171,3 +407,69 @@ func (mm *MetadataManager) GetList(dir string) (common.FileList, error) {
 	// Not caching locally here since directories can be updated by others
 	return mm.queryListServer(dir)
 }
+
+// AddPendingUpload records that addr is uploading a file to S3 so the
+// upload can be resumed if addr restarts
+func (mm *MetadataManager) AddPendingUpload(addr string, pu PendingUpload) {
+	write := func() error {
+		return mm.centralServer.HashSet(pendingKey(addr), pu.Path, fmt.Sprintf("%d:%d", pu.NumBlocks, pu.Size))
+	}
+	if mm.Degraded() {
+		mm.deferWrite(pendingKey(addr)+":"+pu.Path, write)
+		return
+	}
+	mm.check(write())
+}
+
+func (mm *MetadataManager) RemovePendingUpload(addr string, path string) {
+	write := func() error {
+		return mm.centralServer.HashDelete(pendingKey(addr), path)
+	}
+	if mm.Degraded() {
+		mm.deferWrite(pendingKey(addr)+":"+path, write)
+		return
+	}
+	mm.check(write())
+}
+
+// ClearLocations prepares the registry for a node that is (re)starting
+// with an empty cache by removing the locations still pointing at addr. It
+// must run before addr serves, or blocks it caches meanwhile would be
+// removed too.
+func (mm *MetadataManager) ClearLocations(addr string) {
+	if mm.Degraded() {
+		log.Error("Metadata server unavailable. Skipping recovery")
+		return
+	}
+
+	keys, err := mm.centralServer.Keys("l:*")
+	if !mm.check(err) || !mm.check(mm.centralServer.SetRemove(keys, addr)) {
+		return
+	}
+	log.Infof("Recovered %d block locations", len(keys))
+}
+
+// PendingUploads returns the uploads addr didn't finish
+func (mm *MetadataManager) PendingUploads(addr string) []PendingUpload {
+	if mm.Degraded() {
+		log.Error("Metadata server unavailable. Skipping recovery")
+		return nil
+	}
+
+	pending, err := mm.centralServer.HashGetAll(pendingKey(addr))
+	if !mm.check(err) {
+		return nil
+	}
+
+	var result []PendingUpload
+	for path, value := range pending {
+		pu := PendingUpload{Path: path}
+		_, err := fmt.Sscanf(value, "%d:%d", &pu.NumBlocks, &pu.Size)
+		if err != nil {
+			log.Errorf("Invalid pending upload %v: %v", path, value)
+			continue
+		}
+		result = append(result, pu)
+	}
+	return result
+}
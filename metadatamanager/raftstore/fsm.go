@@ -0,0 +1,303 @@
+package raftstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Operations in the raft log
+const (
+	opSet     = "set"
+	opDelete  = "del"
+	opSetAdd  = "sadd"
+	opSetRem  = "srem"
+	opHashSet = "hset"
+	opHashDel = "hdel"
+	opExpire  = "expire"
+	opIncr    = "incr"
+	opXAdd    = "xadd"
+	opCAS     = "cas"
+)
+
+// command is one write. Now is the leader's clock when the write was
+// proposed so every replica computes the same expiry times.
+type command struct {
+	Op     string
+	Keys   []string
+	Values []string      `json:",omitempty"`
+	Field  string        `json:",omitempty"`
+	TTL    time.Duration `json:",omitempty"`
+	MaxLen int64         `json:",omitempty"`
+	Now    int64
+}
+
+// validate checks that cmd is a known operation with the keys and values
+// it needs. A committed command is applied by every replica, again on every
+// replay, so one that can't be applied must never reach the log.
+func (cmd command) validate() error {
+	keys, values := len(cmd.Keys), len(cmd.Values)
+	ok := true
+	switch cmd.Op {
+	case opSet:
+		ok = keys == values
+	case opDelete, opSetRem:
+	case opSetAdd:
+		ok = keys == 1
+	case opHashSet, opXAdd:
+		ok = keys == 1 && values == 1
+	case opHashDel, opIncr:
+		ok = keys == 1
+	case opCAS:
+		ok = keys == 1 && values == 2
+	case opExpire:
+		ok = keys == 0
+	default:
+		return fmt.Errorf("Unknown operation %v", cmd.Op)
+	}
+	if !ok {
+		return fmt.Errorf("Operation %v can't have %d keys and %d values", cmd.Op, keys, values)
+	}
+	return nil
+}
+
+type value struct {
+	Value  string
+	Expiry int64 `json:",omitempty"`
+}
+
+type set struct {
+	Members map[string]bool
+	Expiry  int64 `json:",omitempty"`
+}
+
+type streamEntry struct {
+	ID    int64
+	Value string
+}
+
+// stream entries are in ID order. Last is kept so IDs aren't reused
+// after the stream is trimmed.
+type stream struct {
+	Last    int64
+	Entries []streamEntry
+}
+
+// state is everything that is replicated. Like in redis, a key holds
+// either a value, a set, a hash or a stream.
+type state struct {
+	Values  map[string]*value
+	Sets    map[string]*set
+	Hashes  map[string]map[string]string
+	Streams map[string]*stream
+}
+
+func newState() *state {
+	return &state{
+		Values:  make(map[string]*value),
+		Sets:    make(map[string]*set),
+		Hashes:  make(map[string]map[string]string),
+		Streams: make(map[string]*stream),
+	}
+}
+
+// fsm applies committed commands to the state. Reads are served from it
+// directly.
+type fsm struct {
+	mu    sync.RWMutex
+	state *state
+}
+
+func newFSM() *fsm {
+	return &fsm{state: newState()}
+}
+
+func live(expiry int64, now int64) bool {
+	return expiry == 0 || now < expiry
+}
+
+func expiry(ttl time.Duration, now int64) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now + int64(ttl)
+}
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var cmd command
+	err := json.Unmarshal(l.Data, &cmd)
+	if err != nil {
+		return err
+	}
+	err = cmd.validate()
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := f.state
+
+	switch cmd.Op {
+	case opSet:
+		for i, key := range cmd.Keys {
+			f.delete(key)
+			st.Values[key] = &value{cmd.Values[i], expiry(cmd.TTL, cmd.Now)}
+		}
+	case opDelete:
+		for _, key := range cmd.Keys {
+			f.delete(key)
+		}
+	case opSetAdd:
+		key := cmd.Keys[0]
+		s, ok := st.Sets[key]
+		if !ok || !live(s.Expiry, cmd.Now) {
+			s = &set{Members: make(map[string]bool)}
+			st.Sets[key] = s
+		}
+		for _, member := range cmd.Values {
+			s.Members[member] = true
+		}
+		// Like SADD, a zero ttl leaves the expiry alone
+		if cmd.TTL > 0 {
+			s.Expiry = expiry(cmd.TTL, cmd.Now)
+		}
+	case opSetRem:
+		for _, key := range cmd.Keys {
+			s, ok := st.Sets[key]
+			if !ok {
+				continue
+			}
+			for _, member := range cmd.Values {
+				delete(s.Members, member)
+			}
+			if len(s.Members) == 0 {
+				delete(st.Sets, key)
+			}
+		}
+	case opHashSet:
+		key := cmd.Keys[0]
+		h, ok := st.Hashes[key]
+		if !ok {
+			h = make(map[string]string)
+			st.Hashes[key] = h
+		}
+		h[cmd.Field] = cmd.Values[0]
+	case opHashDel:
+		key := cmd.Keys[0]
+		delete(st.Hashes[key], cmd.Field)
+		if len(st.Hashes[key]) == 0 {
+			delete(st.Hashes, key)
+		}
+	case opIncr:
+		key := cmd.Keys[0]
+		n := int64(0)
+		if v, ok := st.Values[key]; ok && live(v.Expiry, cmd.Now) {
+			n, err = strconv.ParseInt(v.Value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Value of %v is not an integer", key)
+			}
+		}
+		n += 1
+		f.delete(key)
+		st.Values[key] = &value{Value: strconv.FormatInt(n, 10)}
+		return n
+	case opCAS:
+		key := cmd.Keys[0]
+		expected, newValue := cmd.Values[0], cmd.Values[1]
+		current := ""
+		if v, ok := st.Values[key]; ok && live(v.Expiry, cmd.Now) {
+			current = v.Value
+		}
+		// Keys can't hold empty values, so "" stands for no value
+		if current != expected {
+			return int64(0)
+		}
+		f.delete(key)
+		if newValue != "" {
+			st.Values[key] = &value{Value: newValue}
+		}
+		return int64(1)
+	case opXAdd:
+		key := cmd.Keys[0]
+		xs, ok := st.Streams[key]
+		if !ok {
+			xs = &stream{}
+			st.Streams[key] = xs
+		}
+		xs.Last += 1
+		xs.Entries = append(xs.Entries, streamEntry{xs.Last, cmd.Values[0]})
+		// Trim in steps, like MAXLEN ~, so entries aren't copied every time
+		if cmd.MaxLen > 0 && int64(len(xs.Entries)) > cmd.MaxLen+cmd.MaxLen/8 {
+			keep := xs.Entries[int64(len(xs.Entries))-cmd.MaxLen:]
+			xs.Entries = append([]streamEntry(nil), keep...)
+		}
+		return xs.Last
+	case opExpire:
+		for key, v := range st.Values {
+			if !live(v.Expiry, cmd.Now) {
+				delete(st.Values, key)
+			}
+		}
+		for key, s := range st.Sets {
+			if !live(s.Expiry, cmd.Now) {
+				delete(st.Sets, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fsm) delete(key string) {
+	delete(f.state.Values, key)
+	delete(f.state.Sets, key)
+	delete(f.state.Hashes, key)
+	delete(f.state.Streams, key)
+}
+
+// Snapshot serializes the state right away. Raft doesn't apply anything
+// while it runs, so only the copy needs to be held in memory.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	data, err := json.Marshal(f.state)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{data}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	st := newState()
+	err := json.NewDecoder(rc).Decode(st)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.state = st
+	f.mu.Unlock()
+	return nil
+}
+
+type snapshot struct {
+	data []byte
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	_, err := sink.Write(s.data)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
@@ -0,0 +1,210 @@
+package raftstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/hashicorp/raft"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func applyCommand(t *testing.T, f *fsm, cmd command) interface{} {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Apply(&raft.Log{Data: data})
+}
+
+func valueOf(f *fsm, key string) (string, bool) {
+	v, ok := f.state.Values[key]
+	if !ok {
+		return "", false
+	}
+	return v.Value, true
+}
+
+func members(f *fsm, key string) []string {
+	s, ok := f.state.Sets[key]
+	if !ok {
+		return nil
+	}
+	var result []string
+	for member := range s.Members {
+		result = append(result, member)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestApply(t *testing.T) {
+	f := newFSM()
+	now := time.Now().UnixNano()
+
+	applyCommand(t, f, command{Op: opSet, Keys: []string{"a", "b"}, Values: []string{"1", "2"}, Now: now})
+	if v, _ := valueOf(f, "b"); v != "2" {
+		t.Errorf("set: b is %q", v)
+	}
+
+	applyCommand(t, f, command{Op: opDelete, Keys: []string{"a"}, Now: now})
+	if _, ok := valueOf(f, "a"); ok {
+		t.Error("del: a is still set")
+	}
+
+	applyCommand(t, f, command{Op: opSetAdd, Keys: []string{"s"}, Values: []string{"x", "y"}, Now: now})
+	applyCommand(t, f, command{Op: opSetRem, Keys: []string{"s"}, Values: []string{"x"}, Now: now})
+	if got := members(f, "s"); !reflect.DeepEqual(got, []string{"y"}) {
+		t.Errorf("sadd/srem: s is %v", got)
+	}
+	applyCommand(t, f, command{Op: opSetRem, Keys: []string{"s"}, Values: []string{"y"}, Now: now})
+	if _, ok := f.state.Sets["s"]; ok {
+		t.Error("srem: empty set is kept")
+	}
+
+	applyCommand(t, f, command{Op: opHashSet, Keys: []string{"h"}, Field: "f", Values: []string{"v"}, Now: now})
+	if f.state.Hashes["h"]["f"] != "v" {
+		t.Errorf("hset: h is %v", f.state.Hashes["h"])
+	}
+	applyCommand(t, f, command{Op: opHashDel, Keys: []string{"h"}, Field: "f", Now: now})
+	if _, ok := f.state.Hashes["h"]; ok {
+		t.Error("hdel: empty hash is kept")
+	}
+
+	for i := int64(1); i <= 2; i++ {
+		if n := applyCommand(t, f, command{Op: opIncr, Keys: []string{"n"}, Now: now}); n != i {
+			t.Errorf("incr: got %v, expected %v", n, i)
+		}
+	}
+	applyCommand(t, f, command{Op: opSet, Keys: []string{"w"}, Values: []string{"word"}, Now: now})
+	if _, ok := applyCommand(t, f, command{Op: opIncr, Keys: []string{"w"}, Now: now}).(error); !ok {
+		t.Error("incr of a non integer didn't fail")
+	}
+
+	cas := func(expected string, value string) interface{} {
+		return applyCommand(t, f, command{Op: opCAS, Keys: []string{"c"}, Values: []string{expected, value}, Now: now})
+	}
+	if cas("", "1") != int64(1) || cas("", "2") != int64(0) || cas("1", "") != int64(1) {
+		t.Error("cas didn't compare with the current value")
+	}
+	if _, ok := valueOf(f, "c"); ok {
+		t.Error("cas to an empty value didn't delete the key")
+	}
+
+	for i := int64(1); i <= 20; i++ {
+		id := applyCommand(t, f, command{Op: opXAdd, Keys: []string{"x"}, Values: []string{"e"}, MaxLen: 8, Now: now})
+		if id != i {
+			t.Errorf("xadd: got id %v, expected %v", id, i)
+		}
+	}
+	if n := len(f.state.Streams["x"].Entries); n < 8 || n > 9 {
+		t.Errorf("xadd: %d entries are kept, expected about 8", n)
+	}
+
+	applyCommand(t, f, command{Op: opSet, Keys: []string{"t"}, Values: []string{"1"}, TTL: time.Second, Now: now})
+	applyCommand(t, f, command{Op: opExpire, Now: now + int64(2*time.Second)})
+	if _, ok := valueOf(f, "t"); ok {
+		t.Error("expire: t is still set")
+	}
+	if _, ok := valueOf(f, "b"); !ok {
+		t.Error("expire: b without ttl was removed")
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	testCases := []command{
+		{Op: "flush"},
+		{Op: opSet, Keys: []string{"a", "b"}, Values: []string{"1"}},
+		{Op: opCAS, Keys: []string{"a"}, Values: []string{"1"}},
+		{Op: opCAS, Values: []string{"1", "2"}},
+		{Op: opHashSet, Keys: []string{"h"}, Field: "f"},
+		{Op: opXAdd, Keys: []string{"x"}},
+		{Op: opSetAdd},
+		{Op: opHashDel},
+		{Op: opIncr},
+		{Op: opExpire, Keys: []string{"a"}},
+	}
+
+	f := newFSM()
+	for _, cmd := range testCases {
+		if cmd.validate() == nil {
+			t.Errorf("%+v is valid", cmd)
+		}
+		if _, ok := applyCommand(t, f, cmd).(error); !ok {
+			t.Errorf("Applying %+v didn't fail", cmd)
+		}
+	}
+}
+
+type memorySink struct {
+	bytes.Buffer
+}
+
+func (s *memorySink) ID() string    { return "test" }
+func (s *memorySink) Cancel() error { return nil }
+func (s *memorySink) Close() error  { return nil }
+
+func TestSnapshotRestore(t *testing.T) {
+	f := newFSM()
+	now := time.Now().UnixNano()
+	applyCommand(t, f, command{Op: opSet, Keys: []string{"a"}, Values: []string{"1"}, TTL: time.Hour, Now: now})
+	applyCommand(t, f, command{Op: opSetAdd, Keys: []string{"s"}, Values: []string{"x"}, Now: now})
+	applyCommand(t, f, command{Op: opHashSet, Keys: []string{"h"}, Field: "f", Values: []string{"v"}, Now: now})
+	applyCommand(t, f, command{Op: opXAdd, Keys: []string{"x"}, Values: []string{"e"}, Now: now})
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := new(memorySink)
+	err = snap.Persist(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newFSM()
+	err = restored.Restore(ioutil.NopCloser(&sink.Buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.state, restored.state) {
+		t.Errorf("Restored %+v, expected %+v", restored.state, f.state)
+	}
+
+	// Stream IDs continue after a restore
+	id := applyCommand(t, restored, command{Op: opXAdd, Keys: []string{"x"}, Values: []string{"e"}, Now: now})
+	if id != int64(2) {
+		t.Errorf("xadd after restore got id %v", id)
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"l:*", "l:a/b:0", true},
+		{"l:*", "f:a", false},
+		{"f:a?c", "f:abc", true},
+		{"f:a?c", "f:a/c", true},
+		{"f:a?c", "f:ac", false},
+		{`f:a\*`, "f:a*", true},
+		{`f:a\*`, "f:ab", false},
+		{"f:a.b", "f:axb", false},
+		{"f:(a)", "f:(a)", true},
+		{"*", "", true},
+	}
+	for _, tc := range testCases {
+		re, err := globToRegexp(tc.pattern)
+		if err != nil {
+			t.Errorf("%v: %v", tc.pattern, err)
+			continue
+		}
+		if re.MatchString(tc.key) != tc.match {
+			t.Errorf("%v matching %v: expected %v", tc.pattern, tc.key, tc.match)
+		}
+	}
+}
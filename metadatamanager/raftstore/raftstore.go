@@ -0,0 +1,672 @@
+package raftstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/rahulgovind/fastfs/common"
+	"github.com/rahulgovind/fastfs/metadatamanager"
+	"github.com/rahulgovind/fastfs/transport"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoLeader = errors.New("No raft leader")
+var ErrNotLeader = errors.New("Not the raft leader")
+
+const applyTimeout = 5 * time.Second
+
+// Store keeps the metadata in a raft group made of the FastFS nodes. Writes
+// go through the leader and are linearizable. Reads are served by the local
+// replica and may briefly lag behind the leader.
+//
+// Nodes find each other through memberlist: every node advertises its raft
+// address in its node meta and the leader adds the nodes it sees as voters,
+// so gossip must be encrypted for only nodes to join. Nodes that failed for
+// longer than failedTimeout are removed again.
+// A node's raft ID is its memberlist name, which is also its HTTP address,
+// so followers forward writes to the leader's /raft/apply.
+type Store struct {
+	id        string
+	raft      *raft.Raft
+	transport raft.Transport
+	fsm       *fsm
+	client    *http.Client
+
+	// failedTimeout is how long a failed node stays a voter. Until it is
+	// removed it counts towards the quorum. 0 keeps failed nodes forever.
+	failedTimeout time.Duration
+
+	mu     sync.Mutex
+	peers  map[string]string    // node name => raft address
+	failed map[string]time.Time // node name => when it failed
+}
+
+// New starts the raft node id listening on raftAddr. The log and snapshots
+// are kept in dir. The node waits to be added by the leader unless
+// Bootstrap is called. Nodes failed for longer than failedTimeout are
+// removed from the cluster.
+func New(id string, raftAddr string, dir string, failedTimeout time.Duration) *Store {
+	s := new(Store)
+	s.id = id
+	s.failedTimeout = failedTimeout
+	s.fsm = newFSM()
+	s.client = transport.NewClient(applyTimeout)
+	s.peers = make(map[string]string)
+	s.failed = make(map[string]time.Time)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logOutput := log.StandardLogger().Writer()
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(id)
+	config.LogOutput = logOutput
+	// Compact the log once it grows past 8192 entries
+	config.SnapshotThreshold = 8192
+	config.SnapshotInterval = time.Minute
+	config.TrailingLogs = 4096
+
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	logStore, err := raft.NewLogCache(512, boltStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, logOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if tlsConfig := transport.NodeTLSConfig(); tlsConfig != nil {
+		stream, err := newTLSStream(raftAddr, tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.transport = raft.NewNetworkTransport(stream, 3, 10*time.Second, logOutput)
+	} else {
+		s.transport, err = raft.NewTCPTransport(raftAddr, nil, 3, 10*time.Second, logOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	s.raft, err = raft.NewRaft(config, s.fsm, logStore, boltStore, snapshots, s.transport)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go s.watchLeadership()
+	go s.expirer()
+	go s.removeFailed()
+	return s
+}
+
+// Bootstrap creates a new single node cluster, for the node that starts
+// the FastFS cluster. Nodes that already hold raft state are left alone.
+func (s *Store) Bootstrap() {
+	s.bootstrap([]raft.Server{{ID: raft.ServerID(s.id), Address: s.transport.LocalAddr()}})
+}
+
+// BootstrapExpect waits until expect nodes, this one included, have joined
+// the FastFS cluster. The node with the lowest name among the first expect
+// nodes then bootstraps raft with all of them as voters, so seeds started
+// together agree on a single founder. Returns once a leader is known.
+func (s *Store) BootstrapExpect(expect int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for s.Ping() != nil {
+		if servers := s.expected(expect); servers != nil && servers[0].ID == raft.ServerID(s.id) {
+			s.bootstrap(servers)
+			return s.WaitForLeader(time.Until(deadline))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v of %v expected nodes joined before the timeout", len(s.servers()), expect)
+		}
+		time.Sleep(time.Second)
+	}
+	return nil
+}
+
+// expected returns the expect nodes with the lowest names, or nil if fewer
+// nodes are known
+func (s *Store) expected(expect int) []raft.Server {
+	servers := s.servers()
+	if len(servers) < expect {
+		return nil
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].ID < servers[j].ID
+	})
+	return servers[:expect]
+}
+
+// servers returns this node and every peer known through memberlist
+func (s *Store) servers() []raft.Server {
+	servers := []raft.Server{{ID: raft.ServerID(s.id), Address: s.transport.LocalAddr()}}
+	s.mu.Lock()
+	for id, addr := range s.peers {
+		servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(addr)})
+	}
+	s.mu.Unlock()
+	return servers
+}
+
+func (s *Store) bootstrap(servers []raft.Server) {
+	err := s.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	if err == raft.ErrCantBootstrap {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Bootstrapped raft cluster with %v voters at %v", len(servers), s.transport.LocalAddr())
+}
+
+func (s *Store) isLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// watchLeadership adds every known node to the cluster when this node
+// becomes leader, in case the previous leader missed some
+func (s *Store) watchLeadership() {
+	for leader := range s.raft.LeaderCh() {
+		if !leader {
+			continue
+		}
+		log.Infof("%v is the raft leader", s.id)
+		s.mu.Lock()
+		for id, addr := range s.peers {
+			go s.addVoter(id, addr)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Store) addVoter(id string, addr string) {
+	err := s.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, applyTimeout).Error()
+	if err != nil {
+		log.Errorf("Unable to add %v to raft cluster: %v", id, err)
+	}
+}
+
+func (s *Store) removeServer(id string) {
+	err := s.raft.RemoveServer(raft.ServerID(id), 0, applyTimeout).Error()
+	if err != nil {
+		log.Errorf("Unable to remove %v from raft cluster: %v", id, err)
+	}
+}
+
+// removeFailed has the leader remove nodes that failed more than
+// failedTimeout ago, so nodes that are gone for good don't erode the quorum
+func (s *Store) removeFailed() {
+	for range time.Tick(time.Minute) {
+		if s.failedTimeout <= 0 || !s.isLeader() {
+			continue
+		}
+		s.mu.Lock()
+		for id, since := range s.failed {
+			if time.Since(since) > s.failedTimeout {
+				log.Infof("Removing %v from the raft cluster. It failed %v ago", id, time.Since(since))
+				delete(s.failed, id)
+				delete(s.peers, id)
+				go s.removeServer(id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// expirer has the leader drop expired keys so they don't pile up in
+// snapshots. Reads ignore expired keys in the meantime.
+func (s *Store) expirer() {
+	for range time.Tick(time.Minute) {
+		if s.isLeader() {
+			err := s.apply(command{Op: opExpire})
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+func (s *Store) NotifyJoin(n *memberlist.Node) {
+	var meta common.NodeMeta
+	if len(n.Meta) > 0 {
+		err := json.Unmarshal(n.Meta, &meta)
+		if err != nil {
+			log.Errorf("Invalid node meta from %v: %v", n.Name, err)
+			return
+		}
+	}
+	if meta.RaftAddr == "" || n.Name == s.id {
+		return
+	}
+
+	s.mu.Lock()
+	s.peers[n.Name] = meta.RaftAddr
+	delete(s.failed, n.Name)
+	s.mu.Unlock()
+
+	if s.isLeader() {
+		go s.addVoter(n.Name, meta.RaftAddr)
+	}
+}
+
+// NotifyLeave removes nodes that left on purpose right away. Failed nodes
+// stay voters for failedTimeout so they can catch up when they come back.
+func (s *Store) NotifyLeave(n *memberlist.Node) {
+	if n.State != memberlist.StateLeft {
+		s.mu.Lock()
+		if _, ok := s.peers[n.Name]; ok {
+			s.failed[n.Name] = time.Now()
+		}
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.peers, n.Name)
+	s.mu.Unlock()
+
+	if s.isLeader() {
+		go s.removeServer(n.Name)
+	}
+}
+
+func (s *Store) NotifyUpdate(n *memberlist.Node) {
+	s.NotifyJoin(n)
+}
+
+// apply commits cmd through the leader
+func (s *Store) apply(cmd command) error {
+	_, err := s.execute(cmd)
+	return err
+}
+
+// execute commits cmd through the leader and returns its result
+func (s *Store) execute(cmd command) (int64, error) {
+	err := cmd.validate()
+	if err != nil {
+		return 0, err
+	}
+	if !s.isLeader() {
+		return s.forward(cmd)
+	}
+
+	cmd.Now = time.Now().UnixNano()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	f := s.raft.Apply(data, applyTimeout)
+	err = f.Error()
+	if err != nil {
+		return 0, err
+	}
+
+	switch resp := f.Response().(type) {
+	case error:
+		return 0, resp
+	case int64:
+		return resp, nil
+	}
+	return 0, nil
+}
+
+func (s *Store) forward(cmd command) (int64, error) {
+	_, leader := s.raft.LeaderWithID()
+	if leader == "" {
+		return 0, ErrNoLeader
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", transport.URL("%v/raft/apply", leader), bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	transport.Sign(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		// Leadership moved since it was looked up
+		return 0, ErrNotLeader
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("%v: %v", leader, strings.TrimSpace(string(msg)))
+	}
+
+	var result int64
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
+
+// ServeHTTP applies writes forwarded by followers. Only nodes may forward
+// them, whatever the access control policy allows.
+func (s *Store) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/raft/apply" {
+		http.NotFound(w, req)
+		return
+	}
+
+	if transport.Authenticates() && transport.Identity(req) != transport.NodeIdentity {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !s.isLeader() {
+		http.Error(w, ErrNotLeader.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	var cmd command
+	err := json.NewDecoder(req.Body).Decode(&cmd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = cmd.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.execute(cmd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res, _ := json.Marshal(result)
+	_, err = w.Write(res)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Unavailable is true while writes can't be committed, because there is no
+// leader or it can't be reached. Commands the FSM rejects are not.
+func (s *Store) Unavailable(err error) bool {
+	switch err {
+	case nil:
+		return false
+	case ErrNoLeader, ErrNotLeader, raft.ErrNotLeader, raft.ErrLeadershipLost,
+		raft.ErrRaftShutdown, raft.ErrEnqueueTimeout, raft.ErrAbortedByRestore:
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// Ping fails while there is no leader, since writes can't be committed
+func (s *Store) Ping() error {
+	addr, _ := s.raft.LeaderWithID()
+	if addr == "" {
+		return ErrNoLeader
+	}
+	return nil
+}
+
+func (s *Store) Get(key string) (string, bool, error) {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+
+	v, ok := s.fsm.state.Values[key]
+	if !ok || !live(v.Expiry, time.Now().UnixNano()) {
+		return "", false, nil
+	}
+	return v.Value, true, nil
+}
+
+func (s *Store) Set(key string, value string) error {
+	return s.SetWithTTL(key, value, 0)
+}
+
+func (s *Store) SetWithTTL(key string, value string, ttl time.Duration) error {
+	return s.apply(command{Op: opSet, Keys: []string{key}, Values: []string{value}, TTL: ttl})
+}
+
+func (s *Store) MGet(keys []string) (values []string, oks []bool, err error) {
+	for _, key := range keys {
+		value, ok, _ := s.Get(key)
+		values = append(values, value)
+		oks = append(oks, ok)
+	}
+	return
+}
+
+func (s *Store) MSet(keys []string, values []string) error {
+	if len(keys) != len(values) {
+		log.Fatal("(MSET) Number of keys != Number of values")
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.apply(command{Op: opSet, Keys: keys, Values: values})
+}
+
+func (s *Store) Delete(key string) error {
+	return s.apply(command{Op: opDelete, Keys: []string{key}})
+}
+
+func (s *Store) CompareAndSwap(key string, expected string, value string) (bool, error) {
+	swapped, err := s.execute(command{Op: opCAS, Keys: []string{key}, Values: []string{expected, value}})
+	return swapped == 1, err
+}
+
+func (s *Store) Incr(key string) (int64, error) {
+	return s.execute(command{Op: opIncr, Keys: []string{key}})
+}
+
+// Directory sets are prefixed the same way as in RedisConn
+func (s *Store) ListGet(key string) ([]string, bool, error) {
+	members, err := s.SetMembers("__" + key)
+	return members, len(members) > 0, err
+}
+
+func (s *Store) ListAdd(key string, values ...string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	return s.apply(command{Op: opSetAdd, Keys: []string{"__" + key}, Values: values})
+}
+
+func (s *Store) ListDelete(key string, values ...string) error {
+	return s.apply(command{Op: opSetRem, Keys: []string{"__" + key}, Values: values})
+}
+
+// SetAdd adds members to the set at key and resets its expiry to ttl
+func (s *Store) SetAdd(key string, ttl time.Duration, members ...string) error {
+	return s.apply(command{Op: opSetAdd, Keys: []string{key}, Values: members, TTL: ttl})
+}
+
+func (s *Store) SetMembers(key string) ([]string, error) {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+
+	set, ok := s.fsm.state.Sets[key]
+	if !ok || !live(set.Expiry, time.Now().UnixNano()) {
+		return nil, nil
+	}
+
+	var members []string
+	for member := range set.Members {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// SetRemove removes member from the set at every key in one log entry
+func (s *Store) SetRemove(keys []string, member string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.apply(command{Op: opSetRem, Keys: keys, Values: []string{member}})
+}
+
+// Keys returns every key matching a redis glob pattern
+func (s *Store) Keys(pattern string) ([]string, error) {
+	re, err := globToRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	var keys []string
+	for key, v := range s.fsm.state.Values {
+		if live(v.Expiry, now) && re.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	for key, set := range s.fsm.state.Sets {
+		if live(set.Expiry, now) && re.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range s.fsm.state.Hashes {
+		if re.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range s.fsm.state.Streams {
+		if re.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// globToRegexp supports the * and ? wildcards of redis patterns and
+// backslash escapes. Unlike path.Match the wildcards also match slashes.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '*':
+			sb.WriteString(".*")
+		case c == '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// StreamAdd trims the stream to about maxLen entries
+func (s *Store) StreamAdd(key string, maxLen int64, value string) (string, error) {
+	id, err := s.execute(command{Op: opXAdd, Keys: []string{key}, Values: []string{value}, MaxLen: maxLen})
+	return strconv.FormatInt(id, 10), err
+}
+
+func (s *Store) StreamRead(key string, after string, count int64) ([]metadatamanager.StreamEntry, error) {
+	afterID, err := strconv.ParseInt(after, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid stream ID %v", after)
+	}
+
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+
+	xs, ok := s.fsm.state.Streams[key]
+	if !ok {
+		return nil, nil
+	}
+
+	start := sort.Search(len(xs.Entries), func(i int) bool {
+		return xs.Entries[i].ID > afterID
+	})
+
+	var entries []metadatamanager.StreamEntry
+	for _, e := range xs.Entries[start:] {
+		if int64(len(entries)) == count {
+			break
+		}
+		entries = append(entries, metadatamanager.StreamEntry{ID: strconv.FormatInt(e.ID, 10), Value: e.Value})
+	}
+	return entries, nil
+}
+
+func (s *Store) StreamLastID(key string) (string, error) {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+
+	xs, ok := s.fsm.state.Streams[key]
+	if !ok {
+		return "0", nil
+	}
+	return strconv.FormatInt(xs.Last, 10), nil
+}
+
+func (s *Store) HashSet(key string, field string, value string) error {
+	return s.apply(command{Op: opHashSet, Keys: []string{key}, Field: field, Values: []string{value}})
+}
+
+func (s *Store) HashDelete(key string, field string) error {
+	return s.apply(command{Op: opHashDel, Keys: []string{key}, Field: field})
+}
+
+func (s *Store) HashGetAll(key string) (map[string]string, error) {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+
+	result := make(map[string]string)
+	for field, value := range s.fsm.state.Hashes[key] {
+		result[field] = value
+	}
+	return result, nil
+}
+
+// WaitForLeader blocks until a leader is known or timeout passes
+func (s *Store) WaitForLeader(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for s.Ping() != nil {
+		if time.Now().After(deadline) {
+			return ErrNoLeader
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
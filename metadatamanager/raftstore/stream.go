@@ -0,0 +1,26 @@
+package raftstore
+
+import (
+	"crypto/tls"
+	"github.com/hashicorp/raft"
+	"net"
+	"time"
+)
+
+// tlsStream carries raft traffic over TLS
+type tlsStream struct {
+	net.Listener
+	config *tls.Config
+}
+
+func newTLSStream(addr string, config *tls.Config) (*tlsStream, error) {
+	listener, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsStream{listener, config}, nil
+}
+
+func (t *tlsStream) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), t.config)
+}
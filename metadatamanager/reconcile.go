@@ -0,0 +1,295 @@
+package metadatamanager
+
+import (
+	"errors"
+	"github.com/rahulgovind/fastfs/common"
+	"github.com/rahulgovind/fastfs/s3"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+var ErrDegraded = errors.New("Metadata server unavailable")
+
+// Drift is a file whose metadata didn't match S3. OldSize is -1 for files
+// only in S3 and NewSize is -1 for files that are gone from S3.
+type Drift struct {
+	Path    string
+	OldSize int64
+	NewSize int64
+}
+
+// reconcileBatch is how many keys are read or written at once
+const reconcileBatch = 1000
+
+// globEscape quotes the wildcards of redis patterns in s
+func globEscape(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// Reconcile brings the metadata of every file under prefix in line with
+// S3. Files added, removed or resized in S3 by other tools are updated in
+// the store and the local lru. Files still being uploaded through FastFS, or
+// written through it while S3 was walked, are left alone. Returns the files
+// that changed so their cached blocks can be dropped.
+func (mm *MetadataManager) Reconcile(prefix string) (common.ReconcileReport, []Drift, error) {
+	start := time.Now()
+	report := common.ReconcileReport{Prefix: prefix}
+	if mm.Degraded() {
+		return report, nil, ErrDegraded
+	}
+
+	bucket, key, err := mm.buckets.Split(prefix)
+	if err != nil {
+		return report, nil, err
+	}
+
+	// Read before the walk. An upload that finishes during the walk may
+	// not be in S3 yet and is no longer pending afterwards.
+	pending, err := mm.pendingPaths()
+	if !mm.check(err) {
+		return report, nil, err
+	}
+	stored, err := mm.storedValues(prefix)
+	if !mm.check(err) {
+		return report, nil, err
+	}
+	// Prefixes of the default bucket match paths of other buckets too
+	for path := range stored {
+		if b, _, _ := mm.buckets.Split(path); b != bucket {
+			delete(stored, path)
+		}
+	}
+
+	inS3 := make(map[string]int64)
+	err = s3.WalkFiles(bucket, key, func(node s3.S3Node) {
+		if mm.buckets.Reachable(bucket, node.Path) {
+			inS3[mm.buckets.Path(bucket, node.Path)] = node.Size
+		}
+	})
+	if err != nil {
+		return report, nil, err
+	}
+	report.Scanned = len(inS3)
+
+	var drift []Drift
+	for path, size := range inS3 {
+		value, ok := stored[path]
+		if !ok {
+			drift = append(drift, Drift{path, -1, size})
+		} else if oldSize, _ := parseFileValue(value); oldSize != size && !pending[path] {
+			drift = append(drift, Drift{path, oldSize, size})
+		}
+	}
+	for path, value := range stored {
+		if _, ok := inS3[path]; !ok && !pending[path] {
+			oldSize, _ := parseFileValue(value)
+			drift = append(drift, Drift{path, oldSize, -1})
+		}
+	}
+
+	drift, err = mm.applyDrift(stored, drift)
+	for _, d := range drift {
+		switch {
+		case d.OldSize == -1:
+			report.Added += 1
+		case d.NewSize == -1:
+			report.Removed += 1
+		default:
+			report.Changed += 1
+		}
+	}
+	report.Seconds = time.Since(start).Seconds()
+	if !mm.check(err) {
+		return report, drift, err
+	}
+
+	if len(drift) > 0 {
+		log.Infof("Reconciled %v: %d added, %d removed, %d changed", prefix,
+			report.Added, report.Removed, report.Changed)
+	}
+	return report, drift, nil
+}
+
+// storedValues returns the value of every file under prefix in the store
+func (mm *MetadataManager) storedValues(prefix string) (map[string]string, error) {
+	keys, err := mm.centralServer.Keys(fileKey(globEscape(prefix)) + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for i := 0; i < len(keys); i += reconcileBatch {
+		end := i + reconcileBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[i:end]
+		values, oks, err := mm.centralServer.MGet(batch)
+		if err != nil {
+			return nil, err
+		}
+		for j, key := range batch {
+			if oks[j] {
+				result[strings.TrimPrefix(key, fileKey(""))] = values[j]
+			}
+		}
+	}
+	return result, nil
+}
+
+// pendingPaths returns the files any node is still uploading to S3
+func (mm *MetadataManager) pendingPaths() (map[string]bool, error) {
+	keys, err := mm.centralServer.Keys(pendingKey("*"))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]bool)
+	for _, key := range keys {
+		pending, err := mm.centralServer.HashGetAll(key)
+		if err != nil {
+			return nil, err
+		}
+		for path := range pending {
+			result[path] = true
+		}
+	}
+	return result, nil
+}
+
+// applyDrift writes drift to the store and returns the part of it that was
+// applied. Files whose value isn't what stored holds anymore were written
+// through FastFS since and are skipped.
+func (mm *MetadataManager) applyDrift(stored map[string]string, drift []Drift) ([]Drift, error) {
+	var applied, added []Drift
+	for _, d := range drift {
+		if d.OldSize == -1 {
+			added = append(added, d)
+			continue
+		}
+		ok, err := mm.applyChange(stored[d.Path], d)
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			applied = append(applied, d)
+		}
+	}
+
+	added, err := mm.applyAdds(added)
+	return append(applied, added...), err
+}
+
+// applyChange updates or removes a stored file if it still holds old
+func (mm *MetadataManager) applyChange(old string, d Drift) (bool, error) {
+	if d.NewSize == -1 {
+		swapped, err := mm.centralServer.CompareAndSwap(fileKey(d.Path), old, "")
+		if err != nil || !swapped {
+			return false, err
+		}
+		mm.changed(d.Path)
+		err = mm.centralServer.ListDelete(dirOf(d.Path), d.Path)
+		if err != nil {
+			return true, err
+		}
+		mm.recordEvent(common.EventDelete, d.Path, 0, 0)
+		return true, nil
+	}
+
+	generation, err := mm.centralServer.Incr(generationKey(d.Path))
+	if err != nil {
+		return false, err
+	}
+	swapped, err := mm.centralServer.CompareAndSwap(fileKey(d.Path), old, formatFencedValue(d.NewSize, generation, parseFence(old)))
+	if err != nil || !swapped {
+		// The generation is skipped like in commit
+		return false, err
+	}
+	mm.changed(d.Path)
+	mm.recordEvent(common.EventOverwrite, d.Path, d.NewSize, generation)
+	return true, nil
+}
+
+// applyAdds stores files that are only in S3 unless they were stored
+// meanwhile, checking them in batches first. Nobody can hold a lease on
+// them so there is nothing to invalidate, and they are given generation 0
+// like files loaded from S3 when they are first read. Only
+// directories whose listing is stored get the file and a create event.
+func (mm *MetadataManager) applyAdds(added []Drift) ([]Drift, error) {
+	var applied []Drift
+	for i := 0; i < len(added); i += reconcileBatch {
+		end := i + reconcileBatch
+		if end > len(added) {
+			end = len(added)
+		}
+		batch := added[i:end]
+
+		keys := make([]string, len(batch))
+		for j, d := range batch {
+			keys[j] = fileKey(d.Path)
+		}
+		// Files stored since the walk started were written through FastFS
+		_, oks, err := mm.centralServer.MGet(keys)
+		if err != nil {
+			return applied, err
+		}
+
+		for j, d := range batch {
+			if oks[j] {
+				continue
+			}
+			// A file may be committed between the check and the write.
+			// "" stands for no value, so only absent files are added.
+			swapped, err := mm.centralServer.CompareAndSwap(keys[j], "", formatFileValue(d.NewSize, 0))
+			if err != nil {
+				return applied, err
+			}
+			if swapped {
+				applied = append(applied, d)
+			}
+		}
+	}
+
+	byDir := make(map[string][]Drift)
+	for _, d := range applied {
+		byDir[dirOf(d.Path)] = append(byDir[dirOf(d.Path)], d)
+	}
+	for dir, files := range byDir {
+		// Listings that aren't stored are loaded from S3 when they are
+		// first listed, and nobody watching could have seen them
+		_, ok, err := mm.centralServer.ListGet(dir)
+		if err != nil {
+			return applied, err
+		}
+		if !ok {
+			continue
+		}
+
+		paths := make([]string, len(files))
+		for i, d := range files {
+			paths[i] = d.Path
+		}
+		err = mm.centralServer.ListAdd(dir, paths...)
+		if err != nil {
+			return applied, err
+		}
+		for _, d := range files {
+			mm.recordEvent(common.EventCreate, d.Path, d.NewSize, 0)
+		}
+	}
+	return applied, nil
+}
+
+// Invalidate drops filepath from the local lru so it is read from the
+// store again
+func (mm *MetadataManager) Invalidate(filepath string) {
+	mm.lru.Remove(filepath)
+}
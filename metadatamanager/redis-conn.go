@@ -3,23 +3,35 @@ package metadatamanager
 import (
 	"github.com/go-redis/redis"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strings"
 	"sync"
 	"time"
 )
 
 type RedisConn struct {
-	client *redis.Client
+	client redis.UniversalClient
 	mu     sync.Mutex
 }
 
-func NewRedisConn(addr string) *RedisConn {
+// NewRedisConn connects to redis. With a master name addrs are sentinels
+// and the connection follows failovers. Otherwise more than one address
+// connects to a redis cluster.
+func NewRedisConn(addrs []string, masterName string, password string) *RedisConn {
 	conn := new(RedisConn)
-	conn.client = redis.NewClient(&redis.Options{
-		Addr:        addr,
-		Password:    "",
-		DB:          0,
-		DialTimeout: time.Minute,
-		PoolSize:    300,
+	conn.client = redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:           addrs,
+		MasterName:      masterName,
+		Password:        password,
+		DB:              0,
+		DialTimeout:     5 * time.Second,
+		ReadTimeout:     3 * time.Second,
+		WriteTimeout:    3 * time.Second,
+		MaxRetries:      3,
+		MinRetryBackoff: 50 * time.Millisecond,
+		MaxRetryBackoff: time.Second,
+		PoolSize:        300,
 	})
 	return conn
 }
@@ -33,116 +45,324 @@ func (rc *RedisConn) Release() {
 	//rc.mu.Unlock()
 }
 
-func (rc *RedisConn) Get(key string) (string, bool) {
+func (rc *RedisConn) Ping() error {
+	return rc.client.Ping().Err()
+}
+
+// unavailableReplies are redis errors that mean the server can't take
+// commands right now
+var unavailableReplies = []string{
+	"LOADING ", "READONLY ", "CLUSTERDOWN ", "MASTERDOWN ", "TRYAGAIN ",
+	"ERR max number of clients reached",
+}
+
+// Unavailable is true for network errors, errors of the client itself such
+// as pool timeouts and replies of a server that can't take commands
+func (rc *RedisConn) Unavailable(err error) bool {
+	if err == nil || err == redis.Nil {
+		return false
+	}
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	msg := err.Error()
+	if strings.HasPrefix(msg, "redis: ") {
+		return true
+	}
+	for _, prefix := range unavailableReplies {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rc *RedisConn) Get(key string) (string, bool, error) {
 	rc.Acquire()
 	defer rc.Release()
 	val, err := rc.client.Get(key).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return "", false
+			return "", false, nil
 		}
-		log.Fatal(err)
+		return "", false, err
 	}
 
-	return val, true
+	return val, true, nil
 }
 
-func (rc *RedisConn) Set(key string, value string) {
+// Set stores key without expiry
+func (rc *RedisConn) Set(key string, value string) error {
+	return rc.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL stores key for ttl. Zero means no expiry.
+func (rc *RedisConn) SetWithTTL(key string, value string, ttl time.Duration) error {
 	rc.Acquire()
 	defer rc.Release()
 	log.Infof("Setting %v => %v", key, value)
-	err := rc.client.Set(key, value, time.Hour).Err()
-	if err != nil {
-		log.Fatalf("%v %s %s", err, key, value)
-	}
+	return rc.client.Set(key, value, ttl).Err()
 }
 
-func (rc *RedisConn) MGet(keys []string) (values []string, oks []bool) {
+// MGet gets keys in one round trip. Keys may live on different cluster
+// shards so they are pipelined rather than sent in one MGET.
+func (rc *RedisConn) MGet(keys []string) (values []string, oks []bool, err error) {
 	rc.Acquire()
 	defer rc.Release()
 	if len(keys) == 0 {
 		return
 	}
 
-	vals, err := rc.client.MGet(keys...).Result()
-	if err != nil {
-		log.Fatal(err)
+	pipe := rc.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(key)
+	}
+	// Exec returns redis.Nil if any key is missing
+	_, err = pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return nil, nil, err
 	}
-	for _, val := range vals {
-		if val == redis.Nil {
+
+	for _, cmd := range cmds {
+		val, err := cmd.Result()
+		if err == redis.Nil {
 			values = append(values, "")
 			oks = append(oks, false)
-		} else {
-			values = append(values, val.(string))
-			oks = append(oks, true)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
 		}
+		values = append(values, val)
+		oks = append(oks, true)
 	}
-	return
+	return values, oks, nil
 }
 
-func (rc *RedisConn) MSet(keys []string, values []string) {
+// MSet stores keys without expiry. Keys may live on different cluster
+// shards so they are pipelined rather than sent in one MSET.
+func (rc *RedisConn) MSet(keys []string, values []string) error {
 	rc.Acquire()
 	defer rc.Release()
-	var pairs []string
 	if len(keys) != len(values) {
 		log.Fatal("(MSET) Number of keys != Number of values")
 	}
 
 	if len(keys) == 0 {
-		return
+		return nil
 	}
 
+	pipe := rc.client.Pipeline()
 	for i := range keys {
-		pairs = append(pairs, keys[i], values[i])
+		pipe.Set(keys[i], values[i], 0)
 	}
-	s, err := rc.client.MSet(pairs).Result()
+	_, err := pipe.Exec()
+	return err
+}
 
-	if err != nil {
-		log.Fatal(s, err)
-	}
+func (rc *RedisConn) Delete(key string) error {
+	rc.Acquire()
+	defer rc.Release()
+	return rc.client.Del(key).Err()
 }
 
-func (rc *RedisConn) Delete(key string) {
+var casScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if (current == false and ARGV[1] == "") or current == ARGV[1] then
+	if ARGV[2] == "" then
+		redis.call("DEL", KEYS[1])
+	else
+		redis.call("SET", KEYS[1], ARGV[2])
+	end
+	return 1
+end
+return 0
+`)
+
+func (rc *RedisConn) CompareAndSwap(key string, expected string, value string) (bool, error) {
 	rc.Acquire()
 	defer rc.Release()
-	rc.client.Del(key).Result()
+	n, err := casScript.Run(rc.client, []string{key}, expected, value).Int64()
+	return n == 1, err
 }
 
-func (rc *RedisConn) ListGet(key string) ([]string, bool) {
+func (rc *RedisConn) Incr(key string) (int64, error) {
+	rc.Acquire()
+	defer rc.Release()
+	return rc.client.Incr(key).Result()
+}
+
+func (rc *RedisConn) ListGet(key string) ([]string, bool, error) {
 	rc.Acquire()
 	defer rc.Release()
 	key = "__" + key
 	val, err := rc.client.SMembers(key).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return nil, false
+			return nil, false, nil
 		}
-		log.Fatal(err)
+		return nil, false, err
 	}
 
 	if len(val) == 0 {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return val, true
+	return val, true, nil
 }
 
-func (rc *RedisConn) ListDelete(key string, values ...string) {
+func (rc *RedisConn) ListDelete(key string, values ...string) error {
 	rc.Acquire()
 	defer rc.Release()
 	key = "__" + key
-	rc.client.SRem(key, values).Result()
+	return rc.client.SRem(key, values).Err()
 }
 
-func (rc *RedisConn) ListAdd(key string, values ...string) {
+func (rc *RedisConn) ListAdd(key string, values ...string) error {
 	rc.Acquire()
 	defer rc.Release()
+	if len(values) == 0 {
+		return nil
+	}
 	key = "__" + key
-	rc.client.SAdd(key, values).Result()
+	return rc.client.SAdd(key, values).Err()
+}
+
+// SetAdd adds members to the set at key and resets its expiry to ttl
+func (rc *RedisConn) SetAdd(key string, ttl time.Duration, members ...string) error {
+	rc.Acquire()
+	defer rc.Release()
+	pipe := rc.client.Pipeline()
+	pipe.SAdd(key, members)
+	pipe.Expire(key, ttl)
+	_, err := pipe.Exec()
+	return err
+}
+
+func (rc *RedisConn) SetMembers(key string) ([]string, error) {
+	rc.Acquire()
+	defer rc.Release()
+	val, err := rc.client.SMembers(key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return val, err
+}
+
+// SetRemove removes member from the set at every key in one round trip
+func (rc *RedisConn) SetRemove(keys []string, member string) error {
+	rc.Acquire()
+	defer rc.Release()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	pipe := rc.client.Pipeline()
+	for _, key := range keys {
+		pipe.SRem(key, member)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+// Keys returns every key matching pattern. Uses SCAN so redis isn't
+// blocked. In a cluster every master is scanned.
+func (rc *RedisConn) Keys(pattern string) ([]string, error) {
+	rc.Acquire()
+	defer rc.Release()
+
+	cluster, ok := rc.client.(*redis.ClusterClient)
+	if !ok {
+		return scanKeys(rc.client, pattern)
+	}
+
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(func(client *redis.Client) error {
+		shardKeys, err := scanKeys(client, pattern)
+		mu.Lock()
+		keys = append(keys, shardKeys...)
+		mu.Unlock()
+		return err
+	})
+	return keys, err
+}
+
+func scanKeys(client redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(0, pattern, 1000).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// StreamAdd trims the stream to about maxLen entries
+func (rc *RedisConn) StreamAdd(key string, maxLen int64, value string) (string, error) {
+	rc.Acquire()
+	defer rc.Release()
+	return rc.client.XAdd(&redis.XAddArgs{
+		Stream:       key,
+		MaxLenApprox: maxLen,
+		Values:       map[string]interface{}{"v": value},
+	}).Result()
+}
+
+func (rc *RedisConn) StreamRead(key string, after string, count int64) ([]StreamEntry, error) {
+	rc.Acquire()
+	defer rc.Release()
+	streams, err := rc.client.XRead(&redis.XReadArgs{
+		Streams: []string{key, after},
+		Count:   count,
+		Block:   -1,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil || len(streams) == 0 {
+		return nil, err
+	}
+
+	var entries []StreamEntry
+	for _, msg := range streams[0].Messages {
+		value, _ := msg.Values["v"].(string)
+		entries = append(entries, StreamEntry{msg.ID, value})
+	}
+	return entries, nil
+}
+
+func (rc *RedisConn) StreamLastID(key string) (string, error) {
+	rc.Acquire()
+	defer rc.Release()
+	msgs, err := rc.client.XRevRangeN(key, "+", "-", 1).Result()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+	if len(msgs) == 0 {
+		return "0", nil
+	}
+	return msgs[0].ID, nil
+}
+
+func (rc *RedisConn) HashSet(key string, field string, value string) error {
+	rc.Acquire()
+	defer rc.Release()
+	return rc.client.HSet(key, field, value).Err()
 }
 
-func (rc *RedisConn) Flush() {
+func (rc *RedisConn) HashDelete(key string, field string) error {
 	rc.Acquire()
 	defer rc.Release()
-	rc.client.FlushAll().Val()
+	return rc.client.HDel(key, field).Err()
+}
+
+func (rc *RedisConn) HashGetAll(key string) (map[string]string, error) {
+	rc.Acquire()
+	defer rc.Release()
+	val, err := rc.client.HGetAll(key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return val, err
 }
@@ -0,0 +1,56 @@
+package metadatamanager
+
+import "time"
+
+// Store is the key value store the metadata lives in. RedisConn talks to
+// redis and raftstore.Store replicates it between the FastFS nodes.
+// Errors that mean the store is unreachable put the MetadataManager in
+// degraded mode.
+type Store interface {
+	Ping() error
+	// Unavailable returns true if err means the store couldn't be reached
+	// rather than that it rejected the command
+	Unavailable(err error) bool
+
+	Get(key string) (string, bool, error)
+	Set(key string, value string) error
+	SetWithTTL(key string, value string, ttl time.Duration) error
+	MGet(keys []string) ([]string, []bool, error)
+	MSet(keys []string, values []string) error
+	Delete(key string) error
+	// CompareAndSwap sets key to value if it currently holds expected.
+	// An empty expected means key must not exist and an empty value
+	// deletes it. Returns false if key held something else.
+	CompareAndSwap(key string, expected string, value string) (bool, error)
+	// Incr increments the counter at key and returns the new value
+	Incr(key string) (int64, error)
+
+	// Directory listings
+	ListGet(key string) ([]string, bool, error)
+	ListAdd(key string, values ...string) error
+	ListDelete(key string, values ...string) error
+
+	SetAdd(key string, ttl time.Duration, members ...string) error
+	SetMembers(key string) ([]string, error)
+	SetRemove(keys []string, member string) error
+
+	// Keys returns every key matching a redis glob pattern
+	Keys(pattern string) ([]string, error)
+
+	// Streams are append only logs. Entry IDs increase and are opaque.
+	StreamAdd(key string, maxLen int64, value string) (string, error)
+	// StreamRead returns up to count entries after the entry with ID
+	// after. "0" reads from the oldest entry kept.
+	StreamRead(key string, after string, count int64) ([]StreamEntry, error)
+	// StreamLastID returns the ID of the newest entry or "0"
+	StreamLastID(key string) (string, error)
+
+	HashSet(key string, field string, value string) error
+	HashDelete(key string, field string) error
+	HashGetAll(key string) (map[string]string, error)
+}
+
+type StreamEntry struct {
+	ID    string
+	Value string
+}
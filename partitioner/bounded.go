@@ -0,0 +1,70 @@
+package partitioner
+
+import (
+	"fmt"
+	"github.com/hashicorp/memberlist"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// BoundedPartitioner places blocks on a consistent hash ring with bounded
+// loads. Blocks of a node serving more than loadFactor times its share of
+// the requests go to the next node on the ring instead, so hot files
+// spread out. Loads are the hints nodes advertise in their metadata.
+type BoundedPartitioner struct {
+	*HashPartitioner
+	loadFactor float64
+
+	mu    sync.RWMutex
+	loads map[string]float64
+}
+
+func NewBoundedPartitioner(replicas int, loadFactor float64) *BoundedPartitioner {
+	bp := new(BoundedPartitioner)
+	bp.HashPartitioner = NewHashPartitioner(replicas)
+	bp.loadFactor = loadFactor
+	bp.loads = make(map[string]float64)
+	return bp
+}
+
+func (bp *BoundedPartitioner) Algorithm() string {
+	return Bounded
+}
+
+func (bp *BoundedPartitioner) load(name string) float64 {
+	bp.mu.RLock()
+	defer bp.mu.RUnlock()
+	return bp.loads[name]
+}
+
+func (bp *BoundedPartitioner) GetServer(path string, block int64) string {
+	return bp.hm.GetBounded(fmt.Sprintf("%s:%d", path, block), bp.loadFactor, bp.load)
+}
+
+func (bp *BoundedPartitioner) setLoad(n *memberlist.Node) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.loads[n.Name] = nodeMeta(n).Load
+}
+
+func (bp *BoundedPartitioner) NotifyJoin(n *memberlist.Node) {
+	bp.setLoad(n)
+	bp.HashPartitioner.NotifyJoin(n)
+}
+
+func (bp *BoundedPartitioner) NotifyLeave(n *memberlist.Node) {
+	bp.mu.Lock()
+	delete(bp.loads, n.Name)
+	bp.mu.Unlock()
+	bp.HashPartitioner.NotifyLeave(n)
+}
+
+// NotifyUpdate takes in new load hints and capacities
+func (bp *BoundedPartitioner) NotifyUpdate(n *memberlist.Node) {
+	bp.setLoad(n)
+	if nodeWeight(n) != bp.Weights()[n.Name] {
+		bp.HashPartitioner.NotifyUpdate(n)
+		return
+	}
+	log.Debugf("Load of %v is %.1f", n.Name, bp.load(n.Name))
+}
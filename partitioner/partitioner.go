@@ -6,6 +6,7 @@ import (
 	"github.com/rahulgovind/fastfs/consistenthash"
 	log "github.com/sirupsen/logrus"
 	"math/rand"
+	"sync"
 )
 
 // Partitioner has one job:
@@ -18,16 +19,69 @@ type Partitioner interface {
 	PickRandom() string
 }
 
+// Algorithms of Weighted partitioners, named like the partitioner setting
+const (
+	Hash       = "hash"
+	Bounded    = "bounded"
+	Rendezvous = "rendezvous"
+)
+
+// Weighted is a partitioner whose placement clients can reproduce, or with
+// bounded loads approximate, from its Algorithm, Replicas and Weights. Hash
+// and Bounded use a consistenthash.Map, Rendezvous a
+// consistenthash.Rendezvous.
+type Weighted interface {
+	Algorithm() string
+	Replicas() int
+	Weights() map[string]float64
+}
+
+// HashPartitioner places blocks on a consistent hash ring. Nodes get
+// replicas in proportion to their Weight.
 type HashPartitioner struct {
-	hm *consistenthash.Map
+	hm       *consistenthash.Map
+	replicas int
+
+	mu      sync.Mutex
+	weights map[string]float64
 }
 
-func NewHashPartitioner() *HashPartitioner {
+func NewHashPartitioner(replicas int) *HashPartitioner {
 	hp := new(HashPartitioner)
-	hp.hm = consistenthash.New(7, nil)
+	hp.hm = consistenthash.New(replicas, nil)
+	hp.replicas = replicas
+	hp.weights = make(map[string]float64)
 	return hp
 }
 
+func (hp *HashPartitioner) Algorithm() string {
+	return Hash
+}
+
+// Replicas returns the number of replicas of a node of weight 1
+func (hp *HashPartitioner) Replicas() int {
+	return hp.replicas
+}
+
+// Weights returns the weight of every node on the ring
+func (hp *HashPartitioner) Weights() map[string]float64 {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	weights := make(map[string]float64, len(hp.weights))
+	for name, weight := range hp.weights {
+		weights[name] = weight
+	}
+	return weights
+}
+
+func (hp *HashPartitioner) setWeight(name string, weight float64) {
+	hp.mu.Lock()
+	hp.weights[name] = weight
+	hp.mu.Unlock()
+	hp.hm.AddWeighted(name, weight)
+}
+
 func (hp *HashPartitioner) GetServer(path string, block int64) string {
 	return hp.hm.Get(fmt.Sprintf("%s:%d", path, block))
 }
@@ -37,15 +91,22 @@ func (hp *HashPartitioner) PickRandom() string {
 }
 
 func (hp *HashPartitioner) NotifyJoin(n *memberlist.Node) {
-	log.Infof("Adding %v to hash ring", n.Name)
-	hp.hm.Add(n.Name)
+	weight := nodeWeight(n)
+	log.Infof("Adding %v to hash ring with weight %.2f", n.Name, weight)
+	hp.setWeight(n.Name, weight)
 }
 
 func (hp *HashPartitioner) NotifyLeave(n *memberlist.Node) {
 	log.Infof("Removing %v from hash ring", n.Name)
+	hp.mu.Lock()
+	delete(hp.weights, n.Name)
+	hp.mu.Unlock()
 	hp.hm.Remove(n.Name)
 }
 
+// NotifyUpdate moves blocks to or from n if its capacity changed
 func (hp *HashPartitioner) NotifyUpdate(n *memberlist.Node) {
-	log.Infof("Ignoring hash ring metadata update for %v", n.Name)
+	weight := nodeWeight(n)
+	log.Infof("Updating weight of %v on hash ring to %.2f", n.Name, weight)
+	hp.setWeight(n.Name, weight)
 }
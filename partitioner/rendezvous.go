@@ -0,0 +1,60 @@
+package partitioner
+
+import (
+	"fmt"
+	"github.com/hashicorp/memberlist"
+	"github.com/rahulgovind/fastfs/consistenthash"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+)
+
+// RendezvousPartitioner places every block on the node with the highest
+// random weight for it. Nodes are weighted by capacity like with
+// HashPartitioner, without virtual nodes, so shares are exact on average
+// at the cost of looking at every node per block.
+type RendezvousPartitioner struct {
+	r *consistenthash.Rendezvous
+}
+
+func NewRendezvousPartitioner() *RendezvousPartitioner {
+	rp := new(RendezvousPartitioner)
+	rp.r = consistenthash.NewRendezvous()
+	return rp
+}
+
+func (rp *RendezvousPartitioner) Algorithm() string {
+	return Rendezvous
+}
+
+// Replicas is 0 since there are no virtual nodes
+func (rp *RendezvousPartitioner) Replicas() int {
+	return 0
+}
+
+// Weights returns the weight of every node
+func (rp *RendezvousPartitioner) Weights() map[string]float64 {
+	return rp.r.Weights()
+}
+
+func (rp *RendezvousPartitioner) GetServer(path string, block int64) string {
+	return rp.r.Get(fmt.Sprintf("%s:%d", path, block))
+}
+
+func (rp *RendezvousPartitioner) PickRandom() string {
+	return rp.r.Get(fmt.Sprintf("%d", rand.Int()))
+}
+
+func (rp *RendezvousPartitioner) NotifyJoin(n *memberlist.Node) {
+	weight := nodeWeight(n)
+	log.Infof("Adding %v with weight %.2f", n.Name, weight)
+	rp.r.Add(n.Name, weight)
+}
+
+func (rp *RendezvousPartitioner) NotifyLeave(n *memberlist.Node) {
+	log.Infof("Removing %v", n.Name)
+	rp.r.Remove(n.Name)
+}
+
+func (rp *RendezvousPartitioner) NotifyUpdate(n *memberlist.Node) {
+	rp.r.Add(n.Name, nodeWeight(n))
+}
@@ -0,0 +1,38 @@
+package partitioner
+
+import (
+	"encoding/json"
+	"github.com/hashicorp/memberlist"
+	"github.com/rahulgovind/fastfs/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// CapacityUnit is the cache capacity of a node of weight 1
+const CapacityUnit = 1 << 30
+
+// Weight returns the share of blocks a node should get relative to a node
+// with CapacityUnit bytes of cache. Nodes that don't advertise their
+// capacity have weight 1.
+func Weight(meta common.NodeMeta) float64 {
+	capacity := meta.MemoryBytes + meta.DiskBytes
+	if capacity <= 0 {
+		return 1
+	}
+	return float64(capacity) / CapacityUnit
+}
+
+// nodeMeta returns the metadata n advertises
+func nodeMeta(n *memberlist.Node) common.NodeMeta {
+	var meta common.NodeMeta
+	if len(n.Meta) > 0 {
+		err := json.Unmarshal(n.Meta, &meta)
+		if err != nil {
+			log.Errorf("Invalid node meta from %v: %v", n.Name, err)
+		}
+	}
+	return meta
+}
+
+func nodeWeight(n *memberlist.Node) float64 {
+	return Weight(nodeMeta(n))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rahulgovind/fastfs/common"
+	"github.com/rahulgovind/fastfs/transport"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Presigned URLs are valid for DefaultPresignTTL unless asked otherwise and
+// at most MaxPresignTTL
+const (
+	DefaultPresignTTL = 15 * time.Minute
+	MaxPresignTTL     = 7 * 24 * time.Hour
+)
+
+var byteRangePattern = regexp.MustCompile(`^\d+-\d+$`)
+
+// handlePresign serves /presign/<path>?method=GET|PUT&ttl=<seconds>&range=<start>-<end>.
+// It returns a URL of this node for /data GET or /put PUT of path that
+// needs no credentials. The URL has the permissions of the caller.
+func (s *Server) handlePresign(w http.ResponseWriter, req *http.Request, path string) {
+	query := req.URL.Query()
+	method := query.Get("method")
+	if method == "" {
+		method = "GET"
+	}
+	if path == "" || !s.dm.Buckets.Serves(path) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	ttl := DefaultPresignTTL
+	if query.Get("ttl") != "" {
+		seconds, err := strconv.ParseInt(query.Get("ttl"), 10, 64)
+		if err != nil || seconds <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl > MaxPresignTTL {
+		http.Error(w, fmt.Sprintf("ttl can be at most %v", MaxPresignTTL), http.StatusBadRequest)
+		return
+	}
+
+	byteRange := query.Get("range")
+	if byteRange != "" && (method != "GET" || !byteRangePattern.MatchString(byteRange)) {
+		http.Error(w, "range must be <start>-<end> and only for GET", http.StatusBadRequest)
+		return
+	}
+
+	var urlPath string
+	switch method {
+	case "GET":
+		urlPath = "/data/" + path
+	case "PUT":
+		urlPath = "/put/" + path
+	default:
+		http.Error(w, "method must be GET or PUT", http.StatusBadRequest)
+		return
+	}
+
+	expires := time.Now().Add(ttl)
+	url, err := transport.Presign(s.localAddress, method, urlPath, transport.Identity(req), expires, byteRange)
+	if err == transport.ErrPresignDisabled {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, common.PresignedURL{URL: url, Method: method, Expires: expires})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/rahulgovind/fastfs/common"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// driftStats add up the drift found by reconciliations on this node
+type driftStats struct {
+	mu      sync.Mutex
+	metrics common.DriftMetrics
+}
+
+func (ds *driftStats) record(report common.ReconcileReport) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	m := &ds.metrics
+	m.Runs += 1
+	if report.Error != "" {
+		m.Failures += 1
+	}
+	m.Added += int64(report.Added)
+	m.Removed += int64(report.Removed)
+	m.Changed += int64(report.Changed)
+	if m.Last == nil {
+		m.Last = make(map[string]common.ReconcileReport)
+	}
+	m.Last[report.Prefix] = report
+}
+
+func (ds *driftStats) get() common.DriftMetrics {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	m := ds.metrics
+	m.Last = make(map[string]common.ReconcileReport)
+	for prefix, report := range ds.metrics.Last {
+		m.Last[prefix] = report
+	}
+	return m
+}
+
+// reconciler periodically reconciles prefixes with S3 until stop is
+// closed. Every node runs it but only the coordinator reconciles, since the
+// metadata store and invalidations are cluster wide.
+func (s *Server) reconciler(prefixes []string, interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !s.fastfs.IsCoordinator() {
+			continue
+		}
+		for _, prefix := range prefixes {
+			s.reconcile(prefix)
+		}
+	}
+}
+
+// reconcile updates the metadata of prefix from S3 and drops cached blocks
+// of changed and removed files on every node
+func (s *Server) reconcile(prefix string) common.ReconcileReport {
+	report, drift, err := s.mm.Reconcile(prefix)
+	if err != nil {
+		log.Errorf("Reconciling %v failed: %v", prefix, err)
+		report.Error = err.Error()
+	}
+
+	var invalidations []common.Invalidation
+	blockSize := s.localClient.BlockSize
+	for _, d := range drift {
+		if d.OldSize == -1 {
+			// Nothing of it can be cached
+			continue
+		}
+		invalidations = append(invalidations, common.Invalidation{
+			Path:   d.Path,
+			Blocks: (d.OldSize + blockSize - 1) / blockSize,
+		})
+	}
+
+	if len(invalidations) > 0 {
+		s.invalidateAll(invalidations)
+	}
+
+	s.drift.record(report)
+	return report
+}
+
+// invalidateAll drops cached blocks on every node
+func (s *Server) invalidateAll(invalidations []common.Invalidation) {
+	for _, server := range s.fastfs.GetServers() {
+		if server == s.localAddress {
+			s.invalidate(invalidations)
+			continue
+		}
+		err := s.localClient.Invalidate(invalidations, server)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func (s *Server) invalidate(invalidations []common.Invalidation) {
+	for _, inv := range invalidations {
+		s.mm.Invalidate(inv.Path)
+		for block := int64(0); block < inv.Blocks; block += 1 {
+			s.dm.CacheDelete(inv.Path, block)
+		}
+	}
+}
+
+func (s *Server) handleReconcile(w http.ResponseWriter, req *http.Request) {
+	report := s.reconcile(req.URL.Query().Get("prefix"))
+	if report.Error != "" {
+		w.WriteHeader(500)
+	}
+
+	res, _ := json.Marshal(report)
+	_, err := w.Write(res)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (s *Server) handleInvalidate(w http.ResponseWriter, req *http.Request) {
+	var invalidations []common.Invalidation
+	err := json.NewDecoder(req.Body).Decode(&invalidations)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(400)
+		return
+	}
+	s.invalidate(invalidations)
+}
+
+func (s *Server) handleDrift(w http.ResponseWriter, req *http.Request) {
+	res, _ := json.Marshal(s.drift.get())
+	_, err := w.Write(res)
+	if err != nil {
+		log.Error(err)
+	}
+}
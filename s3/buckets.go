@@ -0,0 +1,85 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrBucketNotServed = errors.New("Bucket not served")
+
+// Buckets maps FastFS paths to the bucket and key they are stored at. Paths
+// of buckets in the allowlist start with the bucket name, as in
+// <bucket>/<key>. Every other path is a key in the default bucket, if
+// there is one. Since the bucket is part of the path, cache keys, block
+// locations and directory listings are kept apart per bucket.
+//
+// Keys of the default bucket whose first segment is the name of a bucket in
+// the allowlist map to that bucket instead and can't be reached. Listings
+// of the default bucket leave them out.
+type Buckets struct {
+	Default string
+	allowed map[string]bool
+}
+
+// NewBuckets returns an error if the default bucket is in the allowlist,
+// since its keys would be reachable under two paths
+func NewBuckets(defaultBucket string, allowed []string) (*Buckets, error) {
+	b := new(Buckets)
+	b.Default = defaultBucket
+	b.allowed = make(map[string]bool)
+	for _, bucket := range allowed {
+		if bucket == "" {
+			continue
+		}
+		if bucket == defaultBucket {
+			return nil, fmt.Errorf("default bucket %v can't be in the allowlist", bucket)
+		}
+		b.allowed[bucket] = true
+	}
+	return b, nil
+}
+
+// Split returns the bucket and key of path. See Buckets for keys of the
+// default bucket that collide with the allowlist.
+func (b *Buckets) Split(path string) (string, string, error) {
+	if idx := strings.Index(path, "/"); idx != -1 && b.allowed[path[:idx]] {
+		return path[:idx], path[idx+1:], nil
+	}
+	if b.Default == "" {
+		return "", "", ErrBucketNotServed
+	}
+	return b.Default, path, nil
+}
+
+// Path returns the FastFS path of key in bucket
+func (b *Buckets) Path(bucket string, key string) string {
+	if b.allowed[bucket] {
+		return bucket + "/" + key
+	}
+	return key
+}
+
+// Reachable returns false for keys of the default bucket that map to a
+// bucket in the allowlist
+func (b *Buckets) Reachable(bucket string, key string) bool {
+	split, _, err := b.Split(b.Path(bucket, key))
+	return err == nil && split == bucket
+}
+
+// Serves returns true if path is in a bucket that is served
+func (b *Buckets) Serves(path string) bool {
+	_, _, err := b.Split(path)
+	return err == nil
+}
+
+// Names returns the buckets in the allowlist
+func (b *Buckets) Names() []string {
+	var names []string
+	for bucket := range b.allowed {
+		names = append(names, bucket)
+	}
+	sort.Strings(names)
+	return names
+}
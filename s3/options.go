@@ -0,0 +1,98 @@
+package s3
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"sync"
+)
+
+// Options configure the S3 client shared by downloads, uploads and
+// listings
+type Options struct {
+	Region string
+	// Endpoint overrides the AWS endpoint, e.g. for MinIO or a VPC
+	// endpoint
+	Endpoint string
+	// Profile selects the credentials in ~/.aws. Empty uses the default
+	// credential chain.
+	Profile   string
+	PathStyle bool
+
+	// Written objects get the canned ACL, storage class and server side
+	// encryption (AES256 or aws:kms) given here. Empty leaves them to the
+	// bucket.
+	ACL          string
+	StorageClass string
+	SSE          string
+	SSEKMSKeyID  string
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Region: "us-east-2",
+		ACL:    "private",
+	}
+}
+
+var shared struct {
+	sync.Mutex
+	opts   Options
+	client *s3.S3
+}
+
+// Configure builds the shared client. It should be called before anything
+// else in the package, which otherwise uses DefaultOptions.
+func Configure(opts Options) error {
+	shared.Lock()
+	defer shared.Unlock()
+	return configure(opts)
+}
+
+func configure(opts Options) error {
+	switch opts.SSE {
+	case "", s3.ServerSideEncryptionAes256:
+		if opts.SSEKMSKeyID != "" {
+			return fmt.Errorf("a KMS key needs %v encryption", s3.ServerSideEncryptionAwsKms)
+		}
+	case s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("unknown server side encryption %q", opts.SSE)
+	}
+
+	config := aws.Config{Region: aws.String(opts.Region)}
+	if opts.Endpoint != "" {
+		config.Endpoint = aws.String(opts.Endpoint)
+	}
+	if opts.PathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	sessionOpts := session.Options{Config: config}
+	if opts.Profile != "" {
+		sessionOpts.Profile = opts.Profile
+		sessionOpts.SharedConfigState = session.SharedConfigEnable
+	}
+	sess, err := session.NewSessionWithOptions(sessionOpts)
+	if err != nil {
+		return err
+	}
+
+	shared.opts = opts
+	shared.client = s3.New(sess)
+	return nil
+}
+
+func currentOptions() Options {
+	shared.Lock()
+	defer shared.Unlock()
+	return shared.opts
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
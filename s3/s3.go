@@ -4,11 +4,11 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -21,11 +21,7 @@ type S3Node struct {
 }
 
 func PrintBuckets() error {
-	s, err := session.NewSession(&aws.Config{
-		Region: aws.String("us-west-2"),
-	})
-
-	client := s3.New(s)
+	client := getS3Client("")
 	result, err := client.ListBuckets(nil)
 	if err != nil {
 		log.Fatal("Unable to list buckets, ", err)
@@ -38,16 +34,18 @@ func PrintBuckets() error {
 	return nil
 }
 
+// getS3Client returns the shared client, configured with the defaults
+// unless Configure was called first
 func getS3Client(bucket string) *s3.S3 {
-	s, err := session.NewSession(&aws.Config{
-		Region: aws.String("us-east-2"),
-	})
-
-	if err != nil {
-		log.Fatal(err)
+	shared.Lock()
+	defer shared.Unlock()
+	if shared.client == nil {
+		err := configure(DefaultOptions())
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	svc := s3.New(s)
-	return svc
+	return shared.client
 }
 
 func ListDirectories(bucket string, path string) []string {
@@ -85,37 +83,62 @@ func ListFiles(bucket string, path string) []string {
 	return result
 }
 
+// ListNodes lists the files and directories directly under path. Listings
+// with more than 1000 entries are fetched page by page.
 func ListNodes(bucket string, path string) []S3Node {
 	svc := getS3Client(bucket)
-	resp, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
+	var result []S3Node
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
 		Bucket:    aws.String(bucket),
 		Prefix:    aws.String(path),
 		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, prefix := range page.CommonPrefixes {
+			result = append(result, S3Node{
+				Path:        *prefix.Prefix,
+				Size:        0,
+				IsDirectory: true,
+			})
+		}
+
+		for _, item := range page.Contents {
+			result = append(result, S3Node{
+				Path:        *item.Key,
+				Size:        *item.Size,
+				IsDirectory: false,
+			})
+		}
+		return true
 	})
 	if err != nil {
 		log.Fatalf("Unable to list items in bucket %q, %v", bucket, err)
 	}
 
-	var result []S3Node
-	for _, prefix := range resp.CommonPrefixes {
-		result = append(result, S3Node{
-			Path:        *prefix.Prefix,
-			Size:        0,
-			IsDirectory: true,
-		})
-	}
-
-	for _, item := range resp.Contents {
-		result = append(result, S3Node{
-			Path:        *item.Key,
-			Size:        *item.Size,
-			IsDirectory: false,
-		})
-	}
-
 	return result
 }
 
+// WalkFiles calls fn for every file under prefix, in every subdirectory,
+// one page of the listing at a time
+func WalkFiles(bucket string, prefix string, fn func(node S3Node)) error {
+	svc := getS3Client(bucket)
+	return svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			if strings.HasSuffix(*item.Key, "/") {
+				// Directory marker
+				continue
+			}
+			fn(S3Node{
+				Path: *item.Key,
+				Size: *item.Size,
+			})
+		}
+		return true
+	})
+}
+
 func ByteSize(b int64) string {
 	const unit = 1000
 	if b < unit {
@@ -158,10 +181,7 @@ func (fw *FakeWriterAt) WriteAt(p []byte, offset int64) (n int, err error) {
 
 func GetDownloader() *s3manager.Downloader {
 	startTime := time.Now()
-	sess, _ := session.NewSession(&aws.Config{
-		Region: aws.String("us-east-2")},
-	)
-	downloader := s3manager.NewDownloader(sess)
+	downloader := s3manager.NewDownloaderWithClient(getS3Client(""))
 	elasped := time.Since(startTime)
 	fmt.Println("Creating throughput took :", elasped)
 	return downloader
@@ -249,13 +269,49 @@ func PrintObjects(bucket string, prefix string, delimiter string) {
 	fmt.Println("")
 }
 
+// maxCopySize is the largest object CopyObject can copy in one request.
+// Larger objects are copied in parts.
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// minCopyPartSize is the smallest part of a multipart copy. Parts grow so
+// that there are at most maxCopyParts.
+const (
+	minCopyPartSize = 512 * 1024 * 1024
+	maxCopyParts    = 10000
+)
+
+// copySource is the URL encoded source of a copy
+func copySource(bucket string, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
 func CopyObject(bucket string, src string, dest string) error {
 	svc := getS3Client(bucket)
 
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(src),
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(head.ContentLength) > maxCopySize {
+		return copyMultipart(svc, bucket, src, dest, aws.Int64Value(head.ContentLength))
+	}
+
+	opts := currentOptions()
 	result, err := svc.CopyObject(&s3.CopyObjectInput{
-		Bucket:     aws.String(bucket),
-		CopySource: aws.String("/" + bucket + "/" + src),
-		Key:        aws.String(dest),
+		Bucket:               aws.String(bucket),
+		CopySource:           aws.String(copySource(bucket, src)),
+		Key:                  aws.String(dest),
+		ACL:                  optional(opts.ACL),
+		StorageClass:         optional(opts.StorageClass),
+		ServerSideEncryption: optional(opts.SSE),
+		SSEKMSKeyId:          optional(opts.SSEKMSKeyID),
 	})
 
 	if err != nil {
@@ -278,6 +334,71 @@ func CopyObject(bucket string, src string, dest string) error {
 	return nil
 }
 
+// copyMultipart copies an object too large for CopyObject with
+// UploadPartCopy. The upload is aborted if a part fails.
+func copyMultipart(svc *s3.S3, bucket string, src string, dest string, size int64) error {
+	partSize := int64(minCopyPartSize)
+	if size/maxCopyParts >= partSize {
+		partSize = size/maxCopyParts + 1
+	}
+
+	opts := currentOptions()
+	upload, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(dest),
+		ACL:                  optional(opts.ACL),
+		StorageClass:         optional(opts.StorageClass),
+		ServerSideEncryption: optional(opts.SSE),
+		SSEKMSKeyId:          optional(opts.SSEKMSKeyID),
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []*s3.CompletedPart
+	for start, part := int64(0), int64(1); start < size; start, part = start+partSize, part+1 {
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		result, err := svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(dest),
+			CopySource:      aws.String(copySource(bucket, src)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			PartNumber:      aws.Int64(part),
+			UploadId:        upload.UploadId,
+		})
+		if err != nil {
+			abortMultipart(svc, bucket, dest, upload.UploadId)
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: result.CopyPartResult.ETag, PartNumber: aws.Int64(part)})
+	}
+
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(dest),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		abortMultipart(svc, bucket, dest, upload.UploadId)
+	}
+	return err
+}
+
+func abortMultipart(svc *s3.S3, bucket string, key string, uploadId *string) {
+	_, err := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: uploadId,
+	})
+	if err != nil {
+		log.Errorf("Failed to abort upload of %v: %v", key, err)
+	}
+}
+
 func DeleteObject(bucket string, key string) error {
 	svc := getS3Client(bucket)
 
@@ -305,22 +426,22 @@ func DeleteObject(bucket string, key string) error {
 }
 
 func PutOjbect(bucket string, path string, r io.Reader) error {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String("us-east-2"),
-	})
-	uploader := s3manager.NewUploader(sess)
+	uploader := s3manager.NewUploaderWithClient(getS3Client(bucket))
 	//uploader.PartSize = 10 * 1024 * 1024
 	//uploader.Concurrency = 7
 
+	opts := currentOptions()
 	result, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(path),
-		Body:   r,
-		ACL:    aws.String("public-read"),
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(path),
+		Body:                 r,
+		ACL:                  optional(opts.ACL),
+		StorageClass:         optional(opts.StorageClass),
+		ServerSideEncryption: optional(opts.SSE),
+		SSEKMSKeyId:          optional(opts.SSEKMSKeyID),
 	})
 
 	if err != nil {
-		log.Fatal(err)
 		return fmt.Errorf("failed to upload file, %v", err)
 	}
 	log.Infof("file uploaded to, %s\n", result.Location)
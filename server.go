@@ -6,10 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/klauspost/pgzip"
+	"github.com/rahulgovind/fastfs/acl"
+	"github.com/rahulgovind/fastfs/bufpool"
 	"github.com/rahulgovind/fastfs/csvutils"
 	"github.com/rahulgovind/fastfs/datamanager"
 	"github.com/rahulgovind/fastfs/metadatamanager"
 	"github.com/rahulgovind/fastfs/partitioner"
+	"github.com/rahulgovind/fastfs/transport"
 	"github.com/rahulgovind/select-simd"
 	log "github.com/sirupsen/logrus"
 	"io"
@@ -17,6 +20,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,9 +35,28 @@ type Server struct {
 	localAddress string
 	fastfs       *FastFS
 	s3UploadChan chan *S3UploadInput
+	// raft applies metadata writes forwarded by other nodes. nil unless
+	// metadata is kept in raft.
+	raft  http.Handler
+	drift driftStats
+	// aggregatorParallelism is how many blocks of a file being written
+	// are buffered at once
+	aggregatorParallelism int
+	// policy decides what every identity may do. Everything is allowed if
+	// it is nil. Denials are recorded in audit.
+	policy *acl.Policy
+	audit  *acl.AuditLog
+	// blockRequests counts /data requests, to advertise load
+	blockRequests int64
+	// commitLocks holds conditional writes of a path from commit until
+	// the data is in place
+	commitLocks pathLocks
 	//uploadBucket *ratelimit.Bucket
 }
 
+// GenerationHeader carries the generation of a file in HEAD responses
+const GenerationHeader = "X-Fastfs-Generation"
+
 type S3UploadInput struct {
 	Path      string
 	NumBlocks int64
@@ -42,7 +65,7 @@ type S3UploadInput struct {
 
 func NewServer(addr string, port int, dm *datamanager.DataManager, mm *metadatamanager.MetadataManager,
 	p partitioner.Partitioner,
-	fastfs *FastFS) *Server {
+	fastfs *FastFS, numUploaders int, aggregatorParallelism int) *Server {
 	s := new(Server)
 	s.addr = addr
 	s.port = port
@@ -55,12 +78,23 @@ func NewServer(addr string, port int, dm *datamanager.DataManager, mm *metadatam
 	s.s3UploadChan = make(chan *S3UploadInput, 1024)
 	//s.uploadBucket = ratelimit.NewBucketWithQuantum(10 * time.Millisecond, 1024 * 1024 * 100,
 	//	1024 * 1024)
-	for i := 0; i < 3; i += 1 {
+	s.aggregatorParallelism = aggregatorParallelism
+	for i := 0; i < numUploaders; i += 1 {
 		go s.s3uploader()
 	}
 	return s
 }
 
+// resumeUploads resumes S3 uploads this node didn't finish before it went
+// down. Blocks are read back through this node so it must be serving
+// already.
+func (s *Server) resumeUploads() {
+	for _, pu := range s.mm.PendingUploads(s.localAddress) {
+		log.Infof("Resuming upload of %v", pu.Path)
+		s.s3UploadChan <- &S3UploadInput{pu.Path, pu.NumBlocks, pu.Size}
+	}
+}
+
 func (s *Server) rangeHandler(path string, w io.WriteCloser, start int64, end int64) {
 
 	startTime := time.Now()
@@ -98,6 +132,11 @@ type LsResponse struct {
 type SetupResponse struct {
 	Servers   []string
 	BlockSize int64
+	// Partitioner, Replicas and Weights let clients place blocks like
+	// the servers
+	Partitioner string             `json:",omitempty"`
+	Replicas    int                `json:",omitempty"`
+	Weights     map[string]float64 `json:",omitempty"`
 }
 
 func getWriterWraper(w http.ResponseWriter, encoding string) io.WriteCloser {
@@ -166,6 +205,8 @@ func (s *Server) handleHead(w http.ResponseWriter, req *http.Request, path strin
 	w.Header().Set("Content-Length", fmt.Sprintf("%v", file.Size))
 	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Type", "binary/octet-stream")
+	w.Header().Set(GenerationHeader, fmt.Sprintf("%d", file.Generation))
+	w.Header().Set("ETag", metadatamanager.ETag(file.Generation))
 	log.Debug("length: ", w.Header().Get("Content-Length"))
 	return
 }
@@ -182,11 +223,46 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	log.Info("Got: ", req.Method, req.RequestURI)
+	if !s.authorize(w, req, cmd, path) {
+		return
+	}
+
 	if req.Method == "HEAD" {
 		s.handleHead(w, req, path)
 		return
 	}
 
+	if cmd == "admin" {
+		s.handleAdmin(w, req, path)
+		return
+	}
+
+	if cmd == "watch" {
+		s.handleWatch(w, req, path)
+		return
+	}
+
+	if cmd == "lock" {
+		s.handleLock(w, req, path)
+		return
+	}
+
+	if cmd == "presign" {
+		s.handlePresign(w, req, path)
+		return
+	}
+
+	if cmd == "raft" && s.raft != nil {
+		s.raft.ServeHTTP(w, req)
+		return
+	}
+
+	// Everything else but setup reads or writes files
+	if cmd != "setup" && !s.dm.Buckets.Serves(path) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	if req.Method == "PUT" || req.Method == "POST" || cmd == "put" {
 		s.handlePut(w, req, path)
 		return
@@ -229,12 +305,14 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			dir = path[:lastIndex+1]
 		}
 		s.mm.AddToList(dir, path, size)
+		s.mm.AddPendingUpload(s.localAddress, metadatamanager.PendingUpload{Path: path, NumBlocks: numBlocks, Size: size})
 
 		s.s3UploadChan <- &S3UploadInput{path, numBlocks, size}
 		return
 	}
 
 	if cmd == "data" {
+		atomic.AddInt64(&s.blockRequests, 1)
 		w.Header().Set("Accept-Ranges", "bytes")
 
 		block := req.URL.Query().Get("block")
@@ -275,8 +353,13 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				log.Info(target, s.localAddress)
 				if target != s.localAddress {
 					// Bye bye
-					http.Redirect(w, req, fmt.Sprintf("http://%s/data/%s?force=1", target, path),
-						http.StatusMovedPermanently)
+					location := transport.URL("%s/data/%s?force=1", target, path)
+					if transport.Presigned(req) {
+						// The signature covers the escaped path
+						location = transport.URL("%s%s?force=1&%s", target, req.URL.EscapedPath(),
+							transport.PresignedQuery(req))
+					}
+					http.Redirect(w, req, location, http.StatusTemporaryRedirect)
 					return
 				}
 			}
@@ -294,17 +377,27 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				target := s.partitioner.GetServer(path, blockNum)
 
 				if s.localAddress != target {
-					req.URL.Host = target
-					http.Redirect(w, req, req.URL.String(), http.StatusMovedPermanently)
+					// Placement changes as nodes come and go, so the
+					// redirect is temporary and the target serves it
+					// without looking again
+					query := req.URL.Query()
+					query.Set("force", "1")
+					location := transport.URL("%s%s?%s", target, req.URL.EscapedPath(), query.Encode())
+					http.Redirect(w, req, location, http.StatusTemporaryRedirect)
 					return
 				}
 			}
 			onlyCache := req.URL.Query().Get("onlyCache") == "true"
 
-			data, ok := s.dm.CacheGet(path, blockNum)
+			// Cached blocks are written to the raw response writer so
+			// blocks on disk can go out with sendfile
+			reader, ok := s.dm.CacheOpen(path, blockNum)
 
 			if ok {
-				_, err = dataWriter.Write(data)
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Header().Set("Content-Length", strconv.FormatInt(reader.Len(), 10))
+				_, err = reader.WriteTo(w)
+				reader.Close()
 				if err != nil {
 					log.Errorf("Cache data return failed for %v: %v", req.RequestURI, err)
 					return
@@ -322,18 +415,26 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 
 			// Nope. I don't this data. Let's ask the metadata registry if someone else has a copy
-			candidate, ok := s.mm.QueryLocation(path, blockNum)
+			for _, candidate := range s.mm.QueryLocations(path, blockNum) {
+				// If I am the candidate then it looks like a parallel request went thorugh
+				// or I have deleted the file. Either way, download again.
+				if candidate == s.localAddress {
+					continue
+				}
 
-			// If I am the candidate then it looks like a parallel request went thorugh
-			// or I have deleted the file. Either way, download again.
-			if ok && candidate != s.localAddress {
 				log.Error("I don't have block but looks like someone else might")
 				// Someone else probably has a copy. Fetch it and ask them to delete it.
-				data, err = s.localClient.DirectGet(path, blockNum, candidate, true)
+				buf, err := s.localClient.DirectGet(path, blockNum, candidate, true)
+				if err == errNotCached {
+					// Stale location
+					s.mm.RemoveLocation(path, blockNum, candidate)
+					continue
+				}
 				if err == nil {
 					log.Error("Started copying\t", blockNum)
-					s.dm.CachePut(path, blockNum, data)
-					_, err = dataWriter.Write(data)
+					s.dm.CachePutBuffer(path, blockNum, buf)
+					_, err = buf.WriteTo(dataWriter)
+					buf.Release()
 					if err != nil {
 						log.Fatal(err)
 					}
@@ -344,12 +445,13 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 			// No one else has it. Just fetch it from S3 lol
 			log.Info("Block hit miss. Fetching from S3. ", path)
-			data, err = s.dm.Get(path, blockNum)
+			buf, err := s.dm.GetBuffer(path, blockNum)
 			if err != nil {
 				log.Fatal("Error on get: ", err)
 			}
 
-			_, err = dataWriter.Write(data)
+			_, err = buf.WriteTo(dataWriter)
+			buf.Release()
 			if err != nil {
 				log.Fatal("Error on write: ", err)
 			}
@@ -368,6 +470,11 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			Servers:   s.fastfs.GetServers(),
 			BlockSize: s.dm.BlockSize,
 		}
+		if wp, ok := s.partitioner.(partitioner.Weighted); ok {
+			data.Partitioner = wp.Algorithm()
+			data.Replicas = wp.Replicas()
+			data.Weights = wp.Weights()
+		}
 		res, _ := json.Marshal(data)
 		_, err := w.Write(res)
 		if err != nil {
@@ -392,14 +499,26 @@ func (s *Server) handlePut(w http.ResponseWriter, req *http.Request, path string
 		}
 
 		log.Infof("Receiving disaggregated block %v %v", path, blockNum)
-		buf := bytes.NewBuffer(nil)
-		io.Copy(buf, req.Body)
-		s.dm.CachePut(path, blockNum, buf.Bytes())
+		buf := s.dm.NewBuffer()
+		buf.ReadFrom(req.Body)
+		s.dm.CachePutBuffer(path, blockNum, buf)
+		buf.Release()
+		return
+	}
+
+	var ok bool
+	cond := parsePrecondition(req)
+	cond.Token, ok = fencingToken(w, req)
+	if !ok {
+		return
+	}
+	if cond.IsSet() {
+		s.handleConditionalPut(w, req, path, cond)
 		return
 	}
 
 	//s.dm.Upload(path, req.Body)
-	rag := s.dm.NewReverseAggregator(path, req.Body, 16)
+	rag := s.dm.NewReverseAggregator(path, req.Body, s.aggregatorParallelism)
 
 	s.dm.Upload(path, rag)
 	req.Body.Close()
@@ -409,11 +528,27 @@ func (s *Server) handlePut(w http.ResponseWriter, req *http.Request, path string
 
 func (s *Server) handleDelete(w http.ResponseWriter, req *http.Request, path string) {
 	log.Error("Deleting ", path)
+	var ok bool
+	cond := parsePrecondition(req)
+	cond.Token, ok = fencingToken(w, req)
+	if !ok {
+		return
+	}
+	if cond.IsSet() {
+		s.handleConditionalDelete(w, path, cond)
+		return
+	}
 	s.dm.Delete(path)
 }
 
 func (s *Server) Serve() {
-	err := http.ListenAndServe(s.localAddress, s)
+	s.mm.ClearLocations(s.localAddress)
+	ln, err := transport.Listen(s.localAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go s.resumeUploads()
+	err = transport.Serve(ln, s)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -437,21 +572,43 @@ func (s *Server) s3uploader() {
 		log.Info("Starting upload for ", path)
 
 		reader, writer := io.Pipe()
-		go s.dm.Upload(path, reader)
+		done := make(chan error)
+		go func() {
+			// The metadata was recorded on confirm
+			_, err := s.dm.Persist(path, reader)
+			// Unblock the writer if the upload gave up early
+			reader.CloseWithError(err)
+			done <- err
+		}()
 
 		n := int64(0)
-		for i := int64(0); i < uploadInput.NumBlocks; i += 1 {
+		var err error
+		for i := int64(0); i < uploadInput.NumBlocks && err == nil; i += 1 {
 			log.Infof("Uploading %s block %d", path, i)
 			target := s.partitioner.GetServer(path, i)
 
-			data, err := s.localClient.DirectGet(path, i, target, false)
+			var buf *bufpool.Buffer
+			buf, err = s.localClient.DirectGet(path, i, target, false)
 			if err != nil {
-				log.Fatal(err)
+				err = fmt.Errorf("block %d: %v", i, err)
+				break
 			}
-			ni, _ := writer.Write(data)
-			n += int64(ni)
+			var ni int64
+			ni, err = buf.WriteTo(writer)
+			buf.Release()
+			n += ni
+		}
+		// A missing block aborts the S3 upload instead of leaving a hole
+		writer.CloseWithError(err)
+		if persistErr := <-done; err == nil {
+			err = persistErr
+		}
+		if err != nil {
+			// The pending entry stays so the upload is retried on restart
+			log.Errorf("Failed to upload %v: %v", path, err)
+			continue
 		}
-		writer.Close()
+		s.mm.RemovePendingUpload(s.localAddress, path)
 
 		log.Errorf("Done uploading %v\tSize given: %v\tSize uploaded: %v", path, uploadInput.Size, n)
 	}
@@ -0,0 +1,176 @@
+package transport
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HMACScheme is the Authorization scheme of signed requests. The
+// credentials are <unix seconds>:<hex HMAC-SHA256 of method, request URI
+// and unix seconds, separated by newlines>. Bodies aren't signed. Clients
+// signing with their own key prefix them with <identity>:.
+const HMACScheme = "FASTFS-HMAC-SHA256"
+
+// maxClockSkew is how old or early a signature can be
+const maxClockSkew = 5 * time.Minute
+
+// Identities of requests that aren't from a client with its own identity.
+// Nodes sign requests with the shared Token or HMACKey or present a
+// certificate named in NodeNames, and only those requests are NodeIdentity.
+const (
+	NodeIdentity      = "node"
+	AnonymousIdentity = "anonymous"
+)
+
+var ErrUnauthorized = errors.New("request is not authenticated")
+
+type identityKey struct{}
+
+func signature(key string, method string, uri string, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s", method, uri, timestamp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign adds the configured credentials to req. Requests are signed if
+// there is an HMAC key and carry the bearer token otherwise.
+func Sign(req *http.Request) {
+	opts := options()
+	switch {
+	case opts.HMACKey != "":
+		SignAs(req, "", opts.HMACKey)
+	case opts.Token != "":
+		req.Header.Set("Authorization", "Bearer "+opts.Token)
+	}
+}
+
+// SignAs signs req with the HMAC key of identity, for clients with their
+// own key. An empty identity signs with the shared key of the nodes.
+func SignAs(req *http.Request, identity string, key string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	credentials := timestamp + ":" + signature(key, req.Method, req.URL.RequestURI(), timestamp)
+	if identity != "" {
+		credentials = identity + ":" + credentials
+	}
+	req.Header.Set("Authorization", HMACScheme+" "+credentials)
+}
+
+// Authenticate returns the identity of req. Presigned requests have the
+// identity they were signed for. The shared Token and HMACKey are
+// NodeIdentity, tokens of Tokens and keys of HMACKeys their identity and,
+// without credentials, verified client certificates their common name, or
+// NodeIdentity if it is one of NodeNames. Certificates named NodeIdentity
+// are rejected.
+// Everything is AnonymousIdentity if no credentials are configured.
+// Returns ErrUnauthorized if req has none of them.
+func Authenticate(req *http.Request) (string, error) {
+	opts := options()
+	if Presigned(req) {
+		return authenticatePresigned(req, opts.PresignKey)
+	}
+	if !opts.authenticates() {
+		return AnonymousIdentity, nil
+	}
+
+	// Nodes present their certificate and sign too, so credentials come
+	// first to tell them apart from clients
+	scheme, credentials := splitAuthorization(req.Header.Get("Authorization"))
+	switch scheme {
+	case "":
+		if opts.MutualTLS && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+			return certificateIdentity(req.TLS.VerifiedChains[0][0].Subject.CommonName, opts)
+		}
+	case "Bearer":
+		if opts.Token != "" && subtle.ConstantTimeCompare([]byte(credentials), []byte(opts.Token)) == 1 {
+			return NodeIdentity, nil
+		}
+		if identity, ok := opts.Tokens[credentials]; ok {
+			return identity, nil
+		}
+	case HMACScheme:
+		return authenticateHMAC(req, credentials, opts)
+	}
+	return "", ErrUnauthorized
+}
+
+// certificateIdentity returns the identity of a verified certificate with
+// common name name
+func certificateIdentity(name string, opts Options) (string, error) {
+	if name == NodeIdentity || name == "" {
+		return "", ErrUnauthorized
+	}
+	for _, node := range opts.NodeNames {
+		if name == node {
+			return NodeIdentity, nil
+		}
+	}
+	return name, nil
+}
+
+// authenticateHMAC checks credentials signed with the shared HMACKey, or
+// prefixed with an identity of HMACKeys and signed with its key
+func authenticateHMAC(req *http.Request, credentials string, opts Options) (string, error) {
+	identity, key := NodeIdentity, opts.HMACKey
+	parts := strings.Split(credentials, ":")
+	if len(parts) == 3 {
+		identity, key = parts[0], opts.HMACKeys[parts[0]]
+		parts = parts[1:]
+	}
+	if len(parts) != 2 || key == "" {
+		return "", ErrUnauthorized
+	}
+
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", ErrUnauthorized
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return "", ErrUnauthorized
+	}
+	expected := signature(key, req.Method, req.URL.RequestURI(), parts[0])
+	if !hmac.Equal([]byte(parts[1]), []byte(expected)) {
+		return "", ErrUnauthorized
+	}
+	return identity, nil
+}
+
+// Identity returns the identity of a request served by Authenticated
+func Identity(req *http.Request) string {
+	identity, ok := req.Context().Value(identityKey{}).(string)
+	if !ok {
+		return AnonymousIdentity
+	}
+	return identity
+}
+
+func splitAuthorization(header string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], strings.TrimSpace(parts[1])
+}
+
+// Authenticated rejects requests to handler that don't authenticate. The
+// identity of the others is available through Identity.
+func Authenticated(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity, err := Authenticate(req)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), identityKey{}, identity)))
+	})
+}
@@ -0,0 +1,193 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	err := Configure(Options{
+		Token:    "node-token",
+		HMACKey:  "node-key",
+		Tokens:   map[string]string{"client-token": "analytics"},
+		HMACKeys: map[string]string{"analytics": "client-key"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(Options{})
+
+	signed := func(prefix string, key string, method string, uri string, age time.Duration) string {
+		timestamp := strconv.FormatInt(time.Now().Add(-age).Unix(), 10)
+		return HMACScheme + " " + prefix + timestamp + ":" + signature(key, method, uri, timestamp)
+	}
+
+	testCases := []struct {
+		name          string
+		method        string
+		uri           string
+		authorization string
+		identity      string
+	}{
+		{"node token", "GET", "/get/a", "Bearer node-token", NodeIdentity},
+		{"client token", "GET", "/get/a", "Bearer client-token", "analytics"},
+		{"unknown token", "GET", "/get/a", "Bearer other", ""},
+		{"no credentials", "GET", "/get/a", "", ""},
+		{"node signature", "GET", "/get/a", signed("", "node-key", "GET", "/get/a", 0), NodeIdentity},
+		{"client signature", "GET", "/get/a", signed("analytics:", "client-key", "GET", "/get/a", 0), "analytics"},
+		{"client signing as node", "GET", "/get/a", signed("node:", "node-key", "GET", "/get/a", 0), ""},
+		{"client key without identity", "GET", "/get/a", signed("", "client-key", "GET", "/get/a", 0), ""},
+		{"node key with identity", "GET", "/get/a", signed("analytics:", "node-key", "GET", "/get/a", 0), ""},
+		{"unknown identity", "GET", "/get/a", signed("other:", "client-key", "GET", "/get/a", 0), ""},
+		{"wrong method", "PUT", "/get/a", signed("", "node-key", "GET", "/get/a", 0), ""},
+		{"wrong path", "GET", "/get/b", signed("", "node-key", "GET", "/get/a", 0), ""},
+		{"within skew", "GET", "/get/a", signed("", "node-key", "GET", "/get/a", 4*time.Minute), NodeIdentity},
+		{"replayed after skew", "GET", "/get/a", signed("", "node-key", "GET", "/get/a", 6*time.Minute), ""},
+		{"from the future", "GET", "/get/a", signed("", "node-key", "GET", "/get/a", -6*time.Minute), ""},
+		{"client replayed after skew", "GET", "/get/a",
+			signed("analytics:", "client-key", "GET", "/get/a", 6*time.Minute), ""},
+		{"malformed signature", "GET", "/get/a", HMACScheme + " nonsense", ""},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.uri, nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		identity, err := Authenticate(req)
+		if tc.identity == "" {
+			if err == nil {
+				t.Errorf("%v: authenticated as %v", tc.name, identity)
+			}
+			continue
+		}
+		if err != nil || identity != tc.identity {
+			t.Errorf("%v: got %v, %v, expected %v", tc.name, identity, err, tc.identity)
+		}
+	}
+}
+
+func TestSignAs(t *testing.T) {
+	err := Configure(Options{HMACKeys: map[string]string{"analytics": "client-key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(Options{})
+
+	req := httptest.NewRequest("GET", "/ls/logs/?format=json", nil)
+	SignAs(req, "analytics", "client-key")
+	identity, err := Authenticate(req)
+	if err != nil || identity != "analytics" {
+		t.Errorf("Got %v, %v", identity, err)
+	}
+}
+
+func TestConfigureReservesNodeIdentity(t *testing.T) {
+	defer Configure(Options{})
+	if Configure(Options{HMACKeys: map[string]string{NodeIdentity: "key"}}) == nil {
+		t.Error("An HMAC key of the node identity was accepted")
+	}
+	if Configure(Options{Tokens: map[string]string{"token": NodeIdentity}}) == nil {
+		t.Error("A token of the node identity was accepted")
+	}
+	if Configure(Options{NodeNames: []string{NodeIdentity}}) == nil {
+		t.Error("A node certificate named like the node identity was accepted")
+	}
+}
+
+// writeCertificate writes a self-signed certificate named name and its key
+// to dir, and returns the certificate
+func writeCertificate(t *testing.T, dir string, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600) != nil ||
+		ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600) != nil {
+		t.Fatal("Can't write the certificate")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestAuthenticateCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeCertificate(t, dir, "ca")
+	err = Configure(Options{
+		CertFile:  filepath.Join(dir, "ca.pem"),
+		KeyFile:   filepath.Join(dir, "ca.key"),
+		CAFile:    filepath.Join(dir, "ca.pem"),
+		MutualTLS: true,
+		Token:     "node-token",
+		NodeNames: []string{"node1.internal"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(Options{})
+
+	testCases := []struct {
+		name     string
+		identity string
+	}{
+		{"analytics", "analytics"},
+		{"node1.internal", NodeIdentity},
+		{NodeIdentity, ""},
+		{"", ""},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/get/a", nil)
+		cert := writeCertificate(t, dir, tc.name)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		identity, err := Authenticate(req)
+		if tc.identity == "" {
+			if err == nil {
+				t.Errorf("Certificate %q authenticated as %v", tc.name, identity)
+			}
+			continue
+		}
+		if err != nil || identity != tc.identity {
+			t.Errorf("Certificate %q: got %v, %v, expected %v", tc.name, identity, err, tc.identity)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Query parameters of presigned URLs
+const (
+	presignMethod    = "method"
+	presignExpires   = "expires"
+	presignRange     = "range"
+	presignIdentity  = "identity"
+	presignSignature = "signature"
+)
+
+// presignParams are the query parameters a presigned request may carry.
+// force only stops the node from redirecting.
+var presignParams = map[string]bool{
+	presignMethod: true, presignExpires: true, presignRange: true,
+	presignIdentity: true, presignSignature: true, "force": true,
+}
+
+var ErrPresignDisabled = errors.New("presigned URLs need a presign key")
+
+func presignature(key string, method string, path string, expires string, byteRange string, identity string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, path, expires, byteRange, identity)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Presign returns a URL of addr that anyone can make a method request to
+// until expires, with the permissions of identity. With a byteRange like
+// 0-1023 only those bytes are served. Nodes verify it with the shared
+// presign key alone.
+func Presign(addr string, method string, path string, identity string, expires time.Time,
+	byteRange string) (string, error) {
+	key := options().PresignKey
+	if key == "" {
+		return "", ErrPresignDisabled
+	}
+
+	escaped := (&url.URL{Path: path}).EscapedPath()
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{}
+	query.Set(presignMethod, method)
+	query.Set(presignExpires, unix)
+	if byteRange != "" {
+		query.Set(presignRange, byteRange)
+	}
+	query.Set(presignIdentity, identity)
+	query.Set(presignSignature, presignature(key, method, escaped, unix, byteRange, identity))
+	return URL("%s%s?%s", addr, escaped, query.Encode()), nil
+}
+
+// Presigned returns true if req is made with a presigned URL
+func Presigned(req *http.Request) bool {
+	return req.URL.Query().Get(presignSignature) != ""
+}
+
+// PresignedQuery returns the parameters of a presigned request, to carry
+// over when redirecting it
+func PresignedQuery(req *http.Request) string {
+	query := req.URL.Query()
+	query.Del("force")
+	return query.Encode()
+}
+
+// authenticatePresigned returns the identity a presigned request was signed
+// for. The signed byte range replaces any Range of req.
+func authenticatePresigned(req *http.Request, key string) (string, error) {
+	if key == "" {
+		return "", ErrUnauthorized
+	}
+	query := req.URL.Query()
+	for name := range query {
+		if !presignParams[name] {
+			return "", ErrUnauthorized
+		}
+	}
+
+	method := query.Get(presignMethod)
+	if method != req.Method {
+		return "", ErrUnauthorized
+	}
+	unix, err := strconv.ParseInt(query.Get(presignExpires), 10, 64)
+	if err != nil || time.Now().After(time.Unix(unix, 0)) {
+		return "", ErrUnauthorized
+	}
+
+	expected := presignature(key, method, req.URL.EscapedPath(), query.Get(presignExpires),
+		query.Get(presignRange), query.Get(presignIdentity))
+	if !hmac.Equal([]byte(query.Get(presignSignature)), []byte(expected)) {
+		return "", ErrUnauthorized
+	}
+
+	if byteRange := query.Get(presignRange); byteRange != "" {
+		req.Header.Set("Range", "bytes="+byteRange)
+	}
+	return query.Get(presignIdentity), nil
+}
@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPresigned(t *testing.T) {
+	err := Configure(Options{Token: "node-token", PresignKey: "presign-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(Options{})
+
+	presign := func(method string, expires time.Time, byteRange string) *url.URL {
+		signed, err := Presign("localhost:8100", method, "/get/logs/a b", "analytics", expires, byteRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	set := func(u *url.URL, name string, value string) *url.URL {
+		query := u.Query()
+		query.Set(name, value)
+		u.RawQuery = query.Encode()
+		return u
+	}
+	hour := time.Now().Add(time.Hour)
+
+	tampered := presign("GET", hour, "")
+	tampered.Path = "/get/logs/b"
+	tampered.RawPath = ""
+
+	testCases := []struct {
+		name   string
+		method string
+		url    *url.URL
+		ok     bool
+	}{
+		{"valid", "GET", presign("GET", hour, ""), true},
+		{"valid range", "GET", presign("GET", hour, "0-1023"), true},
+		{"forced", "GET", set(presign("GET", hour, ""), "force", "1"), true},
+		{"expired", "GET", presign("GET", time.Now().Add(-time.Second), ""), false},
+		{"wrong method", "PUT", presign("GET", hour, ""), false},
+		{"method changed", "PUT", set(presign("GET", hour, ""), presignMethod, "PUT"), false},
+		{"tampered path", "GET", tampered, false},
+		{"tampered range", "GET", set(presign("GET", hour, "0-1023"), presignRange, "0-4095"), false},
+		{"added range", "GET", set(presign("GET", hour, ""), presignRange, "0-1023"), false},
+		{"tampered identity", "GET", set(presign("GET", hour, ""), presignIdentity, "admin"), false},
+		{"extended", "GET", set(presign("GET", hour, ""), presignExpires, "99999999999"), false},
+		{"extra parameter", "GET", set(presign("GET", hour, ""), "recursive", "1"), false},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.url.RequestURI(), nil)
+		if !Presigned(req) {
+			t.Errorf("%v: not presigned", tc.name)
+			continue
+		}
+		identity, err := Authenticate(req)
+		if tc.ok && (err != nil || identity != "analytics") {
+			t.Errorf("%v: got %v, %v", tc.name, identity, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%v: authenticated as %v", tc.name, identity)
+		}
+	}
+}
+
+func TestPresignedRange(t *testing.T) {
+	err := Configure(Options{PresignKey: "presign-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(Options{})
+
+	signed, err := Presign("localhost:8100", "GET", "/get/a", "analytics", time.Now().Add(time.Hour), "0-1023")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(signed)
+	req := httptest.NewRequest("GET", u.RequestURI(), nil)
+	req.Header.Set("Range", "bytes=0-")
+	_, err = Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Range"); got != "bytes=0-1023" {
+		t.Errorf("Range is %v, expected the signed one", got)
+	}
+}
+
+func TestPresignDisabled(t *testing.T) {
+	defer Configure(Options{})
+	Configure(Options{})
+	_, err := Presign("localhost:8100", "GET", "/get/a", "analytics", time.Now().Add(time.Hour), "")
+	if err != ErrPresignDisabled {
+		t.Errorf("Got %v", err)
+	}
+}
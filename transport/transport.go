@@ -0,0 +1,260 @@
+// Package transport holds the HTTP settings shared by every connection of
+// FastFS, to clients and between nodes: TLS, mutual TLS and request
+// authentication. Everything is plain HTTP until Configure is called.
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options are the TLS and authentication settings
+type Options struct {
+	// CertFile and KeyFile are the certificate of this node. It is served
+	// to clients and presented to other nodes. Setting them enables TLS.
+	CertFile string
+	KeyFile  string
+
+	// CAFile is the CA certificates are verified against. The system roots
+	// are used if empty.
+	CAFile string
+
+	// MutualTLS requires certificates signed by CAFile from peers. With a
+	// Token or HMACKey, clients may instead present those.
+	MutualTLS bool
+
+	// Token is a bearer token requests must carry
+	Token string
+
+	// HMACKey is a key requests can be signed with instead of carrying
+	// Token
+	HMACKey string
+
+	// Tokens are bearer tokens of clients with their own identity, by
+	// token
+	Tokens map[string]string
+
+	// HMACKeys are keys clients with their own identity sign requests
+	// with, by identity
+	HMACKeys map[string]string
+
+	// PresignKey is the key presigned URLs are signed with. Every node
+	// needs the same one.
+	PresignKey string
+
+	// NodeNames are the common names of node certificates. With MutualTLS
+	// requests presenting one of them are NodeIdentity.
+	NodeNames []string
+}
+
+// authenticates returns true if requests need credentials
+func (opts Options) authenticates() bool {
+	return opts.Token != "" || opts.HMACKey != "" || len(opts.Tokens) > 0 || len(opts.HMACKeys) > 0
+}
+
+// Authenticates returns true if requests need credentials
+func Authenticates() bool {
+	return options().authenticates()
+}
+
+var shared struct {
+	mu        sync.RWMutex
+	opts      Options
+	tlsConfig *tls.Config
+	transport *http.Transport
+}
+
+func init() {
+	shared.transport = newTransport(nil)
+}
+
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	return t
+}
+
+// Configure sets the options of every connection made or served afterwards
+func Configure(opts Options) error {
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return errors.New("a TLS certificate needs both a cert and a key file")
+	}
+	if opts.MutualTLS && (opts.CertFile == "" || opts.CAFile == "") {
+		return errors.New("mutual TLS needs a cert, key and CA file")
+	}
+	for _, identity := range opts.Tokens {
+		if identity == NodeIdentity {
+			return fmt.Errorf("%q can't be the identity of a token", identity)
+		}
+	}
+	for _, name := range opts.NodeNames {
+		if name == NodeIdentity || name == "" {
+			return fmt.Errorf("%q can't be the name of a node certificate", name)
+		}
+	}
+	for identity := range opts.HMACKeys {
+		if identity == NodeIdentity || identity == "" || strings.Contains(identity, ":") {
+			return fmt.Errorf("%q can't be the identity of an HMAC key", identity)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+		if opts.CAFile != "" {
+			data, err := ioutil.ReadFile(opts.CAFile)
+			if err != nil {
+				return err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return fmt.Errorf("%v holds no PEM certificates", opts.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+			tlsConfig.ClientCAs = pool
+		}
+
+		switch {
+		case opts.MutualTLS && opts.authenticates():
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		case opts.MutualTLS:
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	shared.opts = opts
+	shared.tlsConfig = tlsConfig
+	shared.transport = newTransport(tlsConfig)
+	return nil
+}
+
+func options() Options {
+	shared.mu.RLock()
+	defer shared.mu.RUnlock()
+	return shared.opts
+}
+
+// Scheme returns https if TLS is on and http otherwise
+func Scheme() string {
+	if options().CertFile != "" {
+		return "https"
+	}
+	return "http"
+}
+
+// NodeTLSConfig returns the TLS settings of connections that are only
+// between nodes, or nil if TLS is off. With mutual TLS both ends always
+// present certificates.
+func NodeTLSConfig() *tls.Config {
+	shared.mu.RLock()
+	defer shared.mu.RUnlock()
+	if shared.tlsConfig == nil {
+		return nil
+	}
+	config := shared.tlsConfig.Clone()
+	if shared.opts.MutualTLS {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// URL formats a URL with the current scheme. format starts with the host.
+func URL(format string, args ...interface{}) string {
+	return Scheme() + "://" + fmt.Sprintf(format, args...)
+}
+
+// NewClient returns a client using the shared connections and TLS settings.
+// Redirected requests are signed again. A timeout of 0 means none.
+func NewClient(timeout time.Duration) *http.Client {
+	shared.mu.RLock()
+	defer shared.mu.RUnlock()
+	return &http.Client{
+		Transport: shared.transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			Sign(req)
+			return nil
+		},
+	}
+}
+
+// Do signs req and sends it
+func Do(req *http.Request) (*http.Response, error) {
+	Sign(req)
+	return NewClient(0).Do(req)
+}
+
+func Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Do(req)
+}
+
+func Post(url string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return Do(req)
+}
+
+// ListenAndServe serves handler on addr, over TLS if it is on. Requests
+// that don't authenticate are rejected.
+func ListenAndServe(addr string, handler http.Handler) error {
+	ln, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	return Serve(ln, handler)
+}
+
+// Listen binds addr, over TLS if it is on, so callers know the address is
+// up before they start serving on it
+func Listen(addr string) (net.Listener, error) {
+	shared.mu.RLock()
+	tlsConfig := shared.tlsConfig
+	shared.mu.RUnlock()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return ln, nil
+	}
+	// Offer HTTP/2 like http.Server.ListenAndServeTLS does
+	tlsConfig = tlsConfig.Clone()
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// Serve serves handler on a listener from Listen. Requests that don't
+// authenticate are rejected.
+func Serve(ln net.Listener, handler http.Handler) error {
+	server := &http.Server{Handler: Authenticated(handler)}
+	return server.Serve(ln)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rahulgovind/fastfs/common"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type warmTask struct {
+	path  string
+	block int64
+}
+
+func parseWarmOptions(req *http.Request) (pin bool, ttl time.Duration) {
+	pin = req.URL.Query().Get("pin") == "1" || req.URL.Query().Get("pin") == "true"
+	ttlSeconds, _ := strconv.ParseInt(req.URL.Query().Get("ttl"), 10, 64)
+	return pin, time.Duration(ttlSeconds) * time.Second
+}
+
+func (s *Server) handleAdmin(w http.ResponseWriter, req *http.Request, path string) {
+	action := path
+	rest := ""
+	if idx := strings.Index(path, "/"); idx != -1 {
+		action = path[:idx]
+		rest = path[idx+1:]
+	}
+
+	switch action {
+	case "warm":
+		s.handleWarm(w, req)
+	case "warmblock":
+		s.handleWarmBlock(w, req, rest)
+	case "unpin":
+		s.handleUnpin(w, req)
+	case "reconcile":
+		s.handleReconcile(w, req)
+	case "invalidate":
+		s.handleInvalidate(w, req)
+	case "drift":
+		s.handleDrift(w, req)
+	case "usage":
+		res, _ := json.Marshal(s.dm.CacheUsage())
+		_, err := w.Write(res)
+		if err != nil {
+			log.Error(err)
+		}
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// handleWarm loads every file in the given prefix into the cluster cache.
+// Blocks are fetched by the nodes that own them and progress is streamed
+// back as one JSON object per line.
+func (s *Server) handleWarm(w http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("prefix")
+	pin, ttl := parseWarmOptions(req)
+
+	fl, err := s.mm.GetList(prefix)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	progress := common.WarmProgress{Prefix: prefix, Files: len(fl.Files)}
+	blockSize := s.localClient.BlockSize
+	for _, file := range fl.Files {
+		progress.Blocks += (file.Size + blockSize - 1) / blockSize
+	}
+
+	tasks := make(chan warmTask, 1024)
+	results := make(chan error, 1024)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 16; i += 1 {
+		wg.Add(1)
+		go func() {
+			for task := range tasks {
+				results <- s.warmBlock(task.path, task.block, pin, ttl)
+			}
+			wg.Done()
+		}()
+	}
+
+	go func() {
+		for _, file := range fl.Files {
+			numBlocks := (file.Size + blockSize - 1) / blockSize
+			for block := int64(0); block < numBlocks; block += 1 {
+				tasks <- warmTask{file.Path, block}
+			}
+		}
+		close(tasks)
+		wg.Wait()
+		close(results)
+	}()
+
+	log.Infof("Warming %v: %d files, %d blocks, pin: %v", prefix, progress.Files, progress.Blocks, pin)
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	lastReport := time.Now()
+
+	for err := range results {
+		if err != nil {
+			log.Error(err)
+			progress.Failed += 1
+		} else {
+			progress.Done += 1
+		}
+
+		if time.Since(lastReport) > time.Second {
+			encoder.Encode(progress)
+			if flusher != nil {
+				flusher.Flush()
+			}
+			lastReport = time.Now()
+		}
+	}
+
+	progress.Complete = true
+	encoder.Encode(progress)
+}
+
+// warmBlock makes sure the block is cached on the node that owns it
+func (s *Server) warmBlock(path string, block int64, pin bool, ttl time.Duration) error {
+	target := s.partitioner.GetServer(path, block)
+	if target != s.localAddress {
+		return s.localClient.Warm(path, block, target, pin, ttl)
+	}
+	return s.warmLocal(path, block, pin, ttl)
+}
+
+func (s *Server) warmLocal(path string, block int64, pin bool, ttl time.Duration) error {
+	_, err := s.dm.Get(path, block)
+	if err != nil {
+		return err
+	}
+
+	if pin && !s.dm.CachePin(path, block, ttl) {
+		return fmt.Errorf("could not pin %v block %v", path, block)
+	}
+	return nil
+}
+
+func (s *Server) handleWarmBlock(w http.ResponseWriter, req *http.Request, path string) {
+	block, err := strconv.ParseInt(req.URL.Query().Get("block"), 10, 64)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(400)
+		return
+	}
+
+	pin, ttl := parseWarmOptions(req)
+
+	err = s.warmLocal(path, block, pin, ttl)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(500)
+	}
+}
+
+// handleUnpin releases pins under prefix on this node, or on every node
+// in the cluster unless local is set.
+func (s *Server) handleUnpin(w http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("prefix")
+
+	var result common.UnpinResponse
+	if req.URL.Query().Get("local") == "1" {
+		result.Unpinned = s.dm.CacheUnpinPrefix(prefix)
+	} else {
+		for _, server := range s.fastfs.GetServers() {
+			n, err := s.localClient.Unpin(prefix, server)
+			if err != nil {
+				log.Errorf("Unpinning %v on %v failed: %v", prefix, server, err)
+				continue
+			}
+			result.Unpinned += n
+		}
+	}
+
+	res, _ := json.Marshal(result)
+	_, err := w.Write(res)
+	if err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rahulgovind/fastfs/common"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How often watchers check the event log for new events
+	watchPollInterval = 250 * time.Millisecond
+	watchBatch        = 1000
+	maxWatchTimeout   = 5 * time.Minute
+	sseKeepAlive      = 15 * time.Second
+)
+
+// handleWatch streams create, overwrite and delete events of files under
+// prefix. Watching starts after the token query parameter (or the
+// Last-Event-ID header) and from now on without one. Clients that accept
+// text/event-stream get server-sent events. Everyone else long-polls: the
+// request returns as soon as there are events or after timeout seconds.
+func (s *Server) handleWatch(w http.ResponseWriter, req *http.Request, prefix string) {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		token = req.Header.Get("Last-Event-ID")
+	}
+	if token == "" {
+		var err error
+		token, err = s.mm.LatestToken()
+		if err != nil {
+			log.Error(err)
+			w.WriteHeader(503)
+			return
+		}
+	}
+
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		s.streamEvents(w, req, prefix, token)
+		return
+	}
+
+	timeout := 30 * time.Second
+	if t := req.URL.Query().Get("timeout"); t != "" {
+		seconds, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if timeout > maxWatchTimeout {
+		timeout = maxWatchTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	var result common.WatchResponse
+	for {
+		events, next, err := s.mm.Events(prefix, token, watchBatch)
+		if err != nil {
+			log.Error(err)
+			w.WriteHeader(400)
+			return
+		}
+		token = next
+
+		if len(events) > 0 || time.Now().After(deadline) {
+			result.Events = events
+			break
+		}
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(watchPollInterval):
+		}
+	}
+
+	result.Token = token
+	w.Header().Set("Content-Type", "application/json")
+	res, _ := json.Marshal(result)
+	_, err := w.Write(res)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (s *Server) streamEvents(w http.ResponseWriter, req *http.Request, prefix string, token string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	lastWrite := time.Now()
+	for {
+		events, next, err := s.mm.Events(prefix, token, watchBatch)
+		if err != nil {
+			log.Error(err)
+			fmt.Fprintf(w, "event: error\ndata: %v\n\n", err)
+			flusher.Flush()
+			return
+		}
+		token = next
+
+		for _, event := range events {
+			data, _ := json.Marshal(event)
+			_, err = fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", event.Token, event.Type, data)
+			if err != nil {
+				return
+			}
+			lastWrite = time.Now()
+		}
+
+		// Comments keep proxies from closing idle streams
+		if time.Since(lastWrite) > sseKeepAlive {
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			lastWrite = time.Now()
+		}
+		flusher.Flush()
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(watchPollInterval):
+		}
+	}
+}